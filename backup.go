@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ========================== Backup ==========================
+// A backup is the tree of a pinned meta page, copied page by page to a
+// standalone database file encrypted with the same key. Only the pages the
+// meta page reaches are copied, numbered in the order they are written: the
+// tree level by level from the first internal page, right after the meta
+// slots, then the overflow chains in key order. Pointers are remapped to these
+// numbers, so the backup has no free pages. Commits made during the backup are
+// not in it. Commits only in the log are, the backup has no log.
+
+// State of a backup being written to w
+type backupWriter struct {
+	tree        *BPTreeDisk
+	w           io.Writer
+	buffer      *bytes.Buffer
+	cipher      *pageCipher // Of the tree when the backup started
+	compression uint8
+	levels      [][]uint64 // Tree pages of each level, from the first internal page
+	noverflow   uint64     // Overflow pages of all chains
+	chains      []KeyVal   // Values in overflow pages, in the order of the chains
+	next        uint64     // Where the next block goes in the backup
+}
+
+// Write a backup of the committed tree to dstPath. The file is written next
+// to dstPath first, so dstPath is a complete backup or is left as it was.
+func (tree *BPTreeDisk) BackupFile(dstPath string) error {
+	if sameFile(tree.fileName, dstPath) {
+		return fmt.Errorf("backup %s: destination is the database file", dstPath)
+	}
+	tmpPath := dstPath + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	err = tree.Backup(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = os.Rename(tmpPath, dstPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	syncDir(filepath.Dir(dstPath))
+	return nil
+}
+
+// Stream a backup of the committed tree to w, see BackupSnapshot.
+func (tree *BPTreeDisk) Backup(w io.Writer) error {
+	// Pin first: a commit between loading the meta page and pinning it could
+	// free its pages
+	epoch := tree.Pin()
+	defer tree.Unpin(epoch)
+	metaPage, err := tree.LoadMetaPage()
+	if err != nil {
+		return err
+	}
+	return tree.BackupSnapshot(metaPage, w)
+}
+
+// Stream a backup of the tree of metaPage to w, in the format of a database
+// file. metaPage has to stay pinned until this returns, see Pin. The tree is
+// only locked while each page is read, writers go on meanwhile.
+// Step 1: Number the pages, the meta page needs their count
+// Step 2: Meta page in both slots
+// Step 3: Tree pages, level by level
+// Step 4: Overflow chains
+func (tree *BPTreeDisk) BackupSnapshot(metaPage MetaPage, w io.Writer) error {
+	b := backupWriter{tree: tree, w: w, buffer: new(bytes.Buffer)}
+	tree.mu.RLock()
+	b.cipher, b.compression = tree.cipher, tree.compression
+	tree.mu.RUnlock()
+	if err := b.layout(metaPage); err != nil {
+		return err
+	}
+	if err := b.writeMeta(metaPage); err != nil {
+		return err
+	}
+	// Children of the first level are the pages after it, the overflow chains
+	// come after the last level
+	childPtr := uint64(META_SLOTS+len(b.levels[0])) * BLOCK_SIZE
+	overflowPtr := (META_SLOTS + b.treePages()) * BLOCK_SIZE
+	linked := metaPage.header.flags&PAGE_FLAG_LINKED != 0
+	for _, level := range b.levels {
+		for i, ptr := range level {
+			node, err := b.readNode(ptr)
+			if err != nil {
+				return err
+			}
+			b.buffer.Reset()
+			if convert, ok := node.(*BTreeInternalPage); ok {
+				for k := range convert.children {
+					convert.children[k] = childPtr
+					childPtr += BLOCK_SIZE
+				}
+				if err := convert.write_to_buffer(b.buffer); err != nil {
+					return err
+				}
+				if err := b.write(b.buffer.Bytes()); err != nil {
+					return err
+				}
+				continue
+			}
+			convert := node.(*BTreeLeafPage)
+			// Leaves of a level are next to each other in the backup
+			convert.header.next_page_pointer = 0
+			if linked && i+1 < len(level) {
+				convert.header.next_page_pointer = b.next + BLOCK_SIZE
+			}
+			for k := range convert.kv {
+				kv := &convert.kv[k]
+				if kv.overflow_ptr == 0 {
+					continue
+				}
+				b.chains = append(b.chains, *kv)
+				kv.overflow_ptr = overflowPtr
+				overflowPtr += overflowPages(kv) * BLOCK_SIZE
+			}
+			if err := convert.write_to_buffer(b.buffer); err != nil {
+				return err
+			}
+			page := encodeLeafPage(b.buffer, b.compression)
+			if len(page) > PAGE_SIZE {
+				// Written compressed by the tree, which does not compress anymore
+				page = encodeLeafPage(b.buffer, COMPRESSION_FLATE)
+			}
+			if err := b.write(page); err != nil {
+				return err
+			}
+		}
+	}
+	for i := range b.chains {
+		if err := b.writeOverflow(&b.chains[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Overflow pages holding the value of kv
+func overflowPages(kv *KeyVal) uint64 {
+	return (kv.overflow_len + OVERFLOW_MAX_DATA - 1) / OVERFLOW_MAX_DATA
+}
+
+// Read a page of the tree, locked for that page only.
+func (b *backupWriter) readNode(ptr uint64) (any, error) {
+	b.tree.mu.RLock()
+	defer b.tree.mu.RUnlock()
+	pager, err := b.tree.getPager()
+	if err != nil {
+		return nil, err
+	}
+	return b.tree.readNode(ptr, b.buffer, pager)
+}
+
+// Walk the tree of metaPage level by level, as Stats does, to list its pages
+// and count the overflow pages.
+func (b *backupWriter) layout(metaPage MetaPage) error {
+	level := []uint64{}
+	if metaPage.header.next_page_pointer != 0 {
+		level = append(level, metaPage.header.next_page_pointer)
+	}
+	b.levels = [][]uint64{level}
+	for len(level) > 0 {
+		next := []uint64{}
+		for _, ptr := range level {
+			node, err := b.readNode(ptr)
+			if err != nil {
+				return err
+			}
+			if convert, ok := node.(*BTreeInternalPage); ok {
+				next = append(next, convert.children...)
+				continue
+			}
+			for _, kv := range node.(*BTreeLeafPage).kv {
+				if kv.overflow_ptr != 0 {
+					b.noverflow += overflowPages(&kv)
+				}
+			}
+		}
+		if len(next) > 0 {
+			b.levels = append(b.levels, next)
+		}
+		level = next
+	}
+	return nil
+}
+
+// Internal and leaf pages of the tree
+func (b *backupWriter) treePages() uint64 {
+	var n uint64 = 0
+	for _, level := range b.levels {
+		n += uint64(len(level))
+	}
+	return n
+}
+
+// Write metaPage to both meta slots, pointing to the pages of the backup.
+func (b *backupWriter) writeMeta(metaPage MetaPage) error {
+	if b.treePages() > 0 {
+		metaPage.header.next_page_pointer = META_SLOTS * BLOCK_SIZE
+	}
+	metaPage.free_list_pointer = 0
+	metaPage.last_free = META_SLOTS + b.treePages() + b.noverflow
+	metaPage.compression = b.compression
+	if b.cipher != nil {
+		metaPage.encryption = ENCRYPTION_AES_GCM
+		metaPage.key_salt = b.cipher.salt
+		metaPage.key_check = b.cipher.key_check
+	} else {
+		metaPage.encryption = ENCRYPTION_NONE
+		metaPage.key_salt = [16]uint8{}
+		metaPage.key_check = [16]uint8{}
+	}
+	for range META_SLOTS {
+		b.buffer.Reset()
+		if err := metaPage.write_to_buffer(b.buffer); err != nil {
+			return err
+		}
+		if err := b.write(b.buffer.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy the overflow chain of kv to the next blocks, each page links to the
+// one right after it.
+func (b *backupWriter) writeOverflow(kv *KeyVal) error {
+	pages := []OverflowPage{}
+	b.tree.mu.RLock()
+	pager, err := b.tree.getPager()
+	if err == nil {
+		err = b.tree.walkOverflow(kv, b.buffer, pager, func(ptr uint64, oPage *OverflowPage) {
+			pages = append(pages, *oPage)
+		})
+	}
+	b.tree.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	for i := range pages {
+		pages[i].header.next_page_pointer = 0
+		if i+1 < len(pages) {
+			pages[i].header.next_page_pointer = b.next + BLOCK_SIZE
+		}
+		b.buffer.Reset()
+		if err := pages[i].write_to_buffer(b.buffer); err != nil {
+			return err
+		}
+		if err := b.write(b.buffer.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Seal a page for the next block of the backup, encrypt it but for the meta
+// slots, and write it.
+func (b *backupWriter) write(page []byte) error {
+	block, err := sealBuffer(bytes.NewBuffer(page), b.next)
+	if err != nil {
+		return err
+	}
+	if b.cipher != nil && !isMetaSlot(b.next) {
+		if block, err = b.cipher.encrypt(block, b.next); err != nil {
+			return err
+		}
+	}
+	if _, err := b.w.Write(block); err != nil {
+		return err
+	}
+	b.next += BLOCK_SIZE
+	return nil
+}
+
+// Install the backup read from r as the database file dbPath, which must not
+// be open. The backup is validated first: it has to open with key and pass
+// Check, otherwise dbPath is left as it was.
+// Step 1: Write the backup to a file next to dbPath
+// Step 2: Open and check it
+// Step 3: Remove the log of the old file, then swap the files
+func RestoreBackup(r io.Reader, dbPath string, key []byte) error {
+	tmpPath := dbPath + ".restore"
+	file, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, r)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = checkBackup(tmpPath, key)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("restore %s: %w", dbPath, err)
+	}
+	// The log is of the old file, it must not be replayed on the backup
+	if err := os.Remove(dbPath + WAL_SUFFIX); err != nil && !errors.Is(err, os.ErrNotExist) {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, dbPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	syncDir(filepath.Dir(dbPath))
+	return nil
+}
+
+func checkBackup(path string, key []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() < META_SLOTS*BLOCK_SIZE || info.Size()%BLOCK_SIZE != 0 {
+		return fmt.Errorf("%w: backup of %d bytes", ErrCorrupt, info.Size())
+	}
+	tree, err := OpenBPTreeDiskWithKey(path, key)
+	if err != nil {
+		return err
+	}
+	defer tree.Close()
+	report, err := tree.Check()
+	if err != nil {
+		return err
+	}
+	if !report.OK() {
+		return fmt.Errorf("%w: backup fails check: %v", ErrCorrupt, report.Errors[0])
+	}
+	return nil
+}
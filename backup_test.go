@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"maps"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Backup to a buffer while another goroutine sets random keys, with a commit
+// after each, up to maxWrites. Return the backup and the writes committed from
+// the start.
+func backupWhileWriting(tb testing.TB, tree *BPTreeDisk, r *rand.Rand, model map[string][]byte, maxWrites int) (*bytes.Buffer, []walWrite) {
+	tb.Helper()
+	writes := []walWrite{}
+	started := make(chan struct{})
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	// Only the test goroutine can stop the test, errors are sent back on done
+	write := func(key []byte, val []byte) error {
+		meta, err := tree.LoadMetaPage()
+		if err != nil {
+			return err
+		}
+		if meta, err = tree.Set(meta, key, val); err != nil {
+			return err
+		}
+		return tree.WriteMetaPage(meta)
+	}
+	go func() {
+		defer close(done)
+		for len(writes) < maxWrites {
+			key := intToSlice(int64(r.Intn(len(model) + 100)))
+			val := randomBytes(r, 0, 100)
+			if err := write(key, val); err != nil {
+				done <- err
+				if len(writes) == 0 {
+					close(started)
+				}
+				return
+			}
+			model[string(key)] = val
+			writes = append(writes, walWrite{op: WAL_SET, key: key, val: val})
+			if len(writes) == 1 {
+				close(started)
+			}
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+	}()
+	<-started
+	backup := new(bytes.Buffer)
+	err := tree.Backup(backup)
+	close(stop)
+	mustOK(tb, <-done)
+	mustOK(tb, err)
+	return backup, writes
+}
+
+// The content of the restored backup is the tree of one of the commits: base
+// with the first writes applied.
+func checkBackupContent(t *testing.T, backup *bytes.Buffer, base map[string][]byte, writes []walWrite) {
+	t.Helper()
+	restorePath := filepath.Join(t.TempDir(), "restored.db")
+	mustOK(t, RestoreBackup(bytes.NewReader(backup.Bytes()), restorePath, nil))
+	restored := must(OpenBPTreeDisk(restorePath))(t)
+	defer restored.Close()
+	if report := must(restored.Check())(t); !report.OK() || report.FreePages != 0 {
+		t.Errorf("%d free pages, errors:\n%s", report.FreePages, checkErrors(report))
+	}
+	content := must(treeContent(&restored, must(restored.LoadMetaPage())(t)))(t)
+	// Count the keys that differ as the writes are applied one by one
+	state := maps.Clone(base)
+	differs := func(key string) int {
+		val, ok := state[key]
+		restoredVal, restoredOK := content[key]
+		if ok != restoredOK || !bytes.Equal(val, restoredVal) {
+			return 1
+		}
+		return 0
+	}
+	diff := 0
+	for key := range state {
+		diff += differs(key)
+	}
+	for key := range content {
+		if _, ok := state[key]; !ok {
+			diff += 1
+		}
+	}
+	for i := 0; diff != 0; i++ {
+		if i == len(writes) {
+			t.Errorf("Backup of %d keys is not the tree of a commit", len(content))
+			return
+		}
+		key := string(writes[i].key)
+		diff -= differs(key)
+		state[key] = writes[i].val
+		diff += differs(key)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	dbPath := testDBPath(t)
+	r := rand.New(rand.NewSource(1))
+	model := map[string][]byte{}
+	test_db := must(NewBPTreeDisk(dbPath))(t)
+	defer test_db.Close()
+	mustOK(t, test_db.WriteMetaPage(must(test_db.BulkLoad(sortedTestPairs(2000), 1))(t)))
+	for key, val := range sortedTestPairs(2000) {
+		model[string(key)] = val
+	}
+	walWrites(t, &test_db, r, model, 1000)
+
+	// Writes go on, the backup has the tree of a commit
+	base := maps.Clone(model)
+	backup, writes := backupWhileWriting(t, &test_db, r, model, 200)
+	if backup.Len()%BLOCK_SIZE != 0 || int64(backup.Len()) >= must(os.Stat(dbPath))(t).Size() {
+		t.Errorf("Expected a dense backup, got %d bytes", backup.Len())
+	}
+	checkBackupContent(t, backup, base, writes)
+	checkContent(t, &test_db, model)
+
+	// Same in WAL mode, pages of the commits are in memory
+	mustOK(t, test_db.EnableWAL(0))
+	base = maps.Clone(model)
+	backup, writes = backupWhileWriting(t, &test_db, r, model, 200)
+	checkBackupContent(t, backup, base, writes)
+	checkContent(t, &test_db, model)
+	mustOK(t, test_db.DisableWAL())
+
+	// To a file, not onto the database file
+	backupPath := filepath.Join(t.TempDir(), "backup.db")
+	mustOK(t, test_db.BackupFile(backupPath))
+	if err := test_db.BackupFile(dbPath); err == nil {
+		t.Errorf("Backup onto the database file should fail")
+	}
+	backupFile := must(os.Open(backupPath))(t)
+	defer backupFile.Close()
+	restorePath := filepath.Join(t.TempDir(), "restored.db")
+	mustOK(t, RestoreBackup(backupFile, restorePath, nil))
+	restored := must(OpenBPTreeDisk(restorePath))(t)
+	defer restored.Close()
+	checkContent(t, &restored, model)
+}
+
+func TestBackup_Restore(t *testing.T) {
+	dbPath := testDBPath(t)
+	kv := &KV{fileName: dbPath, key: testKey}
+	mustOK(t, kv.Open())
+	defer kv.Close()
+	mustOK(t, kv.tree.EnableWAL(0))
+	meta := must(kv.LoadMetaPage())(t)
+	meta = must(kv.Set(meta, []byte("name"), []byte("Adam")))(t)
+	mustOK(t, kv.WriteMetaPage(meta))
+	backup := new(bytes.Buffer)
+	mustOK(t, kv.Backup(backup))
+	meta = must(kv.Set(meta, []byte("name"), []byte("Eve")))(t)
+	mustOK(t, kv.WriteMetaPage(meta))
+
+	// Not valid: the database is left as it is
+	damaged := bytes.Clone(backup.Bytes())
+	damaged[len(damaged)-BLOCK_SIZE/2] ^= 0xFF
+	for _, data := range [][]byte{damaged, backup.Bytes()[:3*BLOCK_SIZE+10], nil} {
+		if err := kv.Restore(bytes.NewReader(data)); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("Expected ErrCorrupt for a backup of %d bytes, got %v", len(data), err)
+		}
+	}
+	val := must(kv.Get(must(kv.LoadMetaPage())(t), []byte("name")))(t)
+	if !bytes.Equal(val, []byte("Eve")) {
+		t.Errorf("Get after a failed restore: expected Eve, got %q", val)
+	}
+	other := &KV{fileName: testDBPath(t)}
+	mustOK(t, other.Open())
+	defer other.Close()
+	if err := other.Restore(bytes.NewReader(backup.Bytes())); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Expected ErrWrongKey, got %v", err)
+	}
+
+	// The backup has the commit that was only in the log, and the log of
+	// the old file is not replayed on it
+	mustOK(t, kv.Restore(bytes.NewReader(backup.Bytes())))
+	val = must(kv.Get(must(kv.LoadMetaPage())(t), []byte("name")))(t)
+	if !bytes.Equal(val, []byte("Adam")) {
+		t.Errorf("Get after restore: expected Adam, got %q", val)
+	}
+	if kv.tree.wal != nil || kv.tree.cipher == nil {
+		t.Errorf("Expected an encrypted database without a log")
+	}
+}
+
+// A tree in memory is backed up without a file anywhere
+func TestBackup_InMemory(t *testing.T) {
+	test_db := newTestTree(t)
+	defer test_db.Close()
+	mustOK(t, test_db.WriteMetaPage(must(test_db.BulkLoad(sortedTestPairs(300), 1))(t)))
+	workDir := t.TempDir()
+	t.Chdir(workDir)
+	mustOK(t, os.Remove(workDir))
+	backup := new(bytes.Buffer)
+	mustOK(t, test_db.Backup(backup))
+	dbPath := testDBPath(t)
+	mustOK(t, RestoreBackup(bytes.NewReader(backup.Bytes()), dbPath, nil))
+	restored := must(OpenBPTreeDisk(dbPath))(t)
+	defer restored.Close()
+	if report := must(restored.Check())(t); report.Keys != 300 {
+		t.Errorf("Restored backup: expected 300 keys, got %d", report.Keys)
+	}
+}
+
+// The snapshot of a transaction is exported as it was when it began, with its
+// leaf links, compressed and encrypted pages and overflow chains
+func TestBackup_Snapshot(t *testing.T) {
+	dbPath := testDBPath(t)
+	kv := &KV{fileName: dbPath, key: testKey}
+	mustOK(t, kv.Open())
+	defer kv.Close()
+	mustOK(t, kv.tree.SetCompression(COMPRESSION_FLATE))
+	mustOK(t, kv.WriteMetaPage(must(kv.BulkLoad(sortedTestPairs(1000), 1))(t)))
+	meta := must(kv.LoadMetaPage())(t)
+	big := bytes.Repeat(textValue(0), 100)
+	meta = must(kv.Set(meta, intToSlice(0), big))(t)
+	mustOK(t, kv.WriteMetaPage(meta))
+	// Built again from its pairs, the leaves are linked
+	pairs, _ := kv.All(meta)
+	bulk := must(kv.BulkLoad(pairs, 1))(t)
+	mustOK(t, kv.WriteMetaPage(bulk))
+	model := must(treeContent(&kv.tree, bulk))(t)
+
+	tx := KVTX{}
+	mustOK(t, kv.Begin(&tx))
+	// Commits after the snapshot are not in its backup, and do not reuse its pages
+	for i := range 500 {
+		meta = must(kv.LoadMetaPage())(t)
+		meta = must(kv.Del(meta, intToSlice(int64(i))))(t)
+		mustOK(t, kv.WriteMetaPage(meta))
+	}
+	backup := new(bytes.Buffer)
+	mustOK(t, kv.BackupSnapshot(&tx, backup))
+	kv.Abort(&tx)
+
+	restorePath := filepath.Join(t.TempDir(), "restored.db")
+	mustOK(t, RestoreBackup(bytes.NewReader(backup.Bytes()), restorePath, testKey))
+	restored := must(OpenBPTreeDiskWithKey(restorePath, testKey))(t)
+	defer restored.Close()
+	restoredMeta := must(restored.LoadMetaPage())(t)
+	if restoredMeta.header.flags&PAGE_FLAG_LINKED == 0 || restoredMeta.compression != COMPRESSION_FLATE {
+		t.Errorf("Expected a linked tree with compression, got flags %d, compression %d", restoredMeta.header.flags, restoredMeta.compression)
+	}
+	if report := must(restored.Check())(t); !report.OK() || report.FreePages != 0 || report.Keys != len(model) {
+		t.Errorf("%d keys, %d free pages, errors:\n%s", report.Keys, report.FreePages, checkErrors(report))
+	}
+	content := must(treeContent(&restored, restoredMeta))(t)
+	if !maps.EqualFunc(content, model, bytes.Equal) {
+		t.Errorf("Expected the %d keys of the snapshot, got %d, or values not expected", len(model), len(content))
+	}
+	if fileHasText(t, restorePath) {
+		t.Errorf("Expected an encrypted backup")
+	}
+}
+
+func TestCLI_Backup(t *testing.T) {
+	test_db, _ := fragmentedTestTree(t, 1000)
+	test_db.Close()
+	dbPath := test_db.fileName
+	backupPath := filepath.Join(t.TempDir(), "test_backup.db")
+
+	if code := runCommand([]string{"backup", dbPath, backupPath}, io.Discard, io.Discard); code != 0 {
+		t.Errorf("backup: exit code %d", code)
+	}
+	restorePath := filepath.Join(t.TempDir(), "test_restore.db")
+	if code := runCommand([]string{"restore", backupPath, restorePath}, io.Discard, io.Discard); code != 0 {
+		t.Errorf("restore: exit code %d", code)
+	}
+	if code := runCommand([]string{"restore", dbPath + ".none", restorePath}, io.Discard, io.Discard); code == 0 {
+		t.Errorf("restore of a missing backup should fail")
+	}
+	restored := must(OpenBPTreeDisk(restorePath))(t)
+	defer restored.Close()
+	checkTestKeys(t, &restored, must(restored.LoadMetaPage())(t), 1000, 10)
+}
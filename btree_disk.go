@@ -2,33 +2,40 @@ package main
 
 import (
 	"bytes"
+	"cmp"
+	"errors"
 	"fmt"
 	"os"
+	"slices"
+	"sync"
 )
 
 // All constant for easier calculation
 const BLOCK_SIZE = 4096
-const MAX_KEY_SIZE = 16
-const MAX_VAL_SIZE = 32
-
-// Each internal page takes:
-// - Header (8 + 64)
-// - nkey (16)
-// - list of keys: n * (16 + 8*8)
-// - list of children: n*64
-// => 8 + 64 + 16 + n*(16 + MAX_KEY_SIZE*8) + n*64 <= BLOCK_SIZE
-const INTERNAL_MAX_KEY = (BLOCK_SIZE - (8 + 64 + 16)) / (16 + MAX_KEY_SIZE*8 + 64)
-
-// Each leaf page takes:
-// - Header (8 + 64)
-// - nkey (16)
-// - list of kv: n * (16 + 16 + MAX_KEY_SIZE*8 + MAX_VAL_SIZE*8)
-const LEAF_MAX_KV = (BLOCK_SIZE - (8 + 64 + 16)) / (16 + 16 + MAX_KEY_SIZE*8 + MAX_VAL_SIZE*8)
+
+// Bytes of a block a page can take. The rest is left for the nonce and tag of
+// encrypted databases, see CryptPager.
+const PAGE_SIZE = BLOCK_SIZE - CRYPT_OVERHEAD
+
+// Header: page_type (1) + flags (1) + next_page_pointer (8) + checksum (4) + page_ptr (8)
+const PAGE_HEADER_SIZE = 1 + 1 + 8 + 4 + 8
+
+// Keys and values have variable length, pages are split by bytes.
+// Values bigger than MAX_INLINE_VAL_SIZE go to overflow pages, so a leaf cell
+// takes at most: offset (2) + lens (2 + 2) + 512 + 768 = 1286
+// which is less than a third of a page, so a page that got too big after one
+// insert can always be split into 2 pages that fit.
+const MAX_KEY_SIZE = 512
+const MAX_INLINE_VAL_SIZE = 768
 
 // ========================== File Allocator ==========================
 type FileAllocator struct {
 	last_free  uint64   // start at 1,2,3,4,5,6...
 	free_block []uint64 // Always less than last_free
+	list_block []uint64 // Blocks holding the free list written by writeAll
+	// Freed, but maybe still reachable from the meta page on disk.
+	// Only reused after the next writeAll.
+	pending_block []uint64
 }
 
 var isDebugMode = false
@@ -52,123 +59,654 @@ func (a *FileAllocator) alloc() uint64 {
 	return ptr
 }
 
+// Allocator of a new database, only the meta slots are used
+func NewFileAllocator() FileAllocator {
+	return FileAllocator{
+		last_free:     META_SLOTS,
+		free_block:    []uint64{},
+		list_block:    []uint64{},
+		pending_block: []uint64{},
+	}
+}
+
+// Copy that does not share blocks lists with this one
+func (a *FileAllocator) clone() FileAllocator {
+	return FileAllocator{
+		last_free:     a.last_free,
+		free_block:    slices.Clone(a.free_block),
+		list_block:    slices.Clone(a.list_block),
+		pending_block: slices.Clone(a.pending_block),
+	}
+}
+
 func (a *FileAllocator) free(ptr uint64) {
 	if isDebugMode {
 		fmt.Println("freeing block ", ptr/BLOCK_SIZE)
 	}
-	a.free_block = append(a.free_block, ptr/BLOCK_SIZE)
+	a.pending_block = append(a.pending_block, ptr/BLOCK_SIZE)
 }
 
-// TODO: Write Allocator to disk
-func (a *FileAllocator) writeAllToFile(file *os.File) {}
+// Write the free list as a chain of free list pages, return a pointer to the
+// first page (0 if there is nothing to write).
+// The pages of the previous chain and pending blocks are still reachable from
+// the meta page on disk, so they are only released into the new list, never
+// overwritten.
+func (a *FileAllocator) writeAll(pager Pager) (uint64, error) {
+	// Step 1: Take pages for the new chain, until the rest of the list fits.
+	pages := make([]uint64, 0)
+	for {
+		remaining := len(a.free_block) + len(a.pending_block) + len(a.list_block)
+		need := (remaining + FREE_LIST_MAX_BLOCK - 1) / FREE_LIST_MAX_BLOCK
+		if len(pages) >= need {
+			break
+		}
+		if len(a.free_block) > 0 {
+			pages = append(pages, a.free_block[0])
+			a.free_block = a.free_block[1:]
+		} else {
+			pages = append(pages, a.last_free)
+			a.last_free += 1
+		}
+	}
+	entries := make([]uint64, 0, len(a.free_block)+len(a.pending_block)+len(a.list_block))
+	entries = append(entries, a.free_block...)
+	entries = append(entries, a.pending_block...)
+	entries = append(entries, a.list_block...)
+
+	// Step 2: Write the chain, each page links to the next one.
+	buffer := new(bytes.Buffer) // Buffer size = 0
+	for i, block := range pages {
+		flPage := NewFLPage()
+		start := i * FREE_LIST_MAX_BLOCK
+		end := min(start+FREE_LIST_MAX_BLOCK, len(entries))
+		for _, b := range entries[start:end] {
+			flPage.blocks[flPage.nblock] = b
+			flPage.nblock += 1
+		}
+		if i+1 < len(pages) {
+			flPage.header.next_page_pointer = pages[i+1] * BLOCK_SIZE
+		}
+		buffer.Reset()
+		if err := flPage.write_to_buffer(buffer); err != nil {
+			return 0, err
+		}
+		sealed, err := sealBuffer(buffer, block*BLOCK_SIZE)
+		if err != nil {
+			return 0, err
+		}
+		if err := pager.WritePage(block*BLOCK_SIZE, sealed); err != nil {
+			return 0, err
+		}
+	}
 
-// TODO: Load allocator from file
-func LoadFileAllocator(fileName string) FileAllocator {
-	// buffer := new(bytes.Buffer) // Buffer size = 0
-	// Step 1: Open file
-	file, err := os.OpenFile(fileName, os.O_RDWR, 0644)
-	if err != nil {
-		panic(err)
+	// Step 3: Old chain pages and pending blocks are free from now on.
+	a.free_block = entries
+	a.pending_block = []uint64{}
+	a.list_block = pages
+	if len(pages) == 0 {
+		return 0, nil
 	}
-	defer file.Close()
-	return FileAllocator{}
+	return pages[0] * BLOCK_SIZE, nil
 }
 
-type InsertResult struct {
-	node_ptr       uint64
-	node_promo_key KeyEntry
-	new_node_ptr   uint64 // Need to split, else 0
-	new_promo_key  KeyEntry
+// Load allocator from the meta page and the free list chain it points to.
+func LoadFileAllocator(pager Pager, metaPage MetaPage) (FileAllocator, error) {
+	buffer := new(bytes.Buffer) // Buffer size = 0
+	allocator := NewFileAllocator()
+	// Step 1: Blocks past last_free were never used, the meta slots never are
+	allocator.last_free = max(metaPage.last_free, META_SLOTS)
+	// Step 2: Follow the free list chain
+	ptr := metaPage.free_list_pointer
+	for ptr != 0 {
+		buffer.Reset()
+		if err := pager.ReadPage(ptr, buffer); err != nil {
+			return FileAllocator{}, err
+		}
+		if err := verifyBlock(buffer.Bytes(), ptr); err != nil {
+			return FileAllocator{}, err
+		}
+		flPage := FreeListPage{}
+		if err := flPage.read_from_buffer(buffer, true); err != nil {
+			return FileAllocator{}, err
+		}
+		allocator.list_block = append(allocator.list_block, ptr/BLOCK_SIZE)
+		allocator.free_block = append(allocator.free_block, flPage.blocks[:flPage.nblock]...)
+		ptr = flPage.header.next_page_pointer
+	}
+	return allocator, nil
 }
 
-type DelResult struct {
+// First key and pointer of a page, to build or update the level above
+type pageEntry struct {
+	key KeyEntry
+	ptr uint64
+}
+
+type InsertResult struct {
 	node_ptr       uint64
 	node_promo_key KeyEntry
+	new_nodes      []pageEntry // Pages split off after node, empty if no split
 }
 
 // ========================== B+Tree structure ==========================
+// The pager stays open for the whole life of the tree, until Close.
+// A tree can be shared by goroutines: writes and commits hold mu, reads
+// (Find, Seek, iterators, LoadMetaPage, Check, ...) share it. Exported methods
+// take it, unexported ones expect the caller to hold it.
 type BPTreeDisk struct {
-	fileName      string
-	fileAllocator FileAllocator
+	mu          *sync.RWMutex
+	fileName    string // Empty if the pager is not a file
+	pager       Pager
+	cache       *PageCache
+	generation  uint64 // Of the last committed meta page
+	reclaim     *Reclaimer
+	compression uint8       // For the leaf pages written, see SetCompression
+	cipher      *pageCipher // nil: pages are not encrypted
+	wal         *WAL        // nil: not in WAL mode
 }
 
 // To create new, clear the file and write first 0 header to it.
-func NewBPTreeDisk(fileName string) BPTreeDisk {
-	// Step 1: Open file with create / truncate
+func NewBPTreeDisk(fileName string) (BPTreeDisk, error) {
+	// Step 1: Open file with create / truncate, the log of the old one is gone too
 	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
-		panic(err)
+		return BPTreeDisk{}, err
 	}
-	defer file.Close() // Persist
+	if err := os.Remove(fileName + WAL_SUFFIX); err != nil && !errors.Is(err, os.ErrNotExist) {
+		file.Close()
+		return BPTreeDisk{}, err
+	}
+	tree, err := NewBPTreeDiskWithPager(NewFilePager(file))
+	if err != nil {
+		file.Close()
+		return BPTreeDisk{}, err
+	}
+	tree.fileName = fileName
+	return tree, nil
+}
 
+// Start an empty tree on a pager that holds nothing yet.
+func NewBPTreeDiskWithPager(pager Pager) (BPTreeDisk, error) {
 	buffer := new(bytes.Buffer) // Buffer size = 0
-	metaPage := MetaPage{
-		header: PageHeader{
-			page_type:         0,
-			next_page_pointer: 0,
-		},
+	metaPage := NewMetaPage()
+	if err := metaPage.write_to_buffer(buffer); err != nil {
+		return BPTreeDisk{}, err
+	}
+
+	// Both meta slots start with the empty tree
+	tree := BPTreeDisk{
+		mu:      new(sync.RWMutex),
+		pager:   pager,
+		cache:   NewPageCache(DEFAULT_CACHE_PAGES),
+		reclaim: NewReclaimer(),
+	}
+	*pager.allocator() = NewFileAllocator()
+	for slot := uint64(0); slot < META_SLOTS; slot++ {
+		if err := tree.writeBufferToFileAtPtr(buffer, pager, slot*BLOCK_SIZE); err != nil {
+			return BPTreeDisk{}, err
+		}
+	}
+	if err := pager.Sync(); err != nil {
+		return BPTreeDisk{}, err
+	}
+	return tree, nil
+}
+
+// Open an existing database file, or create a new one if there is none.
+// The meta page is validated before the allocator is restored from it.
+func OpenBPTreeDisk(fileName string) (BPTreeDisk, error) {
+	return OpenBPTreeDiskWithKey(fileName, nil)
+}
+
+// Same as OpenBPTreeDisk for a database encrypted with key, a new database is
+// encrypted with it. key: 16, 24 or 32 bytes, nil if the database is not
+// encrypted. Return an error wrapping ErrWrongKey if it is not its key.
+func OpenBPTreeDiskWithKey(fileName string, key []byte) (BPTreeDisk, error) {
+	// Step 1: Check if there is anything to open
+	info, err := os.Stat(fileName)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && info.Size() == 0) {
+		tree, err := NewBPTreeDisk(fileName)
+		if err != nil {
+			return BPTreeDisk{}, err
+		}
+		if err := tree.encryptNewTree(key); err != nil {
+			tree.Close()
+			return BPTreeDisk{}, err
+		}
+		return tree, nil
+	}
+	if err != nil {
+		return BPTreeDisk{}, err
+	}
+	return OpenExistingBPTreeDisk(fileName, key, true)
+}
+
+// Open a database file that must exist, a missing or empty file is an error
+// instead of a new database. Without replayLog the file is opened read-only
+// and the log is left as it is: the tree is the one of the last checkpoint.
+func OpenExistingBPTreeDisk(fileName string, key []byte, replayLog bool) (BPTreeDisk, error) {
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return BPTreeDisk{}, err
+	}
+	if info.Size() == 0 {
+		return BPTreeDisk{}, fmt.Errorf("open %s: %w: empty file", fileName, ErrCorrupt)
 	}
+	flag := os.O_RDONLY
+	if replayLog {
+		flag = os.O_RDWR
+	}
+	file, err := os.OpenFile(fileName, flag, 0644)
+	if err != nil {
+		return BPTreeDisk{}, err
+	}
+	tree, err := openBPTreeDisk(NewFilePager(file), key)
+	if err != nil {
+		file.Close()
+		return BPTreeDisk{}, fmt.Errorf("open %s: %w", fileName, err)
+	}
+	tree.fileName = fileName
+	if !replayLog {
+		return tree, nil
+	}
+	// Step 5: Commits since the last checkpoint are in the log
+	if _, err := os.Stat(fileName + WAL_SUFFIX); err == nil {
+		if err := tree.EnableWAL(0); err != nil {
+			tree.Close()
+			return BPTreeDisk{}, fmt.Errorf("open %s: %w", fileName, err)
+		}
+	}
+	return tree, nil
+}
 
-	metaPage.write_to_buffer(buffer)
+// Open the tree a pager holds from an earlier NewBPTreeDiskWithPager.
+func OpenBPTreeDiskWithPager(pager Pager) (BPTreeDisk, error) {
+	return openBPTreeDisk(pager, nil)
+}
 
+func openBPTreeDisk(pager Pager, key []byte) (BPTreeDisk, error) {
 	tree := BPTreeDisk{
-		fileName: fileName,
-		fileAllocator: FileAllocator{
-			last_free:  1,
-			free_block: []uint64{},
-		},
+		mu:      new(sync.RWMutex),
+		pager:   pager,
+		cache:   NewPageCache(DEFAULT_CACHE_PAGES),
+		reclaim: NewReclaimer(),
+	}
+	// Step 2: Find the newest valid meta page
+	metaPage, err := readMetaPage(pager)
+	if err != nil {
+		return BPTreeDisk{}, err
 	}
-	tree.writeBufferToFileFirst(buffer, file)
-	return tree
+	tree.generation = metaPage.generation
+	tree.compression = metaPage.compression
+	// Step 3: Other pages are read with the key of the meta page
+	if err := tree.openWithKey(metaPage, key); err != nil {
+		return BPTreeDisk{}, err
+	}
+	// Step 4: Restore the allocator, root pointer is read from the meta page
+	allocator, err := LoadFileAllocator(tree.pager, metaPage)
+	if err != nil {
+		return BPTreeDisk{}, err
+	}
+	*pager.allocator() = allocator
+	return tree, nil
+}
+
+// Release the pager, the tree cannot be used after this.
+func (tree *BPTreeDisk) Close() error {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+	return tree.close()
+}
+
+func (tree *BPTreeDisk) close() error {
+	if tree.pager == nil {
+		return nil
+	}
+	var err error
+	if tree.wal != nil {
+		tree.wal.file.Close()
+		tree.wal = nil
+	} else {
+		err = tree.freeRetired()
+	}
+	if closeErr := tree.pager.Close(); err == nil {
+		err = closeErr
+	}
+	tree.pager = nil
+	return err
+}
+
+func (tree *BPTreeDisk) getPager() (Pager, error) {
+	if tree.pager == nil {
+		return nil, fmt.Errorf("%w: %s", ErrClosed, tree.fileName)
+	}
+	return tree.pager, nil
+}
+
+// Read pages from a memory mapping of the file instead of file.ReadAt.
+func (tree *BPTreeDisk) EnableMmap() error {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+	return tree.enableMmap()
+}
+
+func (tree *BPTreeDisk) enableMmap() error {
+	pager, err := tree.getPager()
+	if err != nil {
+		return err
+	}
+	filePager, ok := basePager(pager).(*FilePager)
+	if !ok {
+		return errors.New("mmap needs a database file")
+	}
+	return filePager.enableMmap()
 }
 
-// Reuse buffer style: buffer always of size BLOCK_SIZE
-func (tree *BPTreeDisk) readBlockAtPointer(ptr uint64, buffer *bytes.Buffer, file *os.File) {
-	inbuf := make([]byte, BLOCK_SIZE)
-	sz, err := file.ReadAt(inbuf, int64(ptr))
+// Whether pages are read from a memory mapping, see EnableMmap.
+func (tree *BPTreeDisk) mmapEnabled() bool {
+	filePager, ok := basePager(tree.pager).(*FilePager)
+	return ok && filePager.mmap != nil
+}
+
+// Read both meta slots, return the valid one with the highest generation.
+// A slot is invalid if its checksum does not match (torn write) or if it does
+// not look like one of our meta pages.
+func readMetaPage(pager Pager) (MetaPage, error) {
+	fileSize, err := pager.Size()
 	if err != nil {
-		// Not a eof problem
-		if sz == 0 {
-			panic(err)
+		return MetaPage{}, err
+	}
+	var best *MetaPage
+	var firstErr error
+	buffer := new(bytes.Buffer) // Buffer size = 0
+	for slot := uint64(0); slot < META_SLOTS; slot++ {
+		ptr := slot * BLOCK_SIZE
+		buffer.Reset()
+		if err := pager.ReadPage(ptr, buffer); err != nil {
+			firstErr = cmp.Or(firstErr, fmt.Errorf("meta slot %d: %w", slot, err))
+			continue
+		}
+		if err := verifyBlock(buffer.Bytes(), ptr); err != nil {
+			firstErr = cmp.Or(firstErr, err)
+			continue
+		}
+		metaPage := MetaPage{}
+		if err := metaPage.read_from_buffer(buffer); err != nil {
+			firstErr = cmp.Or(firstErr, fmt.Errorf("meta slot %d: %w", slot, err))
+			continue
+		}
+		if err := validateMetaPage(&metaPage, fileSize); err != nil {
+			firstErr = cmp.Or(firstErr, fmt.Errorf("meta slot %d: %w", slot, err))
+			continue
+		}
+		if best == nil || metaPage.generation > best.generation {
+			best = &metaPage
+		}
+	}
+	if best == nil {
+		return MetaPage{}, fmt.Errorf("%w: no valid meta page: %w", ErrCorrupt, firstErr)
+	}
+	return *best, nil
+}
+
+// Check that a meta page belongs to a database file of fileSize bytes.
+func validateMetaPage(metaPage *MetaPage, fileSize uint64) error {
+	if string(metaPage.signature[:]) != META_SIGNATURE {
+		return fmt.Errorf("bad meta page signature %q", metaPage.signature[:])
+	}
+	if metaPage.header.page_type != 0 {
+		return fmt.Errorf("bad meta page type %d", metaPage.header.page_type)
+	}
+	if metaPage.last_free < META_SLOTS {
+		return fmt.Errorf("bad allocator state: last_free = %d", metaPage.last_free)
+	}
+	if metaPage.compression > COMPRESSION_FLATE {
+		return fmt.Errorf("unknown compression %d", metaPage.compression)
+	}
+	if metaPage.encryption > ENCRYPTION_AES_GCM {
+		return fmt.Errorf("unknown encryption %d", metaPage.encryption)
+	}
+	// Every page pointer must be block aligned, allocated and inside the file
+	limit := min(metaPage.last_free*BLOCK_SIZE, fileSize)
+	for _, ptr := range []uint64{metaPage.header.next_page_pointer, metaPage.free_list_pointer} {
+		if ptr == 0 {
+			continue
+		}
+		if ptr%BLOCK_SIZE != 0 || ptr < META_SLOTS*BLOCK_SIZE || ptr >= limit {
+			return fmt.Errorf("bad page pointer %d in meta page", ptr)
 		}
 	}
+	return nil
+}
+
+// Reuse buffer style: buffer always of size BLOCK_SIZE, or the size of the
+// page before compression for a compressed page.
+// Return an *ErrCorruptPage (ErrCorrupt) if the block does not match its
+// checksum.
+func (tree *BPTreeDisk) readBlockAtPointer(ptr uint64, buffer *bytes.Buffer, pager Pager) error {
 	buffer.Reset()
-	buffer.Write(inbuf)
+	if err := pager.ReadPage(ptr, buffer); err != nil {
+		return fmt.Errorf("read page at %d: %w", ptr, err)
+	}
+	if err := verifyBlock(buffer.Bytes(), ptr); err != nil {
+		return err
+	}
+	if buffer.Bytes()[FLAGS_OFFSET]&PAGE_FLAG_COMPRESSED != 0 {
+		page, err := decompressPage(buffer.Bytes(), ptr)
+		if err != nil {
+			return err
+		}
+		buffer.Reset()
+		buffer.Write(page)
+	}
+	return nil
 }
 
-// Return a disk pointer to this data
-func (tree *BPTreeDisk) writeBufferToFile(buffer *bytes.Buffer, file *os.File) uint64 {
-	last_ptr := tree.fileAllocator.alloc()
-	_, err := file.WriteAt(buffer.Bytes(), int64(last_ptr))
+// Read a internal or leaf page, from the cache if possible.
+// Return a copy, that the caller is free to change.
+func (tree *BPTreeDisk) readNode(ptr uint64, buffer *bytes.Buffer, pager Pager) (any, error) {
+	node, ok := tree.cache.get(ptr)
+	if !ok {
+		if err := tree.readBlockAtPointer(ptr, buffer, pager); err != nil {
+			return nil, err
+		}
+		// Try to convert back to either leaf or internal
+		header := PageHeader{}
+		if err := header.read_from_buffer(buffer); err != nil {
+			return nil, err
+		}
+		if header.page_type == 1 {
+			// Internal page
+			ipage := BTreeInternalPage{header: header}
+			if err := ipage.read_from_buffer(buffer, false); err != nil {
+				return nil, err
+			}
+			node = &ipage
+		} else if header.page_type == 2 {
+			// Leaf page
+			lpage := BTreeLeafPage{header: header}
+			if err := lpage.read_from_buffer(buffer, false); err != nil {
+				return nil, err
+			}
+			node = &lpage
+		} else {
+			return nil, &ErrCorruptPage{Ptr: ptr, PageType: header.page_type, Reason: "not a tree page"}
+		}
+		tree.cache.put(ptr, node)
+	}
+	if convert, ok := node.(*BTreeInternalPage); ok {
+		ipage := convert.clone()
+		return &ipage, nil
+	}
+	lpage := node.(*BTreeLeafPage).clone()
+	return &lpage, nil
+}
+
+// Read the first internal page of a tree, a new empty one if there is none.
+func (tree *BPTreeDisk) readRoot(metaPage MetaPage, buffer *bytes.Buffer, pager Pager) (BTreeInternalPage, error) {
+	if metaPage.header.next_page_pointer == 0 {
+		return NewIPage(), nil
+	}
+	node, err := tree.readNode(metaPage.header.next_page_pointer, buffer, pager)
 	if err != nil {
-		panic(err)
+		return BTreeInternalPage{}, err
+	}
+	convert, ok := node.(*BTreeInternalPage)
+	if !ok {
+		return BTreeInternalPage{}, &ErrCorruptPage{Ptr: metaPage.header.next_page_pointer, PageType: 2, Reason: "first page is a leaf"}
 	}
-	return last_ptr
+	return *convert, nil
+}
+
+// Change how many decoded pages are cached, 0 to disable the cache.
+func (tree *BPTreeDisk) SetCacheSize(pages int) {
+	tree.cache.resize(pages)
+}
+
+func (tree *BPTreeDisk) CacheStats() CacheStats {
+	return tree.cache.Stats()
 }
 
 // Return a disk pointer to this data
-func (tree *BPTreeDisk) writeBufferToFileAtPtr(buffer *bytes.Buffer, file *os.File, input_ptr uint64) {
-	_, err := file.WriteAt(buffer.Bytes(), int64(input_ptr))
-	if err != nil {
-		panic(err)
+func (tree *BPTreeDisk) writeBufferToFile(buffer *bytes.Buffer, pager Pager) (uint64, error) {
+	last_ptr := pager.Alloc()
+	if err := tree.writeBufferToFileAtPtr(buffer, pager, last_ptr); err != nil {
+		return 0, err
 	}
+	return last_ptr, nil
 }
 
-func (tree *BPTreeDisk) writeBufferToFileFirst(buffer *bytes.Buffer, file *os.File) {
-	_, err := file.WriteAt(buffer.Bytes(), 0)
+// Return a disk pointer to this data
+func (tree *BPTreeDisk) writeBufferToFileAtPtr(buffer *bytes.Buffer, pager Pager, input_ptr uint64) error {
+	tree.cache.invalidate(input_ptr) // Block may be reused
+	if buffer.Len() > 0 && buffer.Bytes()[0] == 2 {
+		buffer = bytes.NewBuffer(tree.encodeLeaf(buffer))
+	}
+	sealed, err := sealBuffer(buffer, input_ptr)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if err := pager.WritePage(input_ptr, sealed); err != nil {
+		return fmt.Errorf("write page at %d: %w", input_ptr, err)
 	}
+	return nil
 }
 
 func getKeyEntryFromKeyVal(kv *KeyVal) KeyEntry {
 	return KeyEntry{
-		len:  kv.keylen,
 		data: kv.key,
 	}
 }
 
-func (tree *BPTreeDisk) insertRecursive(node any, insertKey *KeyEntry, insertKV *KeyVal, buffer *bytes.Buffer, file *os.File, deletedPtr *[]uint64) InsertResult {
+// Check the key can be stored in a page, values of any size fit
+func checkKeySize(key []byte) error {
+	if len(key) > MAX_KEY_SIZE {
+		return fmt.Errorf("%w: %d bytes, MAX_KEY_SIZE = %d", ErrKeyTooLarge, len(key), MAX_KEY_SIZE)
+	}
+	return nil
+}
+
+// Save a leaf page, split into as many pages as it takes for each to fit in
+// a block. A leaf that was written compressed can need more than 2.
+func (tree *BPTreeDisk) writeLeafPage(convert *BTreeLeafPage, buffer *bytes.Buffer, pager Pager) (InsertResult, error) {
+	// Step 1: Split the parts that do not fit, until all do
+	parts := []*BTreeLeafPage{convert}
+	for i := 0; i < len(parts); {
+		if parts[i].size() <= PAGE_SIZE || tree.fitsCompressed(parts[i], PAGE_SIZE) {
+			i++
+			continue
+		}
+		if parts[i].nkv < 2 {
+			return InsertResult{}, fmt.Errorf("leaf of %d bytes cannot be split", parts[i].size())
+		}
+		newLeaf := parts[i].Split()
+		parts = slices.Insert(parts, i+1, &newLeaf)
+	}
+	if isDebugMode && len(parts) > 1 {
+		fmt.Printf("Need split into %d leaves\n", len(parts))
+	}
+	// Step 2: Allocate all pages first. Links are left out, see PAGE_FLAG_LINKED
+	ptrs := make([]uint64, len(parts))
+	for i := range ptrs {
+		ptrs[i] = pager.Alloc()
+	}
+	result := InsertResult{node_ptr: ptrs[0], node_promo_key: getKeyEntryFromKeyVal(&convert.kv[0])}
+	for i, part := range parts {
+		part.header.next_page_pointer = 0
+		buffer.Reset()
+		if err := part.write_to_buffer(buffer); err != nil {
+			return InsertResult{}, err
+		}
+		if err := tree.writeBufferToFileAtPtr(buffer, pager, ptrs[i]); err != nil {
+			return InsertResult{}, err
+		}
+		if i > 0 {
+			result.new_nodes = append(result.new_nodes, pageEntry{key: getKeyEntryFromKeyVal(&part.kv[0]), ptr: ptrs[i]})
+		}
+	}
+	return result, nil
+}
+
+// Save an internal page, split into as many pages as it takes for each to fit
+// in a block. Children split into many pages add as many keys.
+func (tree *BPTreeDisk) writeInternalPage(convert *BTreeInternalPage, buffer *bytes.Buffer, pager Pager) (InsertResult, error) {
+	// Step 1: Split the parts that do not fit, until all do
+	parts := []*BTreeInternalPage{convert}
+	for i := 0; i < len(parts); {
+		if parts[i].size() <= PAGE_SIZE {
+			i++
+			continue
+		}
+		if parts[i].nkey < 2 {
+			return InsertResult{}, fmt.Errorf("internal page of %d bytes cannot be split", parts[i].size())
+		}
+		newInternal := parts[i].Split()
+		parts = slices.Insert(parts, i+1, &newInternal)
+	}
+	if isDebugMode && len(parts) > 1 {
+		fmt.Printf("Need split into %d internal pages\n", len(parts))
+	}
+	// Step 2: Allocate all pages first. Links are left out, see PAGE_FLAG_LINKED
+	ptrs := make([]uint64, len(parts))
+	for i := range ptrs {
+		ptrs[i] = pager.Alloc()
+	}
+	result := InsertResult{node_ptr: ptrs[0], node_promo_key: convert.keys[0]}
+	for i, part := range parts {
+		part.header.next_page_pointer = 0
+		buffer.Reset()
+		if err := part.write_to_buffer(buffer); err != nil {
+			return InsertResult{}, err
+		}
+		if err := tree.writeBufferToFileAtPtr(buffer, pager, ptrs[i]); err != nil {
+			return InsertResult{}, err
+		}
+		if i > 0 {
+			result.new_nodes = append(result.new_nodes, pageEntry{key: part.keys[0], ptr: ptrs[i]})
+		}
+	}
+	return result, nil
+}
+
+// Return the pointer of the first internal page after a change,
+// adding new first internal pages above while the old one got split.
+func (tree *BPTreeDisk) writeRootPage(result InsertResult, buffer *bytes.Buffer, pager Pager) (uint64, error) {
+	for len(result.new_nodes) > 0 {
+		// Insert a new page
+		newFirstIPage := NewIPage()
+		newFirstIPage.InsertKV(&result.node_promo_key, result.node_ptr)
+		for _, entry := range result.new_nodes {
+			newFirstIPage.InsertKV(&entry.key, entry.ptr)
+		}
+		var err error
+		if result, err = tree.writeInternalPage(&newFirstIPage, buffer, pager); err != nil {
+			return 0, err
+		}
+	}
+	return result.node_ptr, nil
+}
+
+func (tree *BPTreeDisk) insertRecursive(node any, insertKey *KeyEntry, insertKV *KeyVal, buffer *bytes.Buffer, pager Pager, deletedPtr *[]uint64) (InsertResult, error) {
 	// Insert a key value pair.
 	// Current: [3] | 3 -> [(3,3), (5,5)]
 	if convert, ok := node.(*BTreeInternalPage); ok {
@@ -183,8 +721,13 @@ func (tree *BPTreeDisk) insertRecursive(node any, insertKey *KeyEntry, insertKV
 			if isDebugMode {
 				fmt.Printf("Leaf = %v\n", firstLeaf)
 			}
-			firstLeaf.write_to_buffer(buffer)
-			leafPtr := tree.writeBufferToFile(buffer, file)
+			if err := firstLeaf.write_to_buffer(buffer); err != nil {
+				return InsertResult{}, err
+			}
+			leafPtr, err := tree.writeBufferToFile(buffer, pager)
+			if err != nil {
+				return InsertResult{}, err
+			}
 			if isDebugMode {
 				fmt.Println("Writer to pointer starting at ", leafPtr)
 			}
@@ -193,15 +736,7 @@ func (tree *BPTreeDisk) insertRecursive(node any, insertKey *KeyEntry, insertKV
 				fmt.Printf("After insert, internal page page = %v\n", *convert)
 			}
 			// Save convert to disk
-			buffer.Reset()
-			convert.write_to_buffer(buffer)
-			oldPtr := tree.writeBufferToFile(buffer, file)
-			return InsertResult{
-				node_ptr:       oldPtr,
-				node_promo_key: convert.keys[0],
-				new_node_ptr:   0,
-				new_promo_key:  KeyEntry{},
-			}
+			return tree.writeInternalPage(convert, buffer, pager)
 		} else {
 			pos := convert.FindLastLE(insertKey) // -> -1
 			// Special process for -1 position
@@ -212,28 +747,18 @@ func (tree *BPTreeDisk) insertRecursive(node any, insertKey *KeyEntry, insertKV
 				fmt.Println("pos = ", pos, ", childptr = ", convert.children[pos])
 			}
 			child := convert.children[pos]
-			tree.readBlockAtPointer(child, buffer, file)
-			// Try to convert back to either leaf or internal
-			header := PageHeader{}
-			header.read_from_buffer(buffer)
-			var childNode any
-			if header.page_type == 1 {
-				// Internal page
-				ipage := BTreeInternalPage{header: header}
-				ipage.read_from_buffer(buffer, false)
-				// fmt.Printf("read ipage = %v", ipage)
-				childNode = &ipage
-			} else {
-				// Leaf page
-				lpage := BTreeLeafPage{header: header}
-				lpage.read_from_buffer(buffer, false)
-				childNode = &lpage
+			childNode, err := tree.readNode(child, buffer, pager)
+			if err != nil {
+				return InsertResult{}, err
 			}
 			// child -> [(2,2), (3,3), (5,5)]
 			// Current: [3] -> [(2,2), (3,3), (5,5)]
 			// Node -> any (*BTreeInternalNode / *BTreeLeafNode)
 			// Child *Node -> Node
-			insertResult := tree.insertRecursive(childNode, insertKey, insertKV, buffer, file, deletedPtr)
+			insertResult, err := tree.insertRecursive(childNode, insertKey, insertKV, buffer, pager, deletedPtr)
+			if err != nil {
+				return InsertResult{}, err
+			}
 			if isDebugMode {
 				fmt.Printf("Child insert result: %v\n", insertResult)
 			}
@@ -242,50 +767,14 @@ func (tree *BPTreeDisk) insertRecursive(node any, insertKey *KeyEntry, insertKV
 			convert.children[pos] = insertResult.node_ptr
 			// Current: [2] -> [(2,2), (3,3), (5,5)]
 			// If need split, insert back to parent.
-			if insertResult.new_node_ptr != 0 {
-				convert.InsertKV(&insertResult.new_promo_key, insertResult.new_node_ptr)
+			for _, entry := range insertResult.new_nodes {
+				convert.InsertKV(&entry.key, entry.ptr)
 			}
 			if isDebugMode {
 				fmt.Printf("After insert, internal node = %v\n", *convert)
 			}
-			// After insert, check if need split.
-			if convert.nkey == INTERNAL_MAX_KEY {
-				// Allocate 2 pages: for new page and for old page
-				newPtr := tree.fileAllocator.alloc()
-				oldPtr := tree.fileAllocator.alloc()
-				newInternal := convert.Split()
-				newInternal.header.next_page_pointer = convert.header.next_page_pointer
-				if isDebugMode {
-					fmt.Printf("Need split, old = %v, new = %v\n", *convert, newInternal)
-				}
-				// Save new page
-				buffer.Reset()
-				newInternal.write_to_buffer(buffer)
-				tree.writeBufferToFileAtPtr(buffer, file, newPtr)
-				// Save current page
-				convert.header.next_page_pointer = newPtr
-				buffer.Reset()
-				convert.write_to_buffer(buffer)
-				tree.writeBufferToFileAtPtr(buffer, file, oldPtr)
-				return InsertResult{
-					node_ptr:       oldPtr,
-					node_promo_key: convert.keys[0],
-					new_node_ptr:   newPtr,
-					new_promo_key:  newInternal.keys[0],
-				}
-
-			} else {
-				// Save current page
-				buffer.Reset()
-				convert.write_to_buffer(buffer)
-				oldPtr := tree.writeBufferToFile(buffer, file)
-				return InsertResult{
-					node_ptr:       oldPtr,
-					node_promo_key: convert.keys[0],
-					new_node_ptr:   0,
-					new_promo_key:  KeyEntry{},
-				}
-			}
+			// After insert, split if needed and save
+			return tree.writeInternalPage(convert, buffer, pager)
 		}
 	} else {
 		convert := node.(*BTreeLeafPage)
@@ -296,124 +785,112 @@ func (tree *BPTreeDisk) insertRecursive(node any, insertKey *KeyEntry, insertKV
 		if isDebugMode {
 			fmt.Printf("Leaf after insert = %v\n", *convert)
 		}
+		// After insert, split if needed and save
+		return tree.writeLeafPage(convert, buffer, pager)
+	}
+}
 
-		// After insert, check if need split.
-		if convert.nkv == LEAF_MAX_KV {
-			newLeaf := convert.Split()
-			newLeaf.header.next_page_pointer = convert.header.next_page_pointer
-			// Allocate 2 pages: for new page and for old page
-			newPtr := tree.fileAllocator.alloc()
-			oldPtr := tree.fileAllocator.alloc()
-			// Save new page
-			buffer.Reset()
-			newLeaf.write_to_buffer(buffer)
-			tree.writeBufferToFileAtPtr(buffer, file, newPtr)
-			// Save current page
-			convert.header.next_page_pointer = newPtr // Current.next = newPtr
-			buffer.Reset()
-			convert.write_to_buffer(buffer)
-			tree.writeBufferToFileAtPtr(buffer, file, oldPtr)
-			return InsertResult{
-				node_ptr:       oldPtr,
-				node_promo_key: getKeyEntryFromKeyVal(&convert.kv[0]),
-				new_node_ptr:   newPtr,
-				new_promo_key:  getKeyEntryFromKeyVal(&newLeaf.kv[0]),
-			}
-		} else {
-			// Save current page
-			buffer.Reset()
-			convert.write_to_buffer(buffer)
-			oldPtr := tree.writeBufferToFile(buffer, file)
-			return InsertResult{
-				node_ptr:       oldPtr,
-				node_promo_key: getKeyEntryFromKeyVal(&convert.kv[0]),
-				new_node_ptr:   0,
-				new_promo_key:  KeyEntry{},
-			}
-		}
+// Insert a key that is not in the tree, return an error wrapping ErrKeyExists
+// if it is. Set replaces the value of a key instead.
+func (tree *BPTreeDisk) Insert(metaPage MetaPage, insertKeyBytes []byte, insertValueBytes []byte) (MetaPage, error) {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+	_, err := tree.find(metaPage, insertKeyBytes)
+	if err == nil {
+		return MetaPage{}, fmt.Errorf("%w: %v", ErrKeyExists, insertKeyBytes)
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return MetaPage{}, err
 	}
+	return tree.insert(metaPage, insertKeyBytes, insertValueBytes)
 }
 
-func (tree *BPTreeDisk) Insert(metaPage MetaPage, insertKeyBytes []byte, insertValueBytes []byte) MetaPage {
+func (tree *BPTreeDisk) insert(metaPage MetaPage, insertKeyBytes []byte, insertValueBytes []byte) (_ MetaPage, err error) {
+	if err := checkKeySize(insertKeyBytes); err != nil {
+		return MetaPage{}, err
+	}
 	buffer := new(bytes.Buffer) // Buffer size = 0
 	insertKey := NewKeyEntryFromBytes(insertKeyBytes)
-	insertKV := NewKeyValFromBytes(insertKeyBytes, insertValueBytes)
-	// Step 1: Open file
-	file, err := os.OpenFile(tree.fileName, os.O_RDWR|os.O_CREATE, 0644)
+	// Step 1: Use the pager opened with the tree, the blocks of a failed
+	// write are freed
+	pager, err := tree.getPager()
+	if err != nil {
+		return MetaPage{}, err
+	}
+	tracker := &allocTracker{Pager: pager}
+	pager = tracker
+	defer func() {
+		if err != nil {
+			tracker.freeAll()
+		}
+	}()
+	insertKV, err := tree.newLeafKV(insertKeyBytes, insertValueBytes, buffer, pager)
 	if err != nil {
-		panic(err)
+		return MetaPage{}, err
 	}
-	defer file.Close() // Persist
 	// Step 2: Read MetaPage
 	// tree.readBlockAtPointer(0, buffer, file) // Buffer size = BLOCK_SIZE
 	// metaPage := MetaPage{}
 	// metaPage.read_from_buffer(buffer) // buffer size decrease
 	// fmt.Printf("Meta page: %v\n", metaPage)
-	internalPage := NewIPage()
 	// Step 2': Read first internal page
-	if metaPage.header.next_page_pointer != 0 {
-		tree.readBlockAtPointer(metaPage.header.next_page_pointer, buffer, file) // Buffer size = BLOCK_SIZE
-		internalPage.read_from_buffer(buffer, true)                              // Buffer size decrease
+	internalPage, err := tree.readRoot(metaPage, buffer, pager)
+	if err != nil {
+		return MetaPage{}, err
 	}
 
 	deletedPtr := make([]uint64, 0)
 
 	// Step 3: Insert sub structure
-	insertResult := tree.insertRecursive(&internalPage, &insertKey, &insertKV, buffer, file, &deletedPtr)
+	insertResult, err := tree.insertRecursive(&internalPage, &insertKey, &insertKV, buffer, pager, &deletedPtr)
+	if err != nil {
+		return MetaPage{}, err
+	}
 	// fmt.Printf("Insert res: %v\n", insertResult)
 	// Step 4: Modify MetaPage and save to disk
-	var first_internal_page_ptr uint64
-	if insertResult.new_node_ptr != 0 {
-		// Insert a new page
-		newFirstIPage := NewIPage()
-		newFirstIPage.nkey = 2
-		newFirstIPage.keys[0] = insertResult.node_promo_key
-		newFirstIPage.children[0] = insertResult.node_ptr
-		newFirstIPage.keys[1] = insertResult.new_promo_key
-		newFirstIPage.children[1] = insertResult.new_node_ptr
-		buffer.Reset()
-		newFirstIPage.write_to_buffer(buffer)
-		first_internal_page_ptr = tree.writeBufferToFile(buffer, file)
-	} else {
-		first_internal_page_ptr = insertResult.node_ptr
+	first_internal_page_ptr, err := tree.writeRootPage(insertResult, buffer, pager)
+	if err != nil {
+		return MetaPage{}, err
 	}
 	// Assume last step has the first internal page ptr
 	if metaPage.header.next_page_pointer != 0 {
 		deletedPtr = append(deletedPtr, metaPage.header.next_page_pointer)
 	}
 	metaPage.header.next_page_pointer = first_internal_page_ptr
-	// buffer.Reset()
-	// Write to buffer here
-	// metaPage.write_to_buffer(buffer)
-	// tree.writeBufferToFileFirst(buffer, file)
-	// Defragment
-	// for _, x := range deletedPtr {
-	// 	tree.fileAllocator.free(x)
-	// }
-	return metaPage
-}
-
-func (tree *BPTreeDisk) Find(metaPage MetaPage, key []byte) *KeyVal {
+	metaPage.header.flags &^= PAGE_FLAG_LINKED
+	// Step 5: Old pages are freed once this version is committed
+	metaPage.version = tree.reclaim.newVersion(metaPage.version, deletedPtr, tree.logWrite(WAL_SET, insertKeyBytes, insertValueBytes))
+	return metaPage, nil
+}
+
+// Return the key value pair of key, an error wrapping ErrNotFound if there is
+// none.
+func (tree *BPTreeDisk) Find(metaPage MetaPage, key []byte) (*KeyVal, error) {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+	return tree.find(metaPage, key)
+}
+
+func (tree *BPTreeDisk) find(metaPage MetaPage, key []byte) (*KeyVal, error) {
 	buffer := new(bytes.Buffer) // Buffer size = 0
 	findKeyE := NewKeyEntryFromBytes(key)
 	var emptyVal []byte = make([]byte, 0)
 	findKeyV := NewKeyValFromBytes(key, emptyVal)
-	// Step 1: Open file
-	file, err := os.OpenFile(tree.fileName, os.O_RDWR, 0644)
+	notFound := fmt.Errorf("%w: %v", ErrNotFound, key)
+	// Step 1: Use the pager opened with the tree
+	pager, err := tree.getPager()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer file.Close() // Persist
 	// // Step 2: Read MetaPage
 	// tree.readBlockAtPointer(0, buffer, file) // Buffer size = BLOCK_SIZE
 	// metaPage := MetaPage{}
 	// metaPage.read_from_buffer(buffer) // buffer size decrease
 
-	internalPage := BTreeInternalPage{}
 	// Step 2': Read first internal page
-	if metaPage.header.next_page_pointer != 0 {
-		tree.readBlockAtPointer(metaPage.header.next_page_pointer, buffer, file) // Buffer size = BLOCK_SIZE
-		internalPage.read_from_buffer(buffer, true)                              // Buffer size decrease
+	internalPage, err := tree.readRoot(metaPage, buffer, pager)
+	if err != nil {
+		return nil, err
 	}
 
 	var node any
@@ -425,25 +902,13 @@ func (tree *BPTreeDisk) Find(metaPage MetaPage, key []byte) *KeyVal {
 			pos := convert.FindLastLE(&findKeyE)
 			// fmt.Println("pos = ", pos)
 			if pos == -1 {
-				return nil
+				return nil, notFound
 			}
 			child := convert.children[pos]
 			buffer.Reset()
-			tree.readBlockAtPointer(child, buffer, file)
-			// Try to convert back to either leaf or internal
-			header := PageHeader{}
-			header.read_from_buffer(buffer)
-			var childNode any
-			if header.page_type == 1 {
-				// Internal page
-				ipage := BTreeInternalPage{header: header}
-				ipage.read_from_buffer(buffer, false)
-				childNode = &ipage
-			} else {
-				// Leaf page
-				lpage := BTreeLeafPage{header: header}
-				lpage.read_from_buffer(buffer, false)
-				childNode = &lpage
+			childNode, err := tree.readNode(child, buffer, pager)
+			if err != nil {
+				return nil, err
 			}
 			node = childNode
 		} else {
@@ -452,20 +917,24 @@ func (tree *BPTreeDisk) Find(metaPage MetaPage, key []byte) *KeyVal {
 			pos := convert.FindLastLE(&findKeyV)
 			// fmt.Println("pos = ", pos)
 			if pos == -1 {
-				return nil
+				return nil, notFound
 			}
 			foundKV := convert.kv[pos]
 
 			if foundKV.compare(&findKeyV) == 0 {
-				return &foundKV
+				foundKV, err = tree.loadLeafKV(foundKV, buffer, pager)
+				if err != nil {
+					return nil, err
+				}
+				return &foundKV, nil
 			}
-			return nil
+			return nil, notFound
 		}
 	}
 }
 
 // Assume key can be found always
-func (tree *BPTreeDisk) setRecursive(node any, setKey *KeyEntry, setKV *KeyVal, buffer *bytes.Buffer, file *os.File, deletedPtr *[]uint64) InsertResult {
+func (tree *BPTreeDisk) setRecursive(node any, setKey *KeyEntry, setKV *KeyVal, buffer *bytes.Buffer, pager Pager, deletedPtr *[]uint64) (InsertResult, error) {
 	// Insert a key value pair.
 	// Current: [3] | 3 -> [(3,3), (5,5)]
 	if convert, ok := node.(*BTreeInternalPage); ok {
@@ -477,46 +946,33 @@ func (tree *BPTreeDisk) setRecursive(node any, setKey *KeyEntry, setKV *KeyVal,
 			fmt.Printf("pos = %v\n", pos)
 		}
 		child := convert.children[pos]
-		tree.readBlockAtPointer(child, buffer, file)
-		// Try to convert back to either leaf or internal
-		header := PageHeader{}
-		header.read_from_buffer(buffer)
-		var childNode any
-		if header.page_type == 1 {
-			// Internal page
-			ipage := BTreeInternalPage{header: header}
-			ipage.read_from_buffer(buffer, false)
-			childNode = &ipage
-		} else {
-			// Leaf page
-			lpage := BTreeLeafPage{header: header}
-			lpage.read_from_buffer(buffer, false)
-			childNode = &lpage
+		childNode, err := tree.readNode(child, buffer, pager)
+		if err != nil {
+			return InsertResult{}, err
 		}
 		// child -> [(2,2), (3,3), (5,5)]
 		// Current: [3] -> [(2,2), (3,3), (5,5)]
 		// Node -> any (*BTreeInternalNode / *BTreeLeafNode)
 		// Child *Node -> Node
-		setResult := tree.setRecursive(childNode, setKey, setKV, buffer, file, deletedPtr)
+		setResult, err := tree.setRecursive(childNode, setKey, setKV, buffer, pager, deletedPtr)
+		if err != nil {
+			return InsertResult{}, err
+		}
 		if isDebugMode {
 			fmt.Printf("Set result: %v\n", setResult)
 		}
 		*deletedPtr = append(*deletedPtr, convert.children[pos])
 		convert.children[pos] = setResult.node_ptr
+		// A bigger value can split the child
+		for _, entry := range setResult.new_nodes {
+			convert.InsertKV(&entry.key, entry.ptr)
+		}
 		if isDebugMode {
 			fmt.Printf("set internal page after set: %v\n", *convert)
 		}
 		// Current: [2] -> [(2,2), (3,3), (5,5)]
 		// Save current page
-		buffer.Reset()
-		convert.write_to_buffer(buffer)
-		oldPtr := tree.writeBufferToFile(buffer, file)
-		return InsertResult{
-			node_ptr:       oldPtr,
-			node_promo_key: convert.keys[0],
-			new_node_ptr:   0,
-			new_promo_key:  KeyEntry{},
-		}
+		return tree.writeInternalPage(convert, buffer, pager)
 	} else {
 		convert := node.(*BTreeLeafPage)
 		if isDebugMode {
@@ -526,54 +982,71 @@ func (tree *BPTreeDisk) setRecursive(node any, setKey *KeyEntry, setKV *KeyVal,
 		if isDebugMode {
 			fmt.Printf("pos = %v\n", pos)
 		}
+		// Old value is not needed anymore
+		if err := tree.freeOverflow(&convert.kv[pos], buffer, pager, deletedPtr); err != nil {
+			return InsertResult{}, err
+		}
 		convert.kv[pos] = *setKV // Set it as the new key value
 		if isDebugMode {
 			fmt.Printf("set leaf page after set: %v\n", *convert)
 		}
 		// Save current page
-		buffer.Reset()
-		convert.write_to_buffer(buffer)
-		oldPtr := tree.writeBufferToFile(buffer, file)
-		return InsertResult{
-			node_ptr:       oldPtr,
-			node_promo_key: getKeyEntryFromKeyVal(&convert.kv[0]),
-			new_node_ptr:   0,
-			new_promo_key:  KeyEntry{},
-		}
+		return tree.writeLeafPage(convert, buffer, pager)
 	}
 }
 
-func (tree *BPTreeDisk) Set(metaPage MetaPage, setKeyBytes []byte, setValueBytes []byte) MetaPage {
-	findRes := tree.Find(metaPage, setKeyBytes)
-	if findRes == nil {
+func (tree *BPTreeDisk) Set(metaPage MetaPage, setKeyBytes []byte, setValueBytes []byte) (MetaPage, error) {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+	return tree.set(metaPage, setKeyBytes, setValueBytes)
+}
+
+func (tree *BPTreeDisk) set(metaPage MetaPage, setKeyBytes []byte, setValueBytes []byte) (_ MetaPage, err error) {
+	if err := checkKeySize(setKeyBytes); err != nil {
+		return MetaPage{}, err
+	}
+	_, err = tree.find(metaPage, setKeyBytes)
+	if errors.Is(err, ErrNotFound) {
 		if isDebugMode {
 			fmt.Printf("key %v not found, inserting...\n", setKeyBytes)
 		}
-		return tree.Insert(metaPage, setKeyBytes, setValueBytes)
+		return tree.insert(metaPage, setKeyBytes, setValueBytes)
+	}
+	if err != nil {
+		return MetaPage{}, err
 	}
 
 	buffer := new(bytes.Buffer) // Buffer size = 0
 	setKey := NewKeyEntryFromBytes(setKeyBytes)
-	setKV := NewKeyValFromBytes(setKeyBytes, setValueBytes)
-	if isDebugMode {
-		fmt.Printf("Set kv = %v\n", setKV)
+	// Step 1: Use the pager opened with the tree, the blocks of a failed
+	// write are freed
+	pager, err := tree.getPager()
+	if err != nil {
+		return MetaPage{}, err
 	}
-	// Step 1: Open file
-	file, err := os.OpenFile(tree.fileName, os.O_RDWR, 0644)
+	tracker := &allocTracker{Pager: pager}
+	pager = tracker
+	defer func() {
+		if err != nil {
+			tracker.freeAll()
+		}
+	}()
+	setKV, err := tree.newLeafKV(setKeyBytes, setValueBytes, buffer, pager)
 	if err != nil {
-		panic(err)
+		return MetaPage{}, err
+	}
+	if isDebugMode {
+		fmt.Printf("Set kv = %v\n", setKV)
 	}
-	defer file.Close() // Persist
 	// Step 2: Read MetaPage
 	// tree.readBlockAtPointer(0, buffer, file) // Buffer size = BLOCK_SIZE
 	// metaPage := MetaPage{}
 	// metaPage.read_from_buffer(buffer) // buffer size decrease
 
-	internalPage := NewIPage()
 	// Step 2': Read first internal page
-	if metaPage.header.next_page_pointer != 0 {
-		tree.readBlockAtPointer(metaPage.header.next_page_pointer, buffer, file) // Buffer size = BLOCK_SIZE
-		internalPage.read_from_buffer(buffer, true)                              // Buffer size decrease
+	internalPage, err := tree.readRoot(metaPage, buffer, pager)
+	if err != nil {
+		return MetaPage{}, err
 	}
 	if isDebugMode {
 		fmt.Printf("First internal page: %v\n", internalPage)
@@ -581,104 +1054,142 @@ func (tree *BPTreeDisk) Set(metaPage MetaPage, setKeyBytes []byte, setValueBytes
 	deletedPtr := make([]uint64, 0)
 
 	// Step 3: Set sub structure
-	setResult := tree.setRecursive(&internalPage, &setKey, &setKV, buffer, file, &deletedPtr)
+	setResult, err := tree.setRecursive(&internalPage, &setKey, &setKV, buffer, pager, &deletedPtr)
+	if err != nil {
+		return MetaPage{}, err
+	}
 	if isDebugMode {
 		fmt.Printf("Set result: %v\n", setResult)
 	}
 	// Step 4: Modify MetaPage and save to disk
-	first_internal_page_ptr := setResult.node_ptr
+	first_internal_page_ptr, err := tree.writeRootPage(setResult, buffer, pager)
+	if err != nil {
+		return MetaPage{}, err
+	}
 	// Assume last step has the first internal page ptr
 	if metaPage.header.next_page_pointer != 0 {
 		deletedPtr = append(deletedPtr, metaPage.header.next_page_pointer)
 	}
 	metaPage.header.next_page_pointer = first_internal_page_ptr
-	// buffer.Reset()
-	// metaPage.write_to_buffer(buffer)
-	// tree.writeBufferToFileFirst(buffer, file)
-	// // Defragment
-	// for _, x := range deletedPtr {
-	// 	tree.fileAllocator.free(x)
-	// }
-	return metaPage
+	metaPage.header.flags &^= PAGE_FLAG_LINKED
+	// Step 5: Old pages are freed once this version is committed
+	metaPage.version = tree.reclaim.newVersion(metaPage.version, deletedPtr, tree.logWrite(WAL_SET, setKeyBytes, setValueBytes))
+	return metaPage, nil
 }
 
 // Assume value always have
-func (tree *BPTreeDisk) delRecursive(node any, delKey *KeyEntry, delKV *KeyVal, buffer *bytes.Buffer, file *os.File, deletedPtr *[]uint64) DelResult {
-	// Insert a key value pair.
+// Delete a key from the subtree of node. The node is changed in place but not
+// saved: its parent saves it, after merging it with a sibling if it got less
+// than half full.
+func (tree *BPTreeDisk) delRecursive(node any, delKey *KeyEntry, delKV *KeyVal, buffer *bytes.Buffer, pager Pager, deletedPtr *[]uint64) error {
 	// Current: [3] | 3 -> [(3,3), (5,5)]
 	if convert, ok := node.(*BTreeInternalPage); ok {
 		pos := convert.FindLastLE(delKey) // -> always have
 		child := convert.children[pos]
-		tree.readBlockAtPointer(child, buffer, file)
-		// Try to convert back to either leaf or internal
-		header := PageHeader{}
-		header.read_from_buffer(buffer)
-		var childNode any
-		if header.page_type == 1 {
-			// Internal page
-			ipage := BTreeInternalPage{header: header}
-			ipage.read_from_buffer(buffer, false)
-			childNode = &ipage
-		} else {
-			// Leaf page
-			lpage := BTreeLeafPage{header: header}
-			lpage.read_from_buffer(buffer, false)
-			childNode = &lpage
+		childNode, err := tree.readNode(child, buffer, pager)
+		if err != nil {
+			return err
 		}
 		// child -> [(2,2), (3,3), (5,5)]
 		// Current: [3] -> [(2,2), (3,3), (5,5)]
 		// Node -> any (*BTreeInternalNode / *BTreeLeafNode)
 		// Child *Node -> Node
-		delResult := tree.delRecursive(childNode, delKey, delKV, buffer, file, deletedPtr)
-		if delResult.node_ptr == 0 {
-			// Whole child got deleted
-			*deletedPtr = append(*deletedPtr, convert.children[pos])
+		if err := tree.delRecursive(childNode, delKey, delKV, buffer, pager, deletedPtr); err != nil {
+			return err
+		}
+		*deletedPtr = append(*deletedPtr, child)
+		if isUnderfull(childNode) && convert.nkey > 1 {
+			// Merge with a sibling, or take cells from it
+			return tree.mergeChild(convert, pos, childNode, buffer, pager, deletedPtr)
+		} else if nodeLen(childNode) == 0 {
+			// Whole child got deleted, the parent is fixed one level up
 			convert.DelKVAtPos(pos)
-			if convert.nkey == 0 {
-				return DelResult{
-					node_ptr:       0,
-					node_promo_key: KeyEntry{},
-				}
-			}
+			return nil
 		} else {
-			convert.keys[pos] = delResult.node_promo_key
-			*deletedPtr = append(*deletedPtr, convert.children[pos])
-			convert.children[pos] = delResult.node_ptr
-		}
-		// Current: [2] -> [(2,2), (3,3), (5,5)]
-		// Save current page
-		buffer.Reset()
-		convert.write_to_buffer(buffer)
-		oldPtr := tree.writeBufferToFile(buffer, file)
-		return DelResult{
-			node_ptr:       oldPtr,
-			node_promo_key: convert.keys[0],
+			// Current: [2] -> [(2,2), (3,3), (5,5)]
+			return tree.writeChild(convert, pos, childNode, buffer, pager)
 		}
 	} else {
 		convert := node.(*BTreeLeafPage)
-		convert.DelKV(delKV)
-		if convert.nkv == 0 {
-			return DelResult{
-				node_ptr:       0,
-				node_promo_key: KeyEntry{},
-			}
+		pos := convert.FindLastLE(delKV)
+		if err := tree.freeOverflow(&convert.kv[pos], buffer, pager, deletedPtr); err != nil {
+			return err
 		}
+		convert.DelKV(delKV)
+		return nil
+	}
+}
 
-		// Save current page
-		buffer.Reset()
-		convert.write_to_buffer(buffer)
-		oldPtr := tree.writeBufferToFile(buffer, file)
-		return DelResult{
-			node_ptr:       oldPtr,
-			node_promo_key: getKeyEntryFromKeyVal(&convert.kv[0]),
-		}
+// A page less than half full gets merged with a sibling on delete.
+func isUnderfull(node any) bool {
+	if convert, ok := node.(*BTreeInternalPage); ok {
+		return convert.size() < PAGE_SIZE/2
+	}
+	return node.(*BTreeLeafPage).size() < PAGE_SIZE/2
+}
+
+// Save the child at pos of an internal page and update its entry,
+// adding an entry for each new page if the child got split.
+func (tree *BPTreeDisk) writeChild(parent *BTreeInternalPage, pos int, child any, buffer *bytes.Buffer, pager Pager) error {
+	var writeResult InsertResult
+	var err error
+	if convert, ok := child.(*BTreeInternalPage); ok {
+		writeResult, err = tree.writeInternalPage(convert, buffer, pager)
+	} else {
+		writeResult, err = tree.writeLeafPage(child.(*BTreeLeafPage), buffer, pager)
+	}
+	if err != nil {
+		return err
+	}
+	parent.keys[pos] = writeResult.node_promo_key
+	parent.children[pos] = writeResult.node_ptr
+	for _, entry := range writeResult.new_nodes {
+		parent.InsertKV(&entry.key, entry.ptr)
+	}
+	return nil
+}
+
+// Merge the underfull child at pos with its right sibling (left one for the
+// last child). If both do not fit in a page, the merged page is split again
+// into 2 balanced pages, which is the same as borrowing from the sibling.
+func (tree *BPTreeDisk) mergeChild(parent *BTreeInternalPage, pos int, child any, buffer *bytes.Buffer, pager Pager, deletedPtr *[]uint64) error {
+	// Step 1: Read the sibling, it will be written again
+	leftPos, rightPos := pos, pos+1
+	if rightPos == int(parent.nkey) {
+		leftPos, rightPos = pos-1, pos
+	}
+	siblingPos := leftPos + rightPos - pos
+	sibling, err := tree.readNode(parent.children[siblingPos], buffer, pager)
+	if err != nil {
+		return err
+	}
+	*deletedPtr = append(*deletedPtr, parent.children[siblingPos])
+	left, right := child, sibling
+	if siblingPos == leftPos {
+		left, right = sibling, child
+	}
+	// Step 2: Move all cells to the left page
+	if convert, ok := left.(*BTreeInternalPage); ok {
+		convert.Merge(right.(*BTreeInternalPage))
+	} else {
+		convert := left.(*BTreeLeafPage)
+		convert.Merge(right.(*BTreeLeafPage))
 	}
+	// Step 3: Save it in place of both, split if needed
+	parent.DelKVAtPos(rightPos)
+	return tree.writeChild(parent, leftPos, left, buffer, pager)
+}
+
+// Delete key, return an error wrapping ErrNotFound if there is no such key.
+func (tree *BPTreeDisk) Del(metaPage MetaPage, key []byte) (MetaPage, error) {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+	return tree.del(metaPage, key)
 }
 
-func (tree *BPTreeDisk) Del(metaPage MetaPage, key []byte) (bool, MetaPage) {
-	findRes := tree.Find(metaPage, key)
-	if findRes == nil {
-		return false, MetaPage{}
+func (tree *BPTreeDisk) del(metaPage MetaPage, key []byte) (_ MetaPage, err error) {
+	if _, err := tree.find(metaPage, key); err != nil {
+		return MetaPage{}, err
 	}
 
 	buffer := new(bytes.Buffer) // Buffer size = 0
@@ -686,66 +1197,89 @@ func (tree *BPTreeDisk) Del(metaPage MetaPage, key []byte) (bool, MetaPage) {
 	var emptyVal []byte = make([]byte, 0)
 	delKeyV := NewKeyValFromBytes(key, emptyVal)
 
-	// Step 1: Open file
-	file, err := os.OpenFile(tree.fileName, os.O_RDWR, 0644)
+	// Step 1: Use the pager opened with the tree, the blocks of a failed
+	// write are freed
+	pager, err := tree.getPager()
 	if err != nil {
-		panic(err)
+		return MetaPage{}, err
 	}
-	defer file.Close() // Persist
+	tracker := &allocTracker{Pager: pager}
+	pager = tracker
+	defer func() {
+		if err != nil {
+			tracker.freeAll()
+		}
+	}()
 	// Step 2: Read MetaPage
 	// tree.readBlockAtPointer(0, buffer, file) // Buffer size = BLOCK_SIZE
 	// metaPage := MetaPage{}
 	// metaPage.read_from_buffer(buffer) // buffer size decrease
 
-	internalPage := NewIPage()
 	// Step 2': Read first internal page
-	if metaPage.header.next_page_pointer != 0 {
-		tree.readBlockAtPointer(metaPage.header.next_page_pointer, buffer, file) // Buffer size = BLOCK_SIZE
-		internalPage.read_from_buffer(buffer, true)                              // Buffer size decrease
+	internalPage, err := tree.readRoot(metaPage, buffer, pager)
+	if err != nil {
+		return MetaPage{}, err
 	}
 	deletedPtr := make([]uint64, 0)
 
-	// Step 3: Insert sub structure
-	delResult := tree.delRecursive(&internalPage, &delKeyE, &delKeyV, buffer, file, &deletedPtr)
-	// Step 4: Modify MetaPage and save to disk
-	first_internal_page_ptr := delResult.node_ptr
+	// Step 3: Delete from sub structure
+	if err := tree.delRecursive(&internalPage, &delKeyE, &delKeyV, buffer, pager, &deletedPtr); err != nil {
+		return MetaPage{}, err
+	}
+	// Step 3': Collapse the first internal page while it has a single internal
+	// child, it always stays above the leaves
+	for internalPage.nkey == 1 {
+		childNode, err := tree.readNode(internalPage.children[0], buffer, pager)
+		if err != nil {
+			return MetaPage{}, err
+		}
+		child, ok := childNode.(*BTreeInternalPage)
+		if !ok {
+			break
+		}
+		deletedPtr = append(deletedPtr, internalPage.children[0])
+		internalPage = *child
+	}
+	// Step 4: Modify MetaPage and save to disk, empty tree has no first page
+	var first_internal_page_ptr uint64 = 0
+	if internalPage.nkey > 0 {
+		writeResult, err := tree.writeInternalPage(&internalPage, buffer, pager)
+		if err != nil {
+			return MetaPage{}, err
+		}
+		first_internal_page_ptr, err = tree.writeRootPage(writeResult, buffer, pager)
+		if err != nil {
+			return MetaPage{}, err
+		}
+	}
 	// Assume last step has the first internal page ptr
 	if metaPage.header.next_page_pointer != 0 {
 		deletedPtr = append(deletedPtr, metaPage.header.next_page_pointer)
 	}
 	metaPage.header.next_page_pointer = first_internal_page_ptr
-	// buffer.Reset()
-	// metaPage.write_to_buffer(buffer)
-	// tree.writeBufferToFileFirst(buffer, file)
-	// // Defragment
-	// for _, x := range deletedPtr {
-	// 	tree.fileAllocator.free(x)
-	// }
-	return true, metaPage
+	metaPage.header.flags &^= PAGE_FLAG_LINKED
+	// Step 5: Old pages are freed once this version is committed
+	metaPage.version = tree.reclaim.newVersion(metaPage.version, deletedPtr, tree.logWrite(WAL_DEL, key, nil))
+	return metaPage, nil
 }
 
-// 10 <= x <= 50
-func (tree *BPTreeDisk) SeekGE(metaPage MetaPage, key []byte) *BIter {
+// Iterator on the last key <= key, or on the first key of the tree if there
+// is none. The path is empty if the tree is empty.
+func (tree *BPTreeDisk) seekPath(metaPage MetaPage, key []byte) (*BIter, error) {
 	buffer := new(bytes.Buffer) // Buffer size = 0
 	findKeyE := NewKeyEntryFromBytes(key)
 	var emptyVal []byte = make([]byte, 0)
 	findKeyV := NewKeyValFromBytes(key, emptyVal)
-	// Step 1: Open file
-	file, err := os.OpenFile(tree.fileName, os.O_RDWR, 0644)
+	// Step 1: Use the pager opened with the tree
+	pager, err := tree.getPager()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	// defer file.Close() // Don't close the file, open for reading...
-	// Step 2: Read MetaPage
-	// tree.readBlockAtPointer(0, buffer, file) // Buffer size = BLOCK_SIZE
-	// metaPage := MetaPage{}
-	// metaPage.read_from_buffer(buffer) // buffer size decrease
 
-	internalPage := BTreeInternalPage{}
 	// Step 2': Read first internal page
-	if metaPage.header.next_page_pointer != 0 {
-		tree.readBlockAtPointer(metaPage.header.next_page_pointer, buffer, file) // Buffer size = BLOCK_SIZE
-		internalPage.read_from_buffer(buffer, true)                              // Buffer size decrease
+	internalPage, err := tree.readRoot(metaPage, buffer, pager)
+	if err != nil {
+		return nil, err
 	}
 
 	var node any
@@ -753,16 +1287,18 @@ func (tree *BPTreeDisk) SeekGE(metaPage MetaPage, key []byte) *BIter {
 
 	// Need to defined and get a path
 	iter := BIter{
-		path: []PathData{},
-		tree: tree,
-		file: file,
+		path:  []PathData{},
+		tree:  tree,
+		epoch: tree.reclaim.pin(),
 	}
 
 	for {
 		if convert, ok := node.(*BTreeInternalPage); ok {
-			// fmt.Printf("internal page: %v\n", *convert)
+			if convert.nkey == 0 {
+				// Empty tree, nothing to iterate
+				return &iter, nil
+			}
 			pos := convert.FindLastLE(&findKeyE)
-			// fmt.Println("pos = ", pos)
 			if pos == -1 {
 				// No key that is less or equal: all key > findKey
 				pos = 0
@@ -773,72 +1309,201 @@ func (tree *BPTreeDisk) SeekGE(metaPage MetaPage, key []byte) *BIter {
 			})
 			child := convert.children[pos]
 			buffer.Reset()
-			tree.readBlockAtPointer(child, buffer, file)
-			// Try to convert back to either leaf or internal
-			header := PageHeader{}
-			header.read_from_buffer(buffer)
-			var childNode any
-			if header.page_type == 1 {
-				// Internal page
-				ipage := BTreeInternalPage{header: header}
-				ipage.read_from_buffer(buffer, false)
-				childNode = &ipage
-			} else {
-				// Leaf page
-				lpage := BTreeLeafPage{header: header}
-				lpage.read_from_buffer(buffer, false)
-				childNode = &lpage
+			childNode, err := tree.readNode(child, buffer, pager)
+			if err != nil {
+				iter.close()
+				return nil, err
 			}
 			node = childNode
 		} else {
 			convert := node.(*BTreeLeafPage)
-			// fmt.Printf("leaf page: %v\n", *convert)
 			pos := convert.FindLastLE(&findKeyV)
-			// fmt.Println("pos = ", pos)
 			if pos == -1 {
 				pos = 0
 			}
-			foundKV := convert.kv[pos]
-
-			// Make sure >= findKey
-			if foundKV.compare(&findKeyV) < 0 {
-				pos += 1
-			}
-
 			iter.path = append(iter.path, PathData{
 				node:     node,
 				position: pos,
 			})
-
-			return &iter
+			return &iter, nil
 		}
 	}
 }
 
-func (tree *BPTreeDisk) LoadMetaPage() MetaPage {
-	buffer := new(bytes.Buffer) // Buffer size = 0
-	// Step 1: Open file
-	file, err := os.OpenFile(tree.fileName, os.O_RDWR, 0644)
+// 10 <= x <= 50
+// Iterator on the first key >= key, not valid if there is none.
+func (tree *BPTreeDisk) SeekGE(metaPage MetaPage, key []byte) (*BIter, error) {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+	iter, err := tree.seekPath(metaPage, key)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer file.Close() // Persist
-	// Step 2: Read MetaPage
-	tree.readBlockAtPointer(0, buffer, file) // Buffer size = BLOCK_SIZE
-	metaPage := MetaPage{}
-	metaPage.read_from_buffer(buffer) // buffer size decrease
-	return metaPage
+	// Make sure >= key, the next key can be in the next leaf
+	if iter.Valid() && compareKey(iter.current().key, key) < 0 {
+		iter.next()
+	}
+	return iter.checkSeek()
+}
+
+// Iterator on the last key <= key, not valid if there is none.
+func (tree *BPTreeDisk) SeekLE(metaPage MetaPage, key []byte) (*BIter, error) {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+	iter, err := tree.seekPath(metaPage, key)
+	if err != nil {
+		return nil, err
+	}
+	// Only the first key of the tree can be > key
+	if iter.Valid() && compareKey(iter.current().key, key) > 0 {
+		iter.prev()
+	}
+	return iter.checkSeek()
+}
+
+// Iterator on the smallest key, not valid if the tree is empty.
+func (tree *BPTreeDisk) SeekFirst(metaPage MetaPage) (*BIter, error) {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+	return tree.seekEnd(metaPage, false)
+}
+
+// Iterator on the biggest key, not valid if the tree is empty.
+func (tree *BPTreeDisk) SeekLast(metaPage MetaPage) (*BIter, error) {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+	return tree.seekEnd(metaPage, true)
 }
 
-func (tree *BPTreeDisk) WriteMetaPage(metaPage MetaPage) {
-	// Step 1: Open file
-	file, err := os.OpenFile(tree.fileName, os.O_RDWR, 0644)
+func (tree *BPTreeDisk) seekEnd(metaPage MetaPage, toLast bool) (*BIter, error) {
+	pager, err := tree.getPager()
+	if err != nil {
+		return nil, err
+	}
+	root, err := tree.readRoot(metaPage, new(bytes.Buffer), pager)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	iter := BIter{
+		path:  []PathData{},
+		tree:  tree,
+		epoch: tree.reclaim.pin(),
+	}
+	if root.nkey == 0 {
+		return &iter, nil
 	}
-	defer file.Close()          // Persist
+	pos := 0
+	if toLast {
+		pos = int(root.nkey) - 1
+	}
+	iter.path = append(iter.path, PathData{
+		node:     &root,
+		position: pos,
+	})
+	iter.descend(toLast)
+	return iter.checkSeek()
+}
+
+// Return the last committed meta page: the newest valid of the 2 slots.
+func (tree *BPTreeDisk) LoadMetaPage() (MetaPage, error) {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+	return tree.loadMetaPage()
+}
+
+func (tree *BPTreeDisk) loadMetaPage() (MetaPage, error) {
+	// Step 1: Use the pager opened with the tree
+	pager, err := tree.getPager()
+	if err != nil {
+		return MetaPage{}, err
+	}
+	// Step 2: Read both slots of MetaPage, unless the last commit is only in
+	// the log
+	if tree.wal != nil && tree.wal.version > 0 {
+		metaPage := tree.wal.meta
+		metaPage.version = tree.reclaim.committed_version
+		return metaPage, nil
+	}
+	metaPage, err := readMetaPage(pager)
+	if err != nil {
+		return MetaPage{}, err
+	}
+	metaPage.version = tree.reclaim.committed_version
+	return metaPage, nil
+}
+
+// Commit, to the log in WAL mode, see EnableWAL.
+func (tree *BPTreeDisk) WriteMetaPage(metaPage MetaPage) error {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+	if tree.wal != nil {
+		if _, err := tree.getPager(); err != nil {
+			return err
+		}
+		return tree.commitWAL(metaPage)
+	}
+	return tree.writeMetaPage(metaPage)
+}
+
+// The new pages reach the disk before the meta page pointing to them, which
+// goes to the slot not holding the last committed one.
+// A commit that fails leaves the last committed meta page in use, so the
+// allocator and reclaimer go back to their state from before it.
+func (tree *BPTreeDisk) writeMetaPage(metaPage MetaPage) (err error) {
+	// Step 1: Use the pager opened with the tree
+	pager, err := tree.getPager()
+	if err != nil {
+		return err
+	}
+	allocator := pager.allocator()
+	savedAllocator := allocator.clone()
+	savedReclaim := tree.reclaim.clone()
+	defer func() {
+		if err != nil {
+			*allocator = savedAllocator
+			*tree.reclaim = savedReclaim
+		}
+	}()
+	// Step 2: Free pages retired by the writes since the last commit
+	for _, ptr := range tree.reclaim.commit(metaPage.version) {
+		pager.Free(ptr)
+	}
+	// Step 2': Persist the allocator together with the root pointer
+	metaPage.free_list_pointer, err = allocator.writeAll(pager)
+	if err != nil {
+		return err
+	}
+	metaPage.last_free = allocator.last_free
+	metaPage.compression = tree.compression
+	if tree.cipher != nil {
+		metaPage.encryption = ENCRYPTION_AES_GCM
+		metaPage.key_salt = tree.cipher.salt
+		metaPage.key_check = tree.cipher.key_check
+	} else {
+		metaPage.encryption = ENCRYPTION_NONE
+		metaPage.key_salt = [16]uint8{}
+		metaPage.key_check = [16]uint8{}
+	}
+	for _, block := range allocator.list_block {
+		tree.cache.invalidate(block * BLOCK_SIZE)
+	}
+	// Step 3: Tree and free list pages are durable before the meta page
+	if err := pager.Sync(); err != nil {
+		return err
+	}
+	// Step 4: Write the next generation to the other slot
+	metaPage.generation = tree.generation + 1
 	buffer := new(bytes.Buffer) // Buffer size = 0
 	buffer.Reset()
-	metaPage.write_to_buffer(buffer)
-	tree.writeBufferToFileFirst(buffer, file)
+	if err := metaPage.write_to_buffer(buffer); err != nil {
+		return err
+	}
+	if err := tree.writeBufferToFileAtPtr(buffer, pager, (metaPage.generation%META_SLOTS)*BLOCK_SIZE); err != nil {
+		return err
+	}
+	if err := pager.Sync(); err != nil {
+		return err
+	}
+	tree.generation = metaPage.generation
+	return nil
 }
@@ -3,7 +3,11 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
 	"testing"
 	"time"
 )
@@ -14,27 +18,71 @@ func intToSlice(x int64) []byte {
 	return buf.Bytes()
 }
 
+// Tests stop on errors they do not expect: must(f())(t) is the value of f,
+// or stops t with its error.
+func must[T any](val T, err error) func(tb testing.TB) T {
+	return func(tb testing.TB) T {
+		tb.Helper()
+		mustOK(tb, err)
+		return val
+	}
+}
+
+func mustOK(tb testing.TB, err error) {
+	tb.Helper()
+	if err != nil {
+		tb.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Tree in memory, for tests that never reopen it.
+func newTestTree(tb testing.TB) BPTreeDisk {
+	tb.Helper()
+	return must(NewBPTreeDiskWithPager(NewMemPager()))(tb)
+}
+
+// Path of a database file removed with the test.
+func testDBPath(tb testing.TB) string {
+	return filepath.Join(tb.TempDir(), "test_db.db")
+}
+
+// Flip the bits of mask in the byte at pos, without sealing the block again.
+func flipByte(tb testing.TB, pager Pager, pos uint64, mask byte) {
+	tb.Helper()
+	ptr := pos / BLOCK_SIZE * BLOCK_SIZE
+	buffer := new(bytes.Buffer)
+	mustOK(tb, pager.ReadPage(ptr, buffer))
+	block := buffer.Bytes()
+	block[pos-ptr] ^= mask
+	mustOK(tb, pager.WritePage(ptr, block))
+}
+
+func isSameKV(lhs KeyVal, rhs KeyVal) bool {
+	return bytes.Equal(lhs.key, rhs.key) && bytes.Equal(lhs.val, rhs.val)
+}
+
 func TestBTreeDisk(t *testing.T) {
 	maxNum := 100
 	// Create a new BTreeDisk using a test file
-	test_db := NewBPTreeDisk("test_db.db")
-	meta := test_db.LoadMetaPage()
+	test_db := newTestTree(t)
+	defer test_db.Close()
+	meta := must(test_db.LoadMetaPage())(t)
 	// Insert test: insert 10 nodes from 1->10 to check if it's good.
 	for i := 1; i <= maxNum; i++ {
 		// d := intToSlice(int64(i))
 		// fmt.Printf("insert key = %v\n", d)
-		meta = test_db.Insert(meta, intToSlice(int64(i)), intToSlice(int64(i)))
+		meta = must(test_db.Insert(meta, intToSlice(int64(i)), intToSlice(int64(i))))(t)
 		// fmt.Println("=========================================")
 	}
 	// Find test: Find these kv if they are the same.
 	for i := 1; i <= maxNum; i++ {
-		kv := test_db.Find(meta, intToSlice(int64(i)))
+		kv, _ := test_db.Find(meta, intToSlice(int64(i)))
 		expected := NewKeyValFromInt(int64(i), int64(i))
 		if kv == nil {
 			t.Errorf("Find test failed: Cannot find key = %d", i)
 			return
 		}
-		if *kv != expected {
+		if !isSameKV(*kv, expected) {
 			t.Errorf("Find test failed: val not expected. Expected = %v, got %v", expected, *kv)
 		}
 	}
@@ -42,29 +90,29 @@ func TestBTreeDisk(t *testing.T) {
 	for i := 1; i <= maxNum; i++ {
 		// d := intToSlice(int64(i))
 		// fmt.Printf("set key = %v\n", d)
-		meta = test_db.Set(meta, intToSlice(int64(i)), intToSlice(int64(i+5)))
+		meta = must(test_db.Set(meta, intToSlice(int64(i)), intToSlice(int64(i+5))))(t)
 		// fmt.Println("=========================================")
 	}
 	// Find test: Find these kv if they are the same.
 	for i := 1; i <= maxNum; i++ {
-		kv := test_db.Find(meta, intToSlice(int64(i)))
+		kv, _ := test_db.Find(meta, intToSlice(int64(i)))
 		expected := NewKeyValFromInt(int64(i), int64(i+5))
 		if kv == nil {
 			t.Errorf("Find test failed: Cannot find key = %d", i)
 			return
 		}
-		if *kv != expected {
+		if !isSameKV(*kv, expected) {
 			t.Errorf("Find test failed: val not expected. Expected = %v, got %v", expected, *kv)
 		}
 	}
 	// Iter test: Get an iterator and next 10 times. Should have the correct kv
 	for i := 1; i <= maxNum-10; i++ {
 		// kv := test_db.Find(intToSlice(int64(i)))
-		iter := test_db.SeekGE(meta, intToSlice(int64(i)))
+		iter := must(test_db.SeekGE(meta, intToSlice(int64(i))))(t)
 		for j := range 10 {
-			kv := iter.Deref()
+			kv := must(iter.Deref())(t)
 			expected := NewKeyValFromInt(int64(i+j), int64(i+j+5))
-			if kv != expected {
+			if !isSameKV(kv, expected) {
 				t.Errorf("Iter test failed for i = %d and j = %d: val not expected. Expected = %v, got %v", i, j, expected, kv)
 				return
 			}
@@ -79,19 +127,19 @@ func TestBTreeDisk(t *testing.T) {
 		}
 		// d := intToSlice(int64(i))
 		// fmt.Printf("del key = %v\n", d)
-		_, meta = test_db.Del(meta, intToSlice(int64(i)))
+		meta = must(test_db.Del(meta, intToSlice(int64(i))))(t)
 		// fmt.Println("=========================================")
 	}
 	// Find test: Find these kv if they are the same.
 	for i := 1; i <= maxNum; i++ {
-		kv := test_db.Find(meta, intToSlice(int64(i)))
+		kv, _ := test_db.Find(meta, intToSlice(int64(i)))
 		if i%2 == 0 {
 			expected := NewKeyValFromInt(int64(i), int64(i+5))
 			if kv == nil {
 				t.Errorf("Find test failed: Cannot find key = %d", i)
 				return
 			}
-			if *kv != expected {
+			if !isSameKV(*kv, expected) {
 				t.Errorf("Find test failed: val not expected. Expected = %v, got %v", expected, *kv)
 			}
 		} else {
@@ -116,13 +164,14 @@ func TestBTreeDisk_Shuffle(t *testing.T) {
 		numbers[i], numbers[j] = numbers[j], numbers[i]
 	})
 	// Create a new BTreeDisk using a test file
-	test_db := NewBPTreeDisk("test_db.db")
-	meta := test_db.LoadMetaPage()
+	test_db := newTestTree(t)
+	defer test_db.Close()
+	meta := must(test_db.LoadMetaPage())(t)
 	// Insert test: insert to check if it's good.
 	for _, i := range numbers {
 		// d := intToSlice(int64(i))
 		// fmt.Printf("insert key = %v\n", d)
-		meta = test_db.Insert(meta, intToSlice(int64(i)), intToSlice(int64(i)))
+		meta = must(test_db.Insert(meta, intToSlice(int64(i)), intToSlice(int64(i))))(t)
 		// fmt.Println("=========================================")
 	}
 	// Find test: Find these kv if they are the same.
@@ -130,13 +179,13 @@ func TestBTreeDisk_Shuffle(t *testing.T) {
 		numbers[i], numbers[j] = numbers[j], numbers[i]
 	})
 	for _, i := range numbers {
-		kv := test_db.Find(meta, intToSlice(int64(i)))
+		kv, _ := test_db.Find(meta, intToSlice(int64(i)))
 		expected := NewKeyValFromInt(int64(i), int64(i))
 		if kv == nil {
 			t.Errorf("Find test failed: Cannot find key = %d", i)
 			return
 		}
-		if *kv != expected {
+		if !isSameKV(*kv, expected) {
 			t.Errorf("Find test failed: val not expected. Expected = %v, got %v", expected, *kv)
 		}
 	}
@@ -147,7 +196,7 @@ func TestBTreeDisk_Shuffle(t *testing.T) {
 	for _, i := range numbers {
 		// d := intToSlice(int64(i))
 		// fmt.Printf("set key = %v\n", d)
-		meta = test_db.Set(meta, intToSlice(int64(i)), intToSlice(int64(i+5)))
+		meta = must(test_db.Set(meta, intToSlice(int64(i)), intToSlice(int64(i+5))))(t)
 		// fmt.Println("=========================================")
 	}
 	// Find test: Find these kv if they are the same.
@@ -155,13 +204,13 @@ func TestBTreeDisk_Shuffle(t *testing.T) {
 		numbers[i], numbers[j] = numbers[j], numbers[i]
 	})
 	for _, i := range numbers {
-		kv := test_db.Find(meta, intToSlice(int64(i)))
+		kv, _ := test_db.Find(meta, intToSlice(int64(i)))
 		expected := NewKeyValFromInt(int64(i), int64(i+5))
 		if kv == nil {
 			t.Errorf("Find test failed: Cannot find key = %d", i)
 			return
 		}
-		if *kv != expected {
+		if !isSameKV(*kv, expected) {
 			t.Errorf("Find test failed: val not expected. Expected = %v, got %v", expected, *kv)
 		}
 	}
@@ -175,7 +224,7 @@ func TestBTreeDisk_Shuffle(t *testing.T) {
 		}
 		// d := intToSlice(int64(i))
 		// fmt.Printf("del key = %v\n", d)
-		_, meta = test_db.Del(meta, intToSlice(int64(i)))
+		meta = must(test_db.Del(meta, intToSlice(int64(i))))(t)
 		// fmt.Println("=========================================")
 	}
 	// Find test: Find these kv if they are the same.
@@ -183,14 +232,14 @@ func TestBTreeDisk_Shuffle(t *testing.T) {
 		numbers[i], numbers[j] = numbers[j], numbers[i]
 	})
 	for _, i := range numbers {
-		kv := test_db.Find(meta, intToSlice(int64(i)))
+		kv, _ := test_db.Find(meta, intToSlice(int64(i)))
 		if i%2 == 0 {
 			expected := NewKeyValFromInt(int64(i), int64(i+5))
 			if kv == nil {
 				t.Errorf("Find test failed: Cannot find key = %d", i)
 				return
 			}
-			if *kv != expected {
+			if !isSameKV(*kv, expected) {
 				t.Errorf("Find test failed: val not expected. Expected = %v, got %v", expected, *kv)
 			}
 		} else {
@@ -201,3 +250,757 @@ func TestBTreeDisk_Shuffle(t *testing.T) {
 		}
 	}
 }
+
+func TestFileAllocator_Persist(t *testing.T) {
+	test_db := newTestTree(t)
+	defer test_db.Close()
+	meta := must(test_db.LoadMetaPage())(t)
+	// Enough blocks to need more than one free list page
+	maxNum := FREE_LIST_MAX_BLOCK + 10
+	for i := 1; i <= 50; i++ {
+		meta = must(test_db.Insert(meta, intToSlice(int64(i)), intToSlice(int64(i))))(t)
+	}
+	ptrs := make([]uint64, maxNum)
+	for i := range maxNum {
+		ptrs[i] = test_db.pager.allocator().alloc()
+	}
+	for _, ptr := range ptrs {
+		test_db.pager.allocator().free(ptr)
+	}
+	mustOK(t, test_db.WriteMetaPage(meta))
+
+	expected := *test_db.pager.allocator()
+	loaded, err := LoadFileAllocator(test_db.pager, must(test_db.LoadMetaPage())(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.last_free != expected.last_free {
+		t.Errorf("last_free different, expected = %v, actual = %v", expected.last_free, loaded.last_free)
+	}
+	if len(loaded.list_block) != 2 {
+		t.Errorf("Expected free list in 2 pages, got %v", len(loaded.list_block))
+	}
+	slices.Sort(expected.free_block)
+	slices.Sort(loaded.free_block)
+	if !slices.Equal(loaded.free_block, expected.free_block) {
+		t.Errorf("free_block different, expected = %v, actual = %v", expected.free_block, loaded.free_block)
+	}
+	// Write again: old list pages are released, not leaked
+	mustOK(t, test_db.WriteMetaPage(meta))
+	reloaded, err := LoadFileAllocator(test_db.pager, must(test_db.LoadMetaPage())(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded.free_block)+len(reloaded.list_block) != len(loaded.free_block)+len(loaded.list_block) {
+		t.Errorf("Free list size changed after rewrite, expected = %v, actual = %v",
+			len(loaded.free_block)+len(loaded.list_block), len(reloaded.free_block)+len(reloaded.list_block))
+	}
+	// Data still readable
+	for i := 1; i <= 50; i++ {
+		if kv, _ := test_db.Find(meta, intToSlice(int64(i))); kv == nil {
+			t.Errorf("Find test failed: Cannot find key = %d", i)
+		}
+	}
+}
+
+func TestBTreeDisk_Reopen(t *testing.T) {
+	dbPath := testDBPath(t)
+	maxNum := 300
+	test_db := must(NewBPTreeDisk(dbPath))(t)
+	defer test_db.Close()
+	meta := must(test_db.LoadMetaPage())(t)
+	for i := 1; i <= maxNum; i++ {
+		meta = must(test_db.Insert(meta, intToSlice(int64(i)), intToSlice(int64(i))))(t)
+	}
+	mustOK(t, test_db.WriteMetaPage(meta))
+
+	// Reopen: all keys are there, and new writes do not overwrite old pages
+	reopened, err := OpenBPTreeDisk(dbPath)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer reopened.Close()
+	if reopened.pager.allocator().last_free != test_db.pager.allocator().last_free {
+		t.Errorf("last_free different, expected = %v, actual = %v", test_db.pager.allocator().last_free, reopened.pager.allocator().last_free)
+	}
+	meta = must(reopened.LoadMetaPage())(t)
+	for i := maxNum + 1; i <= 2*maxNum; i++ {
+		meta = must(reopened.Insert(meta, intToSlice(int64(i)), intToSlice(int64(i))))(t)
+	}
+	mustOK(t, reopened.WriteMetaPage(meta))
+	for i := 1; i <= 2*maxNum; i++ {
+		kv, _ := reopened.Find(meta, intToSlice(int64(i)))
+		expected := NewKeyValFromInt(int64(i), int64(i))
+		if kv == nil {
+			t.Fatalf("Find test failed: Cannot find key = %d", i)
+		}
+		if !isSameKV(*kv, expected) {
+			t.Errorf("Find test failed: val not expected. Expected = %v, got %v", expected, *kv)
+		}
+	}
+}
+
+func TestBTreeDisk_OpenInvalid(t *testing.T) {
+	dbPath := testDBPath(t)
+	if err := os.WriteFile(dbPath, []byte("not a database file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenBPTreeDisk(dbPath); err == nil {
+		t.Errorf("Expected error when opening an invalid file")
+	}
+	// Missing file is created
+	os.Remove(dbPath)
+	test_db, err := OpenBPTreeDisk(dbPath)
+	if err != nil {
+		t.Fatalf("Open new file failed: %v", err)
+	}
+	defer test_db.Close()
+	meta := must(test_db.LoadMetaPage())(t)
+	if meta.header.next_page_pointer != 0 || meta.last_free != META_SLOTS {
+		t.Errorf("Expected empty meta page, got %v", meta)
+	}
+}
+
+func randomBytes(r *rand.Rand, minLen int, maxLen int) []byte {
+	data := make([]byte, minLen+r.Intn(maxLen-minLen+1))
+	r.Read(data)
+	return data
+}
+
+func TestBTreeDisk_VarLen(t *testing.T) {
+	maxNum := 500
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	test_db := newTestTree(t)
+	defer test_db.Close()
+	meta := must(test_db.LoadMetaPage())(t)
+	// Keys of any size up to MAX_KEY_SIZE, string columns included
+	model := make(map[string][]byte)
+	for len(model) < maxNum {
+		var key []byte
+		if len(model)%2 == 0 {
+			key = encodeKey(3, []Value{
+				{Type: TYPE_BYTES, Str: randomBytes(r, 1, 200)},
+				{Type: TYPE_INT64, I64: r.Int63()},
+			})
+		} else {
+			key = randomBytes(r, 1, MAX_KEY_SIZE)
+		}
+		if _, ok := model[string(key)]; ok {
+			continue
+		}
+		val := randomBytes(r, 0, MAX_INLINE_VAL_SIZE)
+		model[string(key)] = val
+		meta = must(test_db.Insert(meta, key, val))(t)
+	}
+	// Set test: values change size, pages may split
+	for key := range model {
+		val := randomBytes(r, 0, MAX_INLINE_VAL_SIZE)
+		model[key] = val
+		meta = must(test_db.Set(meta, []byte(key), val))(t)
+	}
+	for key, val := range model {
+		kv, _ := test_db.Find(meta, []byte(key))
+		if kv == nil {
+			t.Fatalf("Find test failed: Cannot find key = %v", []byte(key))
+		}
+		if !bytes.Equal(kv.val, val) {
+			t.Errorf("Find test failed: val not expected. Expected = %v, got %v", val, kv.val)
+		}
+	}
+	// Iter test: keys come back in order
+	keys := make([]string, 0, len(model))
+	for key := range model {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	iter := must(test_db.SeekGE(meta, []byte(keys[0])))(t)
+	for _, key := range keys[:100] {
+		kv := must(iter.Deref())(t)
+		if string(kv.key) != key {
+			t.Fatalf("Iter test failed: key not expected. Expected = %v, got %v", []byte(key), kv.key)
+		}
+		iter.Next()
+	}
+	iter.Close()
+	// Del test: del half of them
+	for _, key := range keys[:maxNum/2] {
+		meta = must(test_db.Del(meta, []byte(key)))(t)
+	}
+	for i, key := range keys {
+		kv, _ := test_db.Find(meta, []byte(key))
+		if i < maxNum/2 && kv != nil {
+			t.Errorf("Find test failed: Expected key to be nil, found = %v", kv.key)
+		}
+		if i >= maxNum/2 && (kv == nil || !bytes.Equal(kv.val, model[key])) {
+			t.Errorf("Find test failed: Cannot find key = %v", []byte(key))
+		}
+	}
+}
+
+func TestBTreeDisk_Overflow(t *testing.T) {
+	maxNum := 100
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	test_db := newTestTree(t)
+	defer test_db.Close()
+	meta := must(test_db.LoadMetaPage())(t)
+	// Mix of inline values and values of many overflow pages
+	model := make(map[int][]byte)
+	for i := 1; i <= maxNum; i++ {
+		model[i] = randomBytes(r, 0, 5*BLOCK_SIZE)
+		meta = must(test_db.Insert(meta, intToSlice(int64(i)), model[i]))(t)
+	}
+	for i := 1; i <= maxNum; i++ {
+		kv, _ := test_db.Find(meta, intToSlice(int64(i)))
+		if kv == nil {
+			t.Fatalf("Find test failed: Cannot find key = %d", i)
+		}
+		if !bytes.Equal(kv.val, model[i]) {
+			t.Errorf("Find test failed: val not expected for key = %d, len = %v, got len = %v", i, len(model[i]), len(kv.val))
+		}
+	}
+	// Iter test: Deref reads overflow pages too
+	iter := must(test_db.SeekGE(meta, intToSlice(1)))(t)
+	for i := 1; i <= 10; i++ {
+		kv := must(iter.Deref())(t)
+		if !bytes.Equal(kv.val, model[i]) {
+			t.Errorf("Iter test failed: val not expected for key = %d, len = %v, got len = %v", i, len(model[i]), len(kv.val))
+		}
+		iter.Next()
+	}
+	iter.Close()
+	// Set test: old chains go back to the allocator
+	mustOK(t, test_db.WriteMetaPage(meta))
+	for i := 1; i <= maxNum; i++ {
+		model[i] = randomBytes(r, 0, 5*BLOCK_SIZE)
+		meta = must(test_db.Set(meta, intToSlice(int64(i)), model[i]))(t)
+	}
+	for i := 1; i <= maxNum; i++ {
+		kv, _ := test_db.Find(meta, intToSlice(int64(i)))
+		if kv == nil || !bytes.Equal(kv.val, model[i]) {
+			t.Errorf("Find test failed: val not expected for key = %d", i)
+		}
+	}
+	// Old chains are freed once the meta page is written, then reused
+	mustOK(t, test_db.WriteMetaPage(meta))
+	if len(test_db.pager.allocator().free_block) == 0 {
+		t.Errorf("Expected old overflow pages to be freed")
+	}
+	lastFree := test_db.pager.allocator().last_free
+	for i := 1; i <= maxNum; i++ {
+		meta = must(test_db.Del(meta, intToSlice(int64(i))))(t)
+		if i%10 == 0 {
+			meta = must(test_db.Insert(meta, intToSlice(int64(i)), model[i]))(t)
+		}
+	}
+	if test_db.pager.allocator().last_free != lastFree {
+		t.Errorf("Expected freed pages to be reused, last_free %v -> %v", lastFree, test_db.pager.allocator().last_free)
+	}
+	for i := 1; i <= maxNum; i++ {
+		kv, _ := test_db.Find(meta, intToSlice(int64(i)))
+		if i%10 == 0 && (kv == nil || !bytes.Equal(kv.val, model[i])) {
+			t.Errorf("Find test failed: val not expected for key = %d", i)
+		}
+		if i%10 != 0 && kv != nil {
+			t.Errorf("Find test failed: Expected key to be nil, found = %v", kv.key)
+		}
+	}
+}
+
+// Blocks in use: allocated and not freed.
+func usedBlocks(tree *BPTreeDisk) int {
+	allocator := tree.pager.allocator()
+	return int(allocator.last_free) - len(allocator.free_block) - len(allocator.pending_block)
+}
+
+func TestBTreeDisk_OverflowCorrupt(t *testing.T) {
+	test_db := newTestTree(t)
+	defer test_db.Close()
+	meta := must(test_db.LoadMetaPage())(t)
+	for i := 1; i <= 2; i++ {
+		meta = must(test_db.Insert(meta, intToSlice(int64(i)), bytes.Repeat([]byte{byte(i)}, 3*BLOCK_SIZE)))(t)
+	}
+	mustOK(t, test_db.WriteMetaPage(meta))
+	buffer := new(bytes.Buffer)
+	root := must(test_db.readNode(meta.header.next_page_pointer, buffer, test_db.pager))(t).(*BTreeInternalPage)
+	leafPtr := root.children[0]
+	leaf := must(test_db.readNode(leafPtr, buffer, test_db.pager))(t).(*BTreeLeafPage)
+	// Point the first page of the chain of kv to next, in place
+	relink := func(kv *KeyVal, next uint64) {
+		mustOK(t, test_db.readBlockAtPointer(kv.overflow_ptr, buffer, test_db.pager))
+		oPage := OverflowPage{}
+		mustOK(t, oPage.read_from_buffer(buffer, true))
+		oPage.header.next_page_pointer = next
+		buffer.Reset()
+		mustOK(t, oPage.write_to_buffer(buffer))
+		mustOK(t, test_db.writeBufferToFileAtPtr(buffer, test_db.pager, kv.overflow_ptr))
+	}
+
+	// A cycle ends the walk instead of looping forever
+	relink(&leaf.kv[0], leaf.kv[0].overflow_ptr)
+	if _, err := test_db.Find(meta, intToSlice(1)); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Overflow cycle: expected ErrCorrupt, got %v", err)
+	}
+	if _, err := test_db.Del(meta, intToSlice(1)); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Del over an overflow cycle: expected ErrCorrupt, got %v", err)
+	}
+	// A chain going on into a tree page
+	relink(&leaf.kv[1], leafPtr)
+	if _, err := test_db.Find(meta, intToSlice(2)); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Overflow chain into a leaf: expected ErrCorrupt, got %v", err)
+	}
+}
+
+// The overflow chain written for an insert that fails is freed
+func TestBTreeDisk_FailedInsertFreesOverflow(t *testing.T) {
+	test_db := newTestTree(t)
+	defer test_db.Close()
+	meta := must(test_db.LoadMetaPage())(t)
+	meta = must(test_db.Insert(meta, intToSlice(1), intToSlice(1)))(t)
+	mustOK(t, test_db.WriteMetaPage(meta))
+	// The root of broken is a leaf, the insert fails once the value is written
+	root := must(test_db.readNode(meta.header.next_page_pointer, new(bytes.Buffer), test_db.pager))(t).(*BTreeInternalPage)
+	broken := meta
+	broken.header.next_page_pointer = root.children[0]
+	used := usedBlocks(&test_db)
+	if _, err := test_db.Insert(broken, intToSlice(2), bytes.Repeat([]byte{2}, 3*BLOCK_SIZE)); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Expected ErrCorrupt, got %v", err)
+	}
+	if usedBlocks(&test_db) != used {
+		t.Errorf("Expected %d blocks in use, got %d", used, usedBlocks(&test_db))
+	}
+}
+
+// The pages allocated for a split are freed when a later write of the insert
+// fails
+func TestBTreeDisk_FailedSplitFreesPages(t *testing.T) {
+	pager := NewFaultPager(rand.New(rand.NewSource(1)))
+	test_db := must(NewBPTreeDiskWithPager(pager))(t)
+	defer test_db.Close()
+	meta := must(test_db.LoadMetaPage())(t)
+	val := bytes.Repeat([]byte{1}, MAX_INLINE_VAL_SIZE)
+	for i := 1; i <= 5; i++ {
+		meta = must(test_db.Insert(meta, intToSlice(int64(i)), val))(t)
+	}
+	mustOK(t, test_db.WriteMetaPage(meta))
+	used := usedBlocks(&test_db)
+	// Fail each I/O call of the insert in turn, until it goes through
+	failed := 0
+	for n := 1; ; n++ {
+		pager.FailAfter(n)
+		newMeta, err := test_db.Insert(meta, intToSlice(6), val)
+		if err == nil {
+			meta = newMeta
+			break
+		}
+		if !errors.Is(err, errInjected) {
+			t.Fatalf("Expected the injected error, got %v", err)
+		}
+		failed += 1
+		if usedBlocks(&test_db) != used {
+			t.Errorf("Failed at call %d: expected %d blocks in use, got %d", n, used, usedBlocks(&test_db))
+		}
+	}
+	pager.FailAfter(0)
+	root := must(test_db.readNode(meta.header.next_page_pointer, new(bytes.Buffer), test_db.pager))(t).(*BTreeInternalPage)
+	if failed == 0 || root.nkey < 2 {
+		t.Errorf("Expected the insert to split the leaf and fail first, %d failures, %d leaves", failed, root.nkey)
+	}
+}
+
+func TestBTreeDisk_Mmap(t *testing.T) {
+	dbPath := testDBPath(t)
+	maxNum := 2000
+	test_db := must(NewBPTreeDisk(dbPath))(t)
+	defer test_db.Close()
+	if err := test_db.EnableMmap(); err != nil {
+		t.Skipf("mmap not available: %v", err)
+	}
+	// No page cache, every read goes through the mapping that has to grow
+	test_db.SetCacheSize(0)
+	meta := must(test_db.LoadMetaPage())(t)
+	for i := 1; i <= maxNum; i++ {
+		meta = must(test_db.Insert(meta, intToSlice(int64(i)), intToSlice(int64(i))))(t)
+	}
+	mustOK(t, test_db.WriteMetaPage(meta))
+	for i := 1; i <= maxNum; i++ {
+		kv, _ := test_db.Find(meta, intToSlice(int64(i)))
+		expected := NewKeyValFromInt(int64(i), int64(i))
+		if kv == nil || !isSameKV(*kv, expected) {
+			t.Fatalf("Find test failed: Cannot find key = %d", i)
+		}
+	}
+	iter := must(test_db.SeekGE(meta, intToSlice(1)))(t)
+	for i := 1; i <= maxNum; i++ {
+		expected := NewKeyValFromInt(int64(i), int64(i))
+		if kv := must(iter.Deref())(t); !isSameKV(kv, expected) {
+			t.Fatalf("Iter test failed: Expected = %v, got %v", expected, kv)
+		}
+		iter.Next()
+	}
+	iter.Close()
+	test_db.Close()
+
+	// Reopen with mmap
+	reopened, err := OpenBPTreeDisk(dbPath)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer reopened.Close()
+	if err := reopened.EnableMmap(); err != nil {
+		t.Fatal(err)
+	}
+	meta = must(reopened.LoadMetaPage())(t)
+	for i := 1; i <= maxNum; i++ {
+		if kv, _ := reopened.Find(meta, intToSlice(int64(i))); kv == nil {
+			t.Fatalf("Find after reopen failed: Cannot find key = %d", i)
+		}
+	}
+}
+
+func TestBTreeDisk_MetaSlots(t *testing.T) {
+	dbPath := testDBPath(t)
+	test_db := must(NewBPTreeDisk(dbPath))(t)
+	defer test_db.Close()
+	meta := must(test_db.LoadMetaPage())(t)
+	for gen := 1; gen <= 3; gen++ {
+		for i := (gen-1)*100 + 1; i <= gen*100; i++ {
+			meta = must(test_db.Insert(meta, intToSlice(int64(i)), intToSlice(int64(i))))(t)
+		}
+		mustOK(t, test_db.WriteMetaPage(meta))
+		if loaded := must(test_db.LoadMetaPage())(t); loaded.generation != uint64(gen) {
+			t.Errorf("Expected generation %d, got %d", gen, loaded.generation)
+		}
+	}
+	// Torn write of generation 3: its slot does not pass the checksum
+	flipByte(t, test_db.pager, 3%META_SLOTS*BLOCK_SIZE+PAGE_HEADER_SIZE, 0xFF)
+	test_db.Close()
+
+	// Reopen: back to generation 2, all of its keys are there
+	reopened, err := OpenBPTreeDisk(dbPath)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer reopened.Close()
+	meta = must(reopened.LoadMetaPage())(t)
+	if meta.generation != 2 {
+		t.Errorf("Expected generation 2 after torn write, got %d", meta.generation)
+	}
+	for i := 1; i <= 300; i++ {
+		kv, _ := reopened.Find(meta, intToSlice(int64(i)))
+		if i <= 200 && kv == nil {
+			t.Fatalf("Find test failed: Cannot find key = %d", i)
+		}
+		if i > 200 && kv != nil {
+			t.Fatalf("Find test failed: key = %d of the torn commit found", i)
+		}
+	}
+	// Next commit goes to the broken slot again
+	meta = must(reopened.Insert(meta, intToSlice(1000), intToSlice(1000)))(t)
+	mustOK(t, reopened.WriteMetaPage(meta))
+	if loaded := must(reopened.LoadMetaPage())(t); loaded.generation != 3 || must(reopened.Find(loaded, intToSlice(1000)))(t) == nil {
+		t.Errorf("Commit after recovery failed, generation = %d", loaded.generation)
+	}
+}
+
+// Height of the tree and number of leaves, walking all pages
+func treeShape(tb testing.TB, tree *BPTreeDisk, meta MetaPage) (int, int) {
+	tb.Helper()
+	if meta.header.next_page_pointer == 0 {
+		return 0, 0
+	}
+	buffer := new(bytes.Buffer)
+	height, leaves := 0, 0
+	level := []uint64{meta.header.next_page_pointer}
+	for len(level) > 0 {
+		height += 1
+		next := []uint64{}
+		for _, ptr := range level {
+			if convert, ok := must(tree.readNode(ptr, buffer, tree.pager))(tb).(*BTreeInternalPage); ok {
+				next = append(next, convert.children...)
+			} else {
+				leaves += 1
+			}
+		}
+		level = next
+	}
+	return height, leaves
+}
+
+func TestBTreeDisk_DelRebalance(t *testing.T) {
+	maxNum := 5000
+	val := make([]byte, 200)
+	test_db := newTestTree(t)
+	defer test_db.Close()
+	meta := must(test_db.LoadMetaPage())(t)
+	for i := 1; i <= maxNum; i++ {
+		meta = must(test_db.Insert(meta, intToSlice(int64(i)), val))(t)
+	}
+	height, leaves := treeShape(t, &test_db, meta)
+	if height < 3 {
+		t.Fatalf("Expected a tree of height >= 3, got %d", height)
+	}
+
+	// Delete all but every 100th key, in random order
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for _, i := range r.Perm(maxNum) {
+		if (i+1)%100 == 0 {
+			continue
+		}
+		newMeta, err := test_db.Del(meta, intToSlice(int64(i+1)))
+		if err != nil {
+			t.Fatalf("Del test failed: Cannot delete key = %d: %v", i+1, err)
+		}
+		meta = newMeta
+	}
+	for i := 1; i <= maxNum; i++ {
+		kv, _ := test_db.Find(meta, intToSlice(int64(i)))
+		if (i%100 == 0) != (kv != nil) {
+			t.Fatalf("Find test failed for key = %d, got %v", i, kv)
+		}
+	}
+	newHeight, newLeaves := treeShape(t, &test_db, meta)
+	if newHeight >= height {
+		t.Errorf("Expected the tree to get lower, height %d -> %d", height, newHeight)
+	}
+	// Leaves at least half full, except the last one
+	kv := NewKeyValFromBytes(intToSlice(1), val)
+	live := (maxNum / 100) * (2 + kv.size())
+	if newLeaves > 2*live/BLOCK_SIZE+1 {
+		t.Errorf("Expected leaves to be merged, leaves %d -> %d", leaves, newLeaves)
+	}
+
+	// Delete the rest: empty tree, then insert again
+	for i := 100; i <= maxNum; i += 100 {
+		meta = must(test_db.Del(meta, intToSlice(int64(i))))(t)
+	}
+	if meta.header.next_page_pointer != 0 {
+		t.Errorf("Expected empty tree, got root = %d", meta.header.next_page_pointer)
+	}
+	meta = must(test_db.Insert(meta, intToSlice(1), intToSlice(1)))(t)
+	if kv, _ := test_db.Find(meta, intToSlice(1)); kv == nil {
+		t.Errorf("Find test failed: Cannot find key = 1 after emptying the tree")
+	}
+}
+
+// The lookup before binary search, kept to compare with
+func linearFindLastLE(n int, key []byte, keyAt func(i int) []byte) int {
+	pos := -1
+	for i := 0; i < n; i++ {
+		if compareKey(keyAt(i), key) <= 0 {
+			pos = i
+		}
+	}
+	return pos
+}
+
+// Fill a leaf page with small keys until it is full: large fan-out
+func fullLeafPage() BTreeLeafPage {
+	lpage := NewLPage()
+	for i := int64(1); ; i++ {
+		kv := NewKeyValFromInt(i, i)
+		if lpage.size()+2+kv.size() > PAGE_SIZE {
+			return lpage
+		}
+		lpage.InsertKV(&kv)
+	}
+}
+
+func BenchmarkLeafPage_FindLastLE(b *testing.B) {
+	lpage := fullLeafPage()
+	keyAt := func(i int) []byte { return lpage.kv[i].key }
+	r := rand.New(rand.NewSource(1))
+	b.Run("linear", func(b *testing.B) {
+		for range b.N {
+			key := intToSlice(r.Int63n(int64(lpage.nkv)) + 1)
+			linearFindLastLE(int(lpage.nkv), key, keyAt)
+		}
+	})
+	b.Run("binary", func(b *testing.B) {
+		for range b.N {
+			key := intToSlice(r.Int63n(int64(lpage.nkv)) + 1)
+			findLastLE(int(lpage.nkv), key, keyAt)
+		}
+	})
+}
+
+func BenchmarkInternalPage_FindLastLE(b *testing.B) {
+	ipage := NewIPage()
+	for i := int64(1); ipage.size() < PAGE_SIZE-64; i++ {
+		key := NewKeyEntryFromInt(i)
+		ipage.InsertKV(&key, uint64(i)*BLOCK_SIZE)
+	}
+	keyAt := func(i int) []byte { return ipage.keys[i].data }
+	r := rand.New(rand.NewSource(1))
+	b.Run("linear", func(b *testing.B) {
+		for range b.N {
+			key := intToSlice(r.Int63n(int64(ipage.nkey)) + 1)
+			linearFindLastLE(int(ipage.nkey), key, keyAt)
+		}
+	})
+	b.Run("binary", func(b *testing.B) {
+		for range b.N {
+			key := intToSlice(r.Int63n(int64(ipage.nkey)) + 1)
+			findLastLE(int(ipage.nkey), key, keyAt)
+		}
+	})
+}
+
+func TestBTreeDisk_Errors(t *testing.T) {
+	test_db := newTestTree(t)
+	defer test_db.Close()
+	meta := must(test_db.LoadMetaPage())(t)
+	for i := 1; i <= 10; i++ {
+		meta = must(test_db.Insert(meta, intToSlice(int64(i)), intToSlice(int64(i))))(t)
+	}
+	// Bad input does not change the tree
+	if _, err := test_db.Insert(meta, make([]byte, MAX_KEY_SIZE+1), nil); !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("Insert: expected ErrKeyTooLarge, got %v", err)
+	}
+	if _, err := test_db.Set(meta, make([]byte, MAX_KEY_SIZE+1), nil); !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("Set: expected ErrKeyTooLarge, got %v", err)
+	}
+	if kv, err := test_db.Find(meta, intToSlice(11)); kv != nil || !errors.Is(err, ErrNotFound) {
+		t.Errorf("Find: expected ErrNotFound, got %v, %v", kv, err)
+	}
+	if _, err := test_db.Del(meta, intToSlice(11)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Del: expected ErrNotFound, got %v", err)
+	}
+	mustOK(t, test_db.WriteMetaPage(meta))
+
+	// Every call after Close fails the same way
+	mustOK(t, test_db.Close())
+	if _, err := test_db.LoadMetaPage(); !errors.Is(err, ErrClosed) {
+		t.Errorf("LoadMetaPage: expected ErrClosed, got %v", err)
+	}
+	if _, err := test_db.Find(meta, intToSlice(1)); !errors.Is(err, ErrClosed) {
+		t.Errorf("Find: expected ErrClosed, got %v", err)
+	}
+	if _, err := test_db.SeekFirst(meta); !errors.Is(err, ErrClosed) {
+		t.Errorf("SeekFirst: expected ErrClosed, got %v", err)
+	}
+	if err := test_db.WriteMetaPage(meta); !errors.Is(err, ErrClosed) {
+		t.Errorf("WriteMetaPage: expected ErrClosed, got %v", err)
+	}
+}
+
+func BenchmarkBTreeDisk_Find(b *testing.B) {
+	maxNum := 20000
+	test_db := newTestTree(b)
+	defer test_db.Close()
+	meta := must(test_db.LoadMetaPage())(b)
+	for i := 1; i <= maxNum; i++ {
+		meta = must(test_db.Insert(meta, intToSlice(int64(i)), intToSlice(int64(i))))(b)
+	}
+	r := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+	for range b.N {
+		test_db.Find(meta, intToSlice(r.Int63n(int64(maxNum))+1))
+	}
+}
+
+func BenchmarkBTreeDisk_Insert(b *testing.B) {
+	test_db := newTestTree(b)
+	defer test_db.Close()
+	meta := must(test_db.LoadMetaPage())(b)
+	r := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+	for range b.N {
+		meta = must(test_db.Insert(meta, intToSlice(r.Int63()), intToSlice(1)))(b)
+	}
+}
+
+func TestBIter_Bidirectional(t *testing.T) {
+	maxNum := 3000
+	test_db := newTestTree(t)
+	defer test_db.Close()
+	meta := must(test_db.LoadMetaPage())(t)
+	if iter := must(test_db.SeekFirst(meta))(t); iter.Valid() {
+		t.Errorf("Expected no valid iterator on an empty tree")
+	}
+	// Even keys only
+	for i := 1; i <= maxNum; i++ {
+		meta = must(test_db.Insert(meta, intToSlice(int64(2*i)), intToSlice(int64(i))))(t)
+	}
+	keyOf := func(iter *BIter) int64 {
+		return int64(binary.BigEndian.Uint64(must(iter.Deref())(t).key))
+	}
+
+	// Full scans both ways
+	count := 0
+	for iter := must(test_db.SeekFirst(meta))(t); iter.Valid(); iter.Next() {
+		count += 1
+		if keyOf(iter) != int64(2*count) {
+			t.Fatalf("Forward scan failed: expected key %d, got %d", 2*count, keyOf(iter))
+		}
+	}
+	if count != maxNum {
+		t.Errorf("Forward scan: expected %d keys, got %d", maxNum, count)
+	}
+	count = 0
+	for iter := must(test_db.SeekLast(meta))(t); iter.Valid(); iter.Prev() {
+		if keyOf(iter) != int64(2*(maxNum-count)) {
+			t.Fatalf("Backward scan failed: expected key %d, got %d", 2*(maxNum-count), keyOf(iter))
+		}
+		count += 1
+	}
+	if count != maxNum {
+		t.Errorf("Backward scan: expected %d keys, got %d", maxNum, count)
+	}
+
+	// Seek between keys, on keys, and past both ends
+	for i := 0; i <= 2*maxNum+1; i++ {
+		ge := must(test_db.SeekGE(meta, intToSlice(int64(i))))(t)
+		expectGE := int64(i + i%2)
+		if i == 0 {
+			expectGE = 2
+		}
+		if expectGE > int64(2*maxNum) {
+			if ge.Valid() {
+				t.Errorf("must(SeekGE(%d))(t): expected not valid, got %d", i, keyOf(ge))
+			}
+		} else if !ge.Valid() || keyOf(ge) != expectGE {
+			t.Fatalf("must(SeekGE(%d))(t): expected %d", i, expectGE)
+		}
+		le := must(test_db.SeekLE(meta, intToSlice(int64(i))))(t)
+		expectLE := int64(i - i%2)
+		if i == 2*maxNum+1 {
+			expectLE = int64(2 * maxNum)
+		}
+		if expectLE < 2 {
+			if le.Valid() {
+				t.Errorf("must(SeekLE(%d))(t): expected not valid, got %d", i, keyOf(le))
+			}
+		} else if !le.Valid() || keyOf(le) != expectLE {
+			t.Fatalf("must(SeekLE(%d))(t): expected %d", i, expectLE)
+		}
+	}
+
+	// Past the last key: Deref fails instead of reading out of the leaf
+	past := must(test_db.SeekGE(meta, intToSlice(int64(2*maxNum+1))))(t)
+	if _, err := past.Deref(); past.Valid() || !errors.Is(err, ErrInvalidIter) {
+		t.Errorf("Deref past the last key: expected ErrInvalidIter, got %v", err)
+	}
+	past.Close()
+
+	// Change direction across leaves
+	iter := must(test_db.SeekGE(meta, intToSlice(1000)))(t)
+	for range 500 {
+		iter.Next()
+	}
+	for range 500 {
+		iter.Prev()
+	}
+	if !iter.Valid() || keyOf(iter) != 1000 {
+		t.Errorf("Next then Prev: expected to be back on 1000")
+	}
+	iter.Close()
+
+	// Latest 10 keys
+	latest := []int64{}
+	for iter := must(test_db.SeekLast(meta))(t); iter.Valid() && len(latest) < 10; iter.Prev() {
+		latest = append(latest, keyOf(iter))
+	}
+	if len(latest) != 10 || latest[0] != int64(2*maxNum) || latest[9] != int64(2*maxNum-18) {
+		t.Errorf("Latest keys not expected: %v", latest)
+	}
+}
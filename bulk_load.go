@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"iter"
+)
+
+// Pages built by BulkLoad are filled to this part of PAGE_SIZE by default,
+// leaving some room for later inserts before pages split.
+const DEFAULT_FILL_FACTOR = 0.9
+
+// Set in PageHeader.flags of a meta page whose tree was built by BulkLoad and
+// not written since: the pages of each level link to the next one. Other
+// writes copy pages without fixing the link of the page before, they clear
+// it and write pages with no link.
+const PAGE_FLAG_LINKED = 2
+
+// Build a new tree from key value pairs sorted by key, without duplicates.
+// Pages are packed left to right up to fillFactor * PAGE_SIZE bytes (once
+// compressed for leaves of a database with compression), then
+// internal levels are built bottom-up. Pages of the same level are linked
+// through next_page_pointer, the meta page has PAGE_FLAG_LINKED.
+// Return a meta page pointing to the new tree, to commit with WriteMetaPage.
+// The new tree replaces the committed one, whose pages are freed by that
+// commit.
+func (tree *BPTreeDisk) BulkLoad(sortedPairs iter.Seq2[[]byte, []byte], fillFactor float64) (MetaPage, error) {
+	if fillFactor <= 0 || fillFactor > 1 {
+		return MetaPage{}, fmt.Errorf("fill factor %v is not in (0, 1]", fillFactor)
+	}
+	limit := int(fillFactor * PAGE_SIZE)
+	buffer := new(bytes.Buffer) // Buffer size = 0
+	// Step 1: Use the pager opened with the tree. The tree is only locked
+	// while writing, sortedPairs may read it (e.g. tree.All)
+	tree.mu.RLock()
+	pager, err := tree.getPager()
+	tree.mu.RUnlock()
+	if err != nil {
+		return MetaPage{}, err
+	}
+	// Run write under the lock, if the tree still uses the pager of step 1:
+	// it is replaced when the tree is closed, reopened or switches to WAL mode
+	locked := func(write func() error) error {
+		tree.mu.Lock()
+		defer tree.mu.Unlock()
+		current, err := tree.getPager()
+		if err != nil {
+			return err
+		}
+		if current != pager {
+			return fmt.Errorf("BulkLoad: pager of %s replaced while loading", tree.fileName)
+		}
+		return write()
+	}
+
+	// Step 2: Pack the leaves, the next leaf pointer is allocated before the
+	// current leaf is written
+	entries := []pageEntry{}
+	leaf := NewLPage()
+	var leafPtr uint64 = 0
+	var lastKey []byte = nil
+	for key, val := range sortedPairs {
+		if err := checkKeySize(key); err != nil {
+			return MetaPage{}, err
+		}
+		if lastKey != nil && compareKey(key, lastKey) <= 0 {
+			return MetaPage{}, fmt.Errorf("BulkLoad: key %v after %v, input is not sorted", key, lastKey)
+		}
+		err := locked(func() error {
+			kv, err := tree.newLeafKV(key, val, buffer, pager)
+			if err != nil {
+				return err
+			}
+			if leafPtr == 0 {
+				leafPtr = pager.Alloc()
+			}
+			full := leaf.size()+2+kv.size() > limit
+			if full && leaf.nkv > 0 && tree.compression != COMPRESSION_NONE {
+				// May still fit once compressed
+				candidate := leaf.clone()
+				candidate.kv = append(candidate.kv, kv)
+				candidate.nkv += 1
+				full = !tree.fitsCompressed(&candidate, limit)
+			}
+			if leaf.nkv > 0 && full {
+				nextPtr := pager.Alloc()
+				leaf.header.next_page_pointer = nextPtr
+				if err := tree.writeBulkPage(&leaf, buffer, pager, leafPtr); err != nil {
+					return err
+				}
+				entries = append(entries, pageEntry{key: getKeyEntryFromKeyVal(&leaf.kv[0]), ptr: leafPtr})
+				leaf = NewLPage()
+				leafPtr = nextPtr
+			}
+			leaf.kv = append(leaf.kv, kv)
+			leaf.nkv += 1
+			lastKey = kv.key
+			return nil
+		})
+		if err != nil {
+			return MetaPage{}, err
+		}
+	}
+	metaPage := NewMetaPage()
+	err = locked(func() error {
+		// Step 3: Pages of the committed tree, retired by the new one. It is
+		// read last, commits made while loading are replaced too
+		committed, err := tree.loadMetaPage()
+		if err != nil {
+			return err
+		}
+		oldPages, err := tree.treePages(committed, buffer, pager)
+		if err != nil {
+			return err
+		}
+		metaPage.version = tree.reclaim.newVersion(committed.version, oldPages, nil)
+		if leaf.nkv == 0 {
+			// Nothing to load, empty tree
+			return nil
+		}
+		if err := tree.writeBulkPage(&leaf, buffer, pager, leafPtr); err != nil {
+			return err
+		}
+		entries = append(entries, pageEntry{key: getKeyEntryFromKeyVal(&leaf.kv[0]), ptr: leafPtr})
+
+		// Step 4: Internal levels until there is a single first internal page,
+		// there is always one above the leaves
+		entries, err = tree.bulkLoadLevel(entries, limit, buffer, pager)
+		for err == nil && len(entries) > 1 {
+			entries, err = tree.bulkLoadLevel(entries, limit, buffer, pager)
+		}
+		if err != nil {
+			return err
+		}
+		metaPage.header.next_page_pointer = entries[0].ptr
+		metaPage.header.flags |= PAGE_FLAG_LINKED
+		return nil
+	})
+	if err != nil {
+		return MetaPage{}, err
+	}
+	return metaPage, nil
+}
+
+// Pages of the tree of metaPage: internal, leaf and overflow pages.
+func (tree *BPTreeDisk) treePages(metaPage MetaPage, buffer *bytes.Buffer, pager Pager) ([]uint64, error) {
+	ptrs := []uint64{}
+	level := []uint64{}
+	if metaPage.header.next_page_pointer != 0 {
+		level = append(level, metaPage.header.next_page_pointer)
+	}
+	for len(level) > 0 {
+		next := []uint64{}
+		for _, ptr := range level {
+			ptrs = append(ptrs, ptr)
+			node, err := tree.readNode(ptr, buffer, pager)
+			if err != nil {
+				return nil, err
+			}
+			if convert, ok := node.(*BTreeInternalPage); ok {
+				next = append(next, convert.children...)
+				continue
+			}
+			convert := node.(*BTreeLeafPage)
+			for i := range convert.kv {
+				if err := tree.freeOverflow(&convert.kv[i], buffer, pager, &ptrs); err != nil {
+					return nil, err
+				}
+			}
+		}
+		level = next
+	}
+	return ptrs, nil
+}
+
+// Pack the pages of a level into internal pages, return the level above.
+func (tree *BPTreeDisk) bulkLoadLevel(entries []pageEntry, limit int, buffer *bytes.Buffer, pager Pager) ([]pageEntry, error) {
+	result := []pageEntry{}
+	page := NewIPage()
+	pagePtr := pager.Alloc()
+	for _, entry := range entries {
+		// At least 2 children per page, or levels never get smaller
+		if page.nkey >= 2 && page.size()+2+8+entry.key.size() > limit {
+			nextPtr := pager.Alloc()
+			page.header.next_page_pointer = nextPtr
+			if err := tree.writeBulkPage(&page, buffer, pager, pagePtr); err != nil {
+				return nil, err
+			}
+			result = append(result, pageEntry{key: page.keys[0], ptr: pagePtr})
+			page = NewIPage()
+			pagePtr = nextPtr
+		}
+		page.keys = append(page.keys, entry.key)
+		page.children = append(page.children, entry.ptr)
+		page.nkey += 1
+	}
+	if err := tree.writeBulkPage(&page, buffer, pager, pagePtr); err != nil {
+		return nil, err
+	}
+	return append(result, pageEntry{key: page.keys[0], ptr: pagePtr}), nil
+}
+
+// A leaf or internal page
+type bulkPage interface {
+	write_to_buffer(buffer *bytes.Buffer) error
+}
+
+// Write a page at a pointer allocated before.
+func (tree *BPTreeDisk) writeBulkPage(page bulkPage, buffer *bytes.Buffer, pager Pager, ptr uint64) error {
+	buffer.Reset()
+	if err := page.write_to_buffer(buffer); err != nil {
+		return err
+	}
+	return tree.writeBufferToFileAtPtr(buffer, pager, ptr)
+}
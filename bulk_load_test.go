@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"iter"
+	"testing"
+)
+
+// Pairs (i, i) for i in [1, maxNum], with a big value every 100 keys
+func sortedTestPairs(maxNum int) iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		for i := 1; i <= maxNum; i++ {
+			val := intToSlice(int64(i))
+			if i%100 == 0 {
+				val = bytes.Repeat(val, 1000)
+			}
+			if !yield(intToSlice(int64(i)), val) {
+				return
+			}
+		}
+	}
+}
+
+// Follow next_page_pointer from the first leaf, return the number of leaves
+// and of key value pairs seen in order.
+func walkLeafChain(t *testing.T, tree *BPTreeDisk, meta MetaPage) (int, int) {
+	buffer := new(bytes.Buffer)
+	node := must(tree.readNode(meta.header.next_page_pointer, buffer, tree.pager))(t)
+	for {
+		convert, ok := node.(*BTreeInternalPage)
+		if !ok {
+			break
+		}
+		node = must(tree.readNode(convert.children[0], buffer, tree.pager))(t)
+	}
+	leaves, pairs := 0, 0
+	for {
+		leaf := node.(*BTreeLeafPage)
+		for _, kv := range leaf.kv {
+			pairs += 1
+			if !bytes.Equal(kv.key, intToSlice(int64(pairs))) {
+				t.Fatalf("Leaf chain: expected key %d, got %v", pairs, kv.key)
+			}
+		}
+		leaves += 1
+		if leaf.header.next_page_pointer == 0 {
+			return leaves, pairs
+		}
+		node = must(tree.readNode(leaf.header.next_page_pointer, buffer, tree.pager))(t)
+	}
+}
+
+func TestBTreeDisk_BulkLoad(t *testing.T) {
+	dbPath := testDBPath(t)
+	maxNum := 20000
+	test_db := must(NewBPTreeDisk(dbPath))(t)
+	defer test_db.Close()
+	if meta := must(test_db.BulkLoad(sortedTestPairs(0), DEFAULT_FILL_FACTOR))(t); meta.header.next_page_pointer != 0 {
+		t.Errorf("Expected empty tree from empty input")
+	}
+
+	leavesAt := map[float64]int{}
+	for _, fillFactor := range []float64{0.5, 1} {
+		meta := must(test_db.BulkLoad(sortedTestPairs(maxNum), fillFactor))(t)
+		leaves, pairs := walkLeafChain(t, &test_db, meta)
+		if pairs != maxNum {
+			t.Fatalf("Leaf chain: expected %d pairs, got %d", maxNum, pairs)
+		}
+		leavesAt[fillFactor] = leaves
+		for i := 1; i <= maxNum; i++ {
+			kv, _ := test_db.Find(meta, intToSlice(int64(i)))
+			var expected []byte
+			if kv == nil {
+				t.Fatalf("Find test failed: Cannot find key = %d", i)
+			}
+			if i%100 == 0 {
+				expected = bytes.Repeat(intToSlice(int64(i)), 1000)
+			} else {
+				expected = intToSlice(int64(i))
+			}
+			if !bytes.Equal(kv.val, expected) {
+				t.Fatalf("Find test failed: val not expected for key = %d", i)
+			}
+		}
+		// Bulk loaded tree is a normal tree: commit, change, reopen
+		mustOK(t, test_db.WriteMetaPage(meta))
+		meta = must(test_db.Insert(meta, intToSlice(int64(maxNum+1)), intToSlice(1)))(t)
+		meta = must(test_db.Del(meta, intToSlice(1)))(t)
+		mustOK(t, test_db.WriteMetaPage(meta))
+		reopened, err := OpenBPTreeDisk(dbPath)
+		if err != nil {
+			t.Fatalf("Reopen failed: %v", err)
+		}
+		meta = must(reopened.LoadMetaPage())(t)
+		if _, err := reopened.Find(meta, intToSlice(1)); !errors.Is(err, ErrNotFound) || must(reopened.Find(meta, intToSlice(int64(maxNum+1))))(t) == nil {
+			t.Errorf("Changes after bulk load not found after reopen")
+		}
+		reopened.Close()
+	}
+	if leavesAt[1] >= leavesAt[0.5] {
+		t.Errorf("Expected less leaves with a higher fill factor, got %v", leavesAt)
+	}
+
+	// Unsorted input
+	_, err := test_db.BulkLoad(func(yield func([]byte, []byte) bool) {
+		_ = yield(intToSlice(2), nil) && yield(intToSlice(1), nil)
+	}, DEFAULT_FILL_FACTOR)
+	if err == nil {
+		t.Errorf("Expected error on unsorted input")
+	}
+}
+
+func TestBTreeDisk_BulkLoadOver(t *testing.T) {
+	kv, meta := newTestKV(t, 500)
+	meta = must(kv.Set(meta, intToSlice(1), bytes.Repeat([]byte{1}, 2*BLOCK_SIZE)))(t)
+	mustOK(t, kv.WriteMetaPage(meta))
+
+	// The tree it replaces is freed by the commit, pages are reused
+	var lastFree uint64
+	for round := range 3 {
+		mustOK(t, kv.WriteMetaPage(must(kv.BulkLoad(sortedTestPairs(500), DEFAULT_FILL_FACTOR))(t)))
+		report := must(kv.tree.Check())(t)
+		if !report.OK() || report.Keys != 500 {
+			t.Fatalf("Round %d: %d keys, errors:\n%s", round, report.Keys, checkErrors(report))
+		}
+		if round > 0 && kv.tree.pager.allocator().last_free > lastFree {
+			t.Errorf("Round %d: file grew from %d to %d blocks", round, lastFree, kv.tree.pager.allocator().last_free)
+		}
+		lastFree = kv.tree.pager.allocator().last_free
+	}
+}
+
+// Repack a tree from its own pairs: BulkLoad reads the tree it writes to
+func TestBTreeDisk_BulkLoadFromItself(t *testing.T) {
+	kv, meta := newTestKV(t, 500)
+	meta = must(kv.Set(meta, intToSlice(1), bytes.Repeat([]byte{1}, 2*BLOCK_SIZE)))(t)
+	mustOK(t, kv.WriteMetaPage(meta))
+	seq, seqErr := kv.All(meta)
+	packed, err := kv.BulkLoad(seq, 1)
+	mustOK(t, errors.Join(err, seqErr()))
+	mustOK(t, kv.WriteMetaPage(packed))
+	report := must(kv.tree.Check())(t)
+	if !report.OK() || report.Keys != 500 {
+		t.Fatalf("%d keys, errors:\n%s", report.Keys, checkErrors(report))
+	}
+	if val := must(kv.Get(packed, intToSlice(1)))(t); len(val) != 2*BLOCK_SIZE {
+		t.Errorf("Big value: expected %d bytes, got %d", 2*BLOCK_SIZE, len(val))
+	}
+}
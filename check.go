@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+)
+
+// ========================== Integrity check ==========================
+// Check walks the committed tree and the free list from disk, without the
+// page cache, and reports every violation found instead of stopping at the
+// first one.
+
+// A violation, at the page where it was found (0: not about one page).
+type CheckIssue struct {
+	Ptr     uint64
+	Message string
+}
+
+func (i CheckIssue) String() string {
+	if i.Ptr == 0 {
+		return i.Message
+	}
+	return fmt.Sprintf("page %d: %s", i.Ptr/BLOCK_SIZE, i.Message)
+}
+
+type CheckReport struct {
+	Generation    uint64
+	Height        int // Levels of internal pages, plus the leaves
+	InternalPages int
+	LeafPages     int
+	OverflowPages int
+	FreeListPages int
+	FreePages     int // Blocks on the free list
+	Keys          int
+	Errors        []CheckIssue
+}
+
+// No error found.
+func (r *CheckReport) OK() bool {
+	return len(r.Errors) == 0
+}
+
+type checker struct {
+	tree      *BPTreeDisk
+	pager     Pager
+	buffer    *bytes.Buffer
+	report    *CheckReport
+	last_free uint64
+	used      map[uint64]string // Block -> what it is used for
+	leaves    []PageHeader      // Leaves in key order, page_ptr is where they are
+	leafDepth int
+}
+
+func (c *checker) errorf(ptr uint64, format string, args ...any) {
+	c.report.Errors = append(c.report.Errors, CheckIssue{Ptr: ptr, Message: fmt.Sprintf(format, args...)})
+}
+
+// Mark a block as used, return false if it must not be read.
+func (c *checker) use(ptr uint64, what string) bool {
+	if ptr%BLOCK_SIZE != 0 || ptr/BLOCK_SIZE < META_SLOTS || ptr/BLOCK_SIZE >= c.last_free {
+		c.errorf(0, "%s pointer %d is not a block in [%d, %d)", what, ptr, META_SLOTS, c.last_free)
+		return false
+	}
+	if other, ok := c.used[ptr/BLOCK_SIZE]; ok {
+		c.errorf(ptr, "used as %s, already used as %s", what, other)
+		return false
+	}
+	c.used[ptr/BLOCK_SIZE] = what
+	return true
+}
+
+// Read a block with its header, the page type has to be one of pageTypes.
+func (c *checker) read(ptr uint64, pageTypes ...uint8) (PageHeader, bool) {
+	header := PageHeader{}
+	if err := c.tree.readBlockAtPointer(ptr, c.buffer, c.pager); err != nil {
+		c.errorf(ptr, "%v", err)
+		return header, false
+	}
+	if err := header.read_from_buffer(c.buffer); err != nil {
+		c.errorf(ptr, "%v", err)
+		return header, false
+	}
+	if !slices.Contains(pageTypes, header.page_type) {
+		c.errorf(ptr, "page type %d, expected one of %v", header.page_type, pageTypes)
+		return header, false
+	}
+	return header, true
+}
+
+// Check the page at ptr and its subtree, all keys have to be in [lo, hi)
+// (nil: no bound). Return the first key of the page, nil if it is unreadable.
+func (c *checker) checkNode(ptr uint64, lo []byte, hi []byte, depth int) []byte {
+	if !c.use(ptr, "tree page") {
+		return nil
+	}
+	// The first internal page is always above the leaves
+	pageTypes := []uint8{1, 2}
+	if depth == 0 {
+		pageTypes = pageTypes[:1]
+	}
+	header, ok := c.read(ptr, pageTypes...)
+	if !ok {
+		return nil
+	}
+	inBounds := func(key []byte) bool {
+		return (lo == nil || compareKey(key, lo) >= 0) && (hi == nil || compareKey(key, hi) < 0)
+	}
+	if header.page_type == 2 {
+		// Step 1: Leaf, all leaves are at the same depth
+		leaf := BTreeLeafPage{header: header}
+		if err := leaf.read_from_buffer(c.buffer, false); err != nil {
+			c.errorf(ptr, "%v", err)
+			return nil
+		}
+		c.report.LeafPages += 1
+		c.report.Keys += int(leaf.nkv)
+		if c.leafDepth < 0 {
+			c.leafDepth = depth
+		} else if c.leafDepth != depth {
+			c.errorf(ptr, "leaf at depth %d, other leaves at depth %d", depth, c.leafDepth)
+		}
+		if leaf.nkv == 0 {
+			c.errorf(ptr, "empty leaf")
+			return nil
+		}
+		for i := range leaf.kv {
+			kv := &leaf.kv[i]
+			if i > 0 && compareKey(leaf.kv[i-1].key, kv.key) >= 0 {
+				c.errorf(ptr, "key %v after %v", kv.key, leaf.kv[i-1].key)
+			}
+			if !inBounds(kv.key) {
+				c.errorf(ptr, "key %v out of the range [%v, %v) of its parent", kv.key, lo, hi)
+			}
+			if kv.overflow_ptr != 0 {
+				c.checkOverflow(kv)
+			}
+		}
+		header.page_ptr = ptr
+		c.leaves = append(c.leaves, header)
+		return leaf.kv[0].key
+	}
+	// Step 2: Internal page, each key is the first key of its child
+	node := BTreeInternalPage{header: header}
+	if err := node.read_from_buffer(c.buffer, false); err != nil {
+		c.errorf(ptr, "%v", err)
+		return nil
+	}
+	c.report.InternalPages += 1
+	if node.nkey == 0 {
+		c.errorf(ptr, "empty internal page")
+		return nil
+	}
+	for i := 0; i < int(node.nkey); i++ {
+		key := node.keys[i].data
+		if i > 0 && compareKey(node.keys[i-1].data, key) >= 0 {
+			c.errorf(ptr, "key %v after %v", key, node.keys[i-1].data)
+		}
+		if !inBounds(key) {
+			c.errorf(ptr, "key %v out of the range [%v, %v) of its parent", key, lo, hi)
+		}
+		childHi := hi
+		if i+1 < int(node.nkey) {
+			childHi = node.keys[i+1].data
+		}
+		first := c.checkNode(node.children[i], key, childHi, depth+1)
+		if first != nil && compareKey(first, key) != 0 {
+			c.errorf(ptr, "key %v, first key of child %d is %v", key, node.children[i]/BLOCK_SIZE, first)
+		}
+	}
+	return node.keys[0].data
+}
+
+// The overflow chain of a value holds exactly overflow_len bytes.
+func (c *checker) checkOverflow(kv *KeyVal) {
+	var total uint64 = 0
+	ptr := kv.overflow_ptr
+	for ptr != 0 {
+		if !c.use(ptr, "overflow page") {
+			return
+		}
+		header, ok := c.read(ptr, 4)
+		if !ok {
+			return
+		}
+		oPage := OverflowPage{header: header}
+		if err := oPage.read_from_buffer(c.buffer, false); err != nil {
+			c.errorf(ptr, "%v", err)
+			return
+		}
+		c.report.OverflowPages += 1
+		total += uint64(oPage.nbyte)
+		ptr = header.next_page_pointer
+	}
+	if total != kv.overflow_len {
+		c.errorf(kv.overflow_ptr, "overflow chain of key %v holds %d bytes, expected %d", kv.key, total, kv.overflow_len)
+	}
+}
+
+// Each leaf links to the next one, the last one to nothing. Only for a tree
+// with PAGE_FLAG_LINKED, others have no links.
+func (c *checker) checkLeafChain() {
+	for i, leaf := range c.leaves {
+		var expected uint64 = 0
+		if i+1 < len(c.leaves) {
+			expected = c.leaves[i+1].page_ptr
+		}
+		if leaf.next_page_pointer != expected {
+			c.errorf(leaf.page_ptr, "leaf links to %d, next leaf is %d", leaf.next_page_pointer/BLOCK_SIZE, expected/BLOCK_SIZE)
+		}
+	}
+}
+
+// Follow the free list, each block is either used or free, never both. With
+// allocator, the free blocks are the ones it holds rather than the ones listed.
+func (c *checker) checkFreeList(metaPage MetaPage, allocator *FileAllocator) {
+	blocks := []uint64{}
+	ptr := metaPage.free_list_pointer
+	for ptr != 0 {
+		if !c.use(ptr, "free list page") {
+			break
+		}
+		header, ok := c.read(ptr, 3)
+		if !ok {
+			break
+		}
+		flPage := FreeListPage{header: header}
+		if err := flPage.read_from_buffer(c.buffer, false); err != nil {
+			c.errorf(ptr, "%v", err)
+			break
+		}
+		c.report.FreeListPages += 1
+		blocks = append(blocks, flPage.blocks[:flPage.nblock]...)
+		ptr = header.next_page_pointer
+	}
+	if allocator != nil {
+		blocks = append(slices.Clone(allocator.free_block), allocator.pending_block...)
+	}
+	// Free list pages are used too, check the blocks once the chain is known
+	free := make(map[uint64]bool)
+	for _, block := range blocks {
+		if block < META_SLOTS || block >= c.last_free {
+			c.errorf(0, "free block %d is not in [%d, %d)", block, META_SLOTS, c.last_free)
+		} else if free[block] {
+			c.errorf(block*BLOCK_SIZE, "free, listed twice")
+		} else if what, ok := c.used[block]; ok {
+			c.errorf(block*BLOCK_SIZE, "free, but used as %s", what)
+		}
+		free[block] = true
+	}
+	c.report.FreePages = len(free)
+	// Pages retired while readers are pinned are freed by a later commit,
+	// pages of the checkpointed tree by the next checkpoint
+	retired := make(map[uint64]bool)
+	for _, pages := range c.tree.reclaim.retired {
+		for _, ptr := range pages.ptrs {
+			retired[ptr/BLOCK_SIZE] = true
+		}
+	}
+	for _, ptr := range c.tree.reclaim.held {
+		retired[ptr/BLOCK_SIZE] = true
+	}
+	for block := uint64(META_SLOTS); block < c.last_free; block++ {
+		if _, ok := c.used[block]; !ok && !free[block] && !retired[block] {
+			c.errorf(block*BLOCK_SIZE, "leaked: neither used nor free")
+		}
+	}
+}
+
+// Check the last committed meta page, the tree and the free list it points to.
+// Damage is in the report, the error is for a tree that cannot be checked at
+// all: closed, or without a valid meta page.
+func (tree *BPTreeDisk) Check() (CheckReport, error) {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+	report := CheckReport{}
+	pager, err := tree.getPager()
+	if err != nil {
+		return report, err
+	}
+	metaPage, err := tree.loadMetaPage()
+	if err != nil {
+		return report, err
+	}
+	report.Generation = metaPage.generation
+	c := checker{
+		tree:      tree,
+		pager:     pager,
+		buffer:    new(bytes.Buffer),
+		report:    &report,
+		last_free: metaPage.last_free,
+		used:      make(map[uint64]string),
+		leafDepth: -1,
+	}
+	// Step 1: The commits since the checkpoint are only in the log and in
+	// memory, the allocator knows their blocks but not the meta page on disk
+	var allocator *FileAllocator
+	if tree.wal != nil && tree.wal.version > 0 {
+		allocator = pager.allocator()
+		c.last_free = allocator.last_free
+	}
+	// Step 1': The file has all blocks the meta page counts
+	if size, err := c.pager.Size(); err != nil {
+		c.errorf(0, "%v", err)
+	} else if size < c.last_free*BLOCK_SIZE {
+		c.errorf(0, "file has %d bytes, meta page counts %d blocks", size, c.last_free)
+		c.last_free = size / BLOCK_SIZE
+	}
+	// Step 2: Tree from the first internal page, empty tree has none
+	if metaPage.header.next_page_pointer != 0 {
+		c.checkNode(metaPage.header.next_page_pointer, nil, nil, 0)
+		report.Height = c.leafDepth + 1
+		if metaPage.header.flags&PAGE_FLAG_LINKED != 0 {
+			c.checkLeafChain()
+		}
+	}
+	// Step 3: Free list, and blocks that are in neither
+	c.checkFreeList(metaPage, allocator)
+	return report, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+func checkErrors(report CheckReport) string {
+	messages := []string{}
+	for _, issue := range report.Errors {
+		messages = append(messages, issue.String())
+	}
+	return strings.Join(messages, "\n")
+}
+
+func TestCheck(t *testing.T) {
+	maxNum := 500
+	test_db := newTestTree(t)
+	defer test_db.Close()
+	meta := must(test_db.LoadMetaPage())(t)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 3000; i++ {
+		key := intToSlice(int64(r.Intn(maxNum)))
+		if r.Intn(3) == 0 {
+			if newMeta, err := test_db.Del(meta, key); err == nil {
+				meta = newMeta
+			}
+		} else {
+			meta = must(test_db.Set(meta, key, randomBytes(r, 0, 2*BLOCK_SIZE)))(t)
+		}
+		if i%100 == 0 {
+			mustOK(t, test_db.WriteMetaPage(meta))
+		}
+	}
+	mustOK(t, test_db.WriteMetaPage(meta))
+
+	report := must(test_db.Check())(t)
+	if !report.OK() {
+		t.Fatalf("Errors on a valid tree:\n%s", checkErrors(report))
+	}
+	if report.Height < 2 || report.OverflowPages == 0 || report.FreePages == 0 {
+		t.Errorf("Report not expected: %+v", report)
+	}
+	keys := 0
+	seq, seqErr := test_db.All(meta)
+	for range seq {
+		keys += 1
+	}
+	mustOK(t, seqErr())
+	if report.Keys != keys {
+		t.Errorf("Expected %d keys, got %d", keys, report.Keys)
+	}
+
+	// A page both used and free
+	test_db.pager.allocator().free(meta.header.next_page_pointer)
+	mustOK(t, test_db.WriteMetaPage(meta))
+	if report := must(test_db.Check())(t); !strings.Contains(checkErrors(report), "free, but used as tree page") {
+		t.Errorf("Expected a used page on the free list, got:\n%s", checkErrors(report))
+	}
+}
+
+func TestCheck_Violations(t *testing.T) {
+	maxNum := 300
+	test_db := newTestTree(t)
+	defer test_db.Close()
+	meta := must(test_db.BulkLoad(sortedTestPairs(maxNum), 1))(t)
+	mustOK(t, test_db.WriteMetaPage(meta))
+	report := must(test_db.Check())(t)
+	if !report.OK() {
+		t.Fatalf("Bulk loaded tree:\n%s", checkErrors(report))
+	}
+
+	// A leaked page: written, never used
+	buffer := new(bytes.Buffer)
+	leaked := NewLPage()
+	leaked.write_to_buffer(buffer)
+	test_db.writeBufferToFile(buffer, test_db.pager)
+	mustOK(t, test_db.WriteMetaPage(meta))
+	if report := must(test_db.Check())(t); !strings.Contains(checkErrors(report), "leaked") {
+		t.Errorf("Expected a leaked page, got:\n%s", checkErrors(report))
+	}
+
+	// Change the first key of the second leaf in place: it no longer matches
+	// its key in the parent
+	root := must(test_db.readNode(meta.header.next_page_pointer, buffer, test_db.pager))(t).(*BTreeInternalPage)
+	leafPtr := root.children[1]
+	leaf := must(test_db.readNode(leafPtr, buffer, test_db.pager))(t).(*BTreeLeafPage)
+	leaf.kv[0].key = append(leaf.kv[0].key, 0)
+	buffer.Reset()
+	leaf.write_to_buffer(buffer)
+	mustOK(t, test_db.writeBufferToFileAtPtr(buffer, test_db.pager, leafPtr))
+	if report := must(test_db.Check())(t); !strings.Contains(checkErrors(report), "first key of child") {
+		t.Errorf("Expected a wrong key in the parent, got:\n%s", checkErrors(report))
+	}
+}
+
+func TestCheck_LeafChain(t *testing.T) {
+	test_db := newTestTree(t)
+	defer test_db.Close()
+	meta := must(test_db.BulkLoad(sortedTestPairs(300), 1))(t)
+	if meta.header.flags&PAGE_FLAG_LINKED == 0 {
+		t.Fatalf("Bulk loaded tree is not linked")
+	}
+	mustOK(t, test_db.WriteMetaPage(meta))
+
+	// A linked tree whose first leaf lost its link
+	buffer := new(bytes.Buffer)
+	root := must(test_db.readNode(meta.header.next_page_pointer, buffer, test_db.pager))(t).(*BTreeInternalPage)
+	leafPtr := root.children[0]
+	leaf := must(test_db.readNode(leafPtr, buffer, test_db.pager))(t).(*BTreeLeafPage)
+	leaf.header.next_page_pointer = 0
+	buffer.Reset()
+	leaf.write_to_buffer(buffer)
+	mustOK(t, test_db.writeBufferToFileAtPtr(buffer, test_db.pager, leafPtr))
+	if report := must(test_db.Check())(t); !strings.Contains(checkErrors(report), "leaf links to") {
+		t.Errorf("Expected a broken leaf chain, got:\n%s", checkErrors(report))
+	}
+
+	// Writes drop the links, the tree is fine without them
+	meta = must(test_db.Set(meta, intToSlice(150), []byte("changed")))(t)
+	meta = must(test_db.Del(meta, intToSlice(151)))(t)
+	if meta.header.flags&PAGE_FLAG_LINKED != 0 {
+		t.Fatalf("Tree is still linked after a write")
+	}
+	mustOK(t, test_db.WriteMetaPage(meta))
+	if report := must(test_db.Check())(t); !report.OK() {
+		t.Errorf("Written tree:\n%s", checkErrors(report))
+	}
+}
+
+func TestCLI_Fsck(t *testing.T) {
+	dbPath := testDBPath(t)
+	test_db := must(NewBPTreeDisk(dbPath))(t)
+	mustOK(t, test_db.WriteMetaPage(must(test_db.BulkLoad(sortedTestPairs(100), 1))(t)))
+	test_db.Close()
+	out := new(bytes.Buffer)
+	if code := runCommand([]string{"fsck", dbPath}, out, out); code != 0 {
+		t.Errorf("fsck: exit code %d, output:\n%s", code, out)
+	}
+	if code := runCommand([]string{"fsck"}, io.Discard, io.Discard); code == 0 {
+		t.Errorf("fsck without <db> should fail")
+	}
+
+	// A missing file is not created
+	missingPath := dbPath + ".none"
+	for _, args := range [][]string{{"fsck", missingPath}, {"stats", missingPath}, {"dump", missingPath},
+		{"backup", missingPath, dbPath + ".bak"}, {"compact", "-online", missingPath}} {
+		if code := runCommand(args, io.Discard, io.Discard); code == 0 {
+			t.Errorf("%s of a missing file should fail", args[0])
+		}
+		if _, err := os.Stat(missingPath); !os.IsNotExist(err) {
+			t.Fatalf("%s created the missing file", args[0])
+		}
+	}
+
+	// The log is left as it is, the last checkpoint is checked
+	test_db = must(OpenBPTreeDisk(dbPath))(t)
+	mustOK(t, test_db.EnableWAL(0))
+	walWrites(t, &test_db, rand.New(rand.NewSource(1)), map[string][]byte{}, 20)
+	test_db.Close()
+	log := must(os.ReadFile(dbPath + WAL_SUFFIX))(t)
+	out.Reset()
+	if code := runCommand([]string{"fsck", dbPath}, out, out); code != 0 || !strings.Contains(out.String(), "100 keys") {
+		t.Errorf("fsck with a log: exit code %d, output:\n%s", code, out)
+	}
+	if !bytes.Equal(must(os.ReadFile(dbPath+WAL_SUFFIX))(t), log) {
+		t.Errorf("fsck changed the log")
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ========================== Command line ==========================
+// mini_db_go <command> [flags] <args>, each command has its own flag set.
+// Commands only open a database that exists. Those that only read it (fsck,
+// stats, dump) see the last checkpoint and leave its log as it is. An
+// encrypted database needs its key, with -key or -key-file on any command.
+
+const cliUsage = `usage: mini_db_go <command> [flags] <args>
+
+commands:
+  backup [key flags] <db> <dst>
+  restore [key flags] <backup> <db>
+  compact [key flags] [-online] <db> [<dst>]
+  fsck [key flags] <db>
+  stats [key flags] [-json] <db>
+  dump [key flags] [-format dot|json] [-decode] <db>
+
+key flags, for an encrypted database:
+  -key <hex>       the key, 16, 24 or 32 bytes in hex
+  -key-file <path> a file holding the key as raw bytes
+`
+
+// Run a command, return the exit code. Results go to out, usage, errors and
+// fsck issues to errOut, so that out can be piped.
+func runCommand(args []string, out io.Writer, errOut io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(errOut, cliUsage)
+		return 2
+	}
+	var err error
+	switch args[0] {
+	case "backup":
+		err = runBackup(args[1:], out, errOut)
+	case "restore":
+		err = runRestore(args[1:], out, errOut)
+	case "compact":
+		err = runCompact(args[1:], out, errOut)
+	case "fsck":
+		err = runFsck(args[1:], out, errOut)
+	case "stats":
+		err = runStats(args[1:], out, errOut)
+	case "dump":
+		err = runDump(args[1:], out, errOut)
+	default:
+		fmt.Fprintf(errOut, "unknown command %q\n%s", args[0], cliUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(errOut, "error:", err)
+		return 1
+	}
+	return 0
+}
+
+// Flags for the encryption key, the same on every command.
+type keyFlags struct {
+	hexKey  *string
+	keyFile *string
+}
+
+func addKeyFlags(flags *flag.FlagSet) keyFlags {
+	return keyFlags{
+		hexKey:  flags.String("key", "", "encryption key of the database, in hex"),
+		keyFile: flags.String("key-file", "", "file holding the encryption key of the database"),
+	}
+}
+
+// The key given, nil if none: the database is not encrypted.
+func (k keyFlags) key() ([]byte, error) {
+	if *k.hexKey != "" && *k.keyFile != "" {
+		return nil, errors.New("use -key or -key-file, not both")
+	}
+	if *k.keyFile != "" {
+		return os.ReadFile(*k.keyFile)
+	}
+	if *k.hexKey != "" {
+		key, err := hex.DecodeString(*k.hexKey)
+		if err != nil {
+			return nil, fmt.Errorf("-key: %w", err)
+		}
+		return key, nil
+	}
+	return nil, nil
+}
+
+func runBackup(args []string, out io.Writer, errOut io.Writer) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	flags.SetOutput(errOut)
+	keyFlags := addKeyFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: backup [key flags] <db> <dst>")
+	}
+	key, err := keyFlags.key()
+	if err != nil {
+		return err
+	}
+	tree, err := OpenExistingBPTreeDisk(flags.Arg(0), key, true)
+	if err != nil {
+		return err
+	}
+	defer tree.Close()
+	if err := tree.BackupFile(flags.Arg(1)); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s: backup of %s\n", flags.Arg(1), flags.Arg(0))
+	return nil
+}
+
+func runRestore(args []string, out io.Writer, errOut io.Writer) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	flags.SetOutput(errOut)
+	keyFlags := addKeyFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: restore [key flags] <backup> <db>")
+	}
+	key, err := keyFlags.key()
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := RestoreBackup(file, flags.Arg(1), key); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s: restored from %s\n", flags.Arg(1), flags.Arg(0))
+	return nil
+}
+
+func runCompact(args []string, out io.Writer, errOut io.Writer) error {
+	flags := flag.NewFlagSet("compact", flag.ContinueOnError)
+	flags.SetOutput(errOut)
+	keyFlags := addKeyFlags(flags)
+	online := flags.Bool("online", false, "compact in place, swapping the file once done")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	// Step 1: Check arguments, online writes back to <db>
+	if *online && flags.NArg() != 1 || !*online && flags.NArg() != 2 {
+		return fmt.Errorf("usage: compact [key flags] [-online] <db> [<dst>]")
+	}
+	key, err := keyFlags.key()
+	if err != nil {
+		return err
+	}
+	tree, err := OpenExistingBPTreeDisk(flags.Arg(0), key, true)
+	if err != nil {
+		return err
+	}
+	defer tree.Close()
+	// Step 2: Compact, report the size before and after
+	before := tree.pager.allocator().last_free * BLOCK_SIZE
+	dst := flags.Arg(0)
+	if *online {
+		err = tree.CompactOnline()
+	} else {
+		dst = flags.Arg(1)
+		err = tree.Compact(dst)
+	}
+	if err != nil {
+		return err
+	}
+	compacted, err := OpenExistingBPTreeDisk(dst, key, false)
+	if err != nil {
+		return err
+	}
+	defer compacted.Close()
+	fmt.Fprintf(out, "%s: %d -> %d bytes\n", dst, before, compacted.pager.allocator().last_free*BLOCK_SIZE)
+	return nil
+}
+
+func runFsck(args []string, out io.Writer, errOut io.Writer) error {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	flags.SetOutput(errOut)
+	keyFlags := addKeyFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: fsck [key flags] <db>")
+	}
+	key, err := keyFlags.key()
+	if err != nil {
+		return err
+	}
+	// The log is not replayed: the last checkpoint is checked, as it is
+	tree, err := OpenExistingBPTreeDisk(flags.Arg(0), key, false)
+	if err != nil {
+		return err
+	}
+	defer tree.Close()
+	if _, err := os.Stat(flags.Arg(0) + WAL_SUFFIX); err == nil {
+		fmt.Fprintln(errOut, "log not replayed, checking the last checkpoint")
+	}
+	report, err := tree.Check()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "generation %d, height %d, %d keys\n", report.Generation, report.Height, report.Keys)
+	fmt.Fprintf(out, "pages: %d internal, %d leaf, %d overflow, %d free list, %d free\n",
+		report.InternalPages, report.LeafPages, report.OverflowPages, report.FreeListPages, report.FreePages)
+	for _, issue := range report.Errors {
+		fmt.Fprintln(errOut, "error:", issue)
+	}
+	if !report.OK() {
+		return fmt.Errorf("%d errors", len(report.Errors))
+	}
+	fmt.Fprintln(out, "ok")
+	return nil
+}
+
+func runStats(args []string, out io.Writer, errOut io.Writer) error {
+	flags := flag.NewFlagSet("stats", flag.ContinueOnError)
+	flags.SetOutput(errOut)
+	keyFlags := addKeyFlags(flags)
+	asJSON := flags.Bool("json", false, "print the stats as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: stats [key flags] [-json] <db>")
+	}
+	key, err := keyFlags.key()
+	if err != nil {
+		return err
+	}
+	tree, err := OpenExistingBPTreeDisk(flags.Arg(0), key, false)
+	if err != nil {
+		return err
+	}
+	defer tree.Close()
+	metaPage, err := tree.LoadMetaPage()
+	if err != nil {
+		return err
+	}
+	stats, err := tree.Stats(metaPage)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(stats)
+	}
+	fmt.Fprintf(out, "generation %d, height %d, %d keys: %d key bytes, %d value bytes\n",
+		stats.Generation, stats.Height, stats.Keys, stats.KeyBytes, stats.ValueBytes)
+	fmt.Fprintf(out, "pages: %d internal, %d leaf, %d overflow, %d free list, %d free\n",
+		stats.InternalPages, stats.LeafPages, stats.OverflowPages, stats.FreeListPages, stats.FreePages)
+	for i, level := range stats.Levels {
+		fmt.Fprintf(out, "level %d: %d pages, %d keys, %.0f%% full\n", i, level.Pages, level.Keys, level.AvgFill*100)
+	}
+	fmt.Fprintf(out, "file: %d bytes, %.0f%% fragmented\n", stats.FileSize, stats.Fragmentation*100)
+	return nil
+}
+
+func runDump(args []string, out io.Writer, errOut io.Writer) error {
+	flags := flag.NewFlagSet("dump", flag.ContinueOnError)
+	flags.SetOutput(errOut)
+	keyFlags := addKeyFlags(flags)
+	format := flags.String("format", "dot", "output format: dot or json")
+	decode := flags.Bool("decode", false, "show keys as encodeKey tuples")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 || *format != "dot" && *format != "json" {
+		return fmt.Errorf("usage: dump [key flags] [-format dot|json] [-decode] <db>")
+	}
+	key, err := keyFlags.key()
+	if err != nil {
+		return err
+	}
+	tree, err := OpenExistingBPTreeDisk(flags.Arg(0), key, false)
+	if err != nil {
+		return err
+	}
+	defer tree.Close()
+	metaPage, err := tree.LoadMetaPage()
+	if err != nil {
+		return err
+	}
+	dump, err := tree.Dump(metaPage, *decode)
+	if err != nil {
+		return err
+	}
+	if *format == "json" {
+		return dump.WriteJSON(out)
+	}
+	return dump.WriteDOT(out)
+}
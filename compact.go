@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ========================== Compaction ==========================
+// The live tree of the committed meta page is rewritten into a new file with
+// BulkLoad: pages are full, in key order, and the file has no free pages.
+
+// Rewrite the committed tree densely into a new file dst. The new file has
+// the same page size: BLOCK_SIZE is fixed when building, so compaction cannot
+// change it.
+func (tree *BPTreeDisk) Compact(dst string) error {
+	if sameFile(tree.fileName, dst) {
+		return fmt.Errorf("compact %s: destination is the database file", dst)
+	}
+	// Step 1: Keep the snapshot readable while copying
+	epoch := tree.Pin()
+	defer tree.Unpin(epoch)
+	metaPage, err := tree.LoadMetaPage()
+	if err != nil {
+		return err
+	}
+	// Step 2: Copy it to the new file, encrypted with the same key
+	dstTree, err := NewBPTreeDisk(dst)
+	if err != nil {
+		return err
+	}
+	defer dstTree.Close()
+	if err := dstTree.encryptNewTree(tree.key()); err != nil {
+		return err
+	}
+	if err := copyTree(&dstTree, tree, metaPage); err != nil {
+		return err
+	}
+	return dstTree.Close()
+}
+
+// Bulk load the tree of metaPage into dst and commit it. dst compresses its
+// leaves the same way as tree.
+func copyTree(dst *BPTreeDisk, tree *BPTreeDisk, metaPage MetaPage) error {
+	dst.compression = tree.compression
+	seq, seqErr := tree.All(metaPage)
+	dstMeta, err := dst.BulkLoad(seq, 1)
+	if err == nil {
+		err = seqErr()
+	}
+	if err != nil {
+		return err
+	}
+	return dst.WriteMetaPage(dstMeta)
+}
+
+func sameFile(lhs string, rhs string) bool {
+	lhsInfo, err := os.Stat(lhs)
+	if err != nil {
+		return false
+	}
+	rhsInfo, err := os.Stat(rhs)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(lhsInfo, rhsInfo)
+}
+
+// Online compaction: the tree is copied to a sibling file while it is still
+// being written, then the sibling catches up with the commits made since the
+// copy, and replaces the database file.
+type Compaction struct {
+	tree    *BPTreeDisk
+	dst     BPTreeDisk
+	dstPath string
+	key     []byte   // Of the sibling file
+	copied  MetaPage // Source meta page the sibling file has the content of
+	epoch   uint64   // Pin on copied, so that it can be compared later
+	pinned  bool     // Until the last catch up, or Abort
+	done    bool     // Finished or aborted
+}
+
+// Copy the committed tree to a sibling file, writes can go on after this.
+func (tree *BPTreeDisk) StartCompaction() (*Compaction, error) {
+	return tree.startCompaction(tree.fileName+".compact", tree.key())
+}
+
+// Same as StartCompaction, the sibling file at dstPath is encrypted with key.
+func (tree *BPTreeDisk) startCompaction(dstPath string, key []byte) (*Compaction, error) {
+	if tree.fileName == "" {
+		return nil, errors.New("compaction: the tree is not in a database file")
+	}
+	c := &Compaction{
+		tree:    tree,
+		dstPath: dstPath,
+		key:     key,
+	}
+	var err error
+	c.epoch = tree.Pin()
+	c.pinned = true
+	if c.copied, err = tree.LoadMetaPage(); err != nil {
+		c.unpin()
+		return nil, err
+	}
+	if c.dst, err = NewBPTreeDisk(c.dstPath); err != nil {
+		c.unpin()
+		return nil, err
+	}
+	if err := c.dst.encryptNewTree(key); err != nil {
+		c.Abort()
+		return nil, err
+	}
+	if err := copyTree(&c.dst, tree, c.copied); err != nil {
+		c.Abort()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Apply to the sibling file the changes committed since the last copy. Pairs
+// of both trees are compared in order, values in overflow pages are compared
+// by pointer first. Writers wait until it is done, readers do not.
+func (c *Compaction) CatchUp() error {
+	c.tree.mu.RLock()
+	defer c.tree.mu.RUnlock()
+	return c.catchUp()
+}
+
+// The caller holds tree.mu: nothing is committed between loading the meta
+// page and pinning it.
+func (c *Compaction) catchUp() error {
+	metaPage, err := c.tree.loadMetaPage()
+	// In WAL mode, commits to the log change the version only
+	if err != nil || (metaPage.generation == c.copied.generation && metaPage.version == c.copied.version) {
+		return err
+	}
+	epoch := c.tree.reclaim.pin()
+	if err := c.copyChanges(metaPage); err != nil {
+		c.tree.reclaim.unpin(epoch)
+		return err
+	}
+	// Move the pin forward to the new copy
+	c.tree.reclaim.unpin(c.epoch)
+	c.epoch = epoch
+	c.copied = metaPage
+	return nil
+}
+
+func (c *Compaction) copyChanges(metaPage MetaPage) error {
+	oldIter, err := c.tree.seekEnd(c.copied, false)
+	if err != nil {
+		return err
+	}
+	defer oldIter.close()
+	newIter, err := c.tree.seekEnd(metaPage, false)
+	if err != nil {
+		return err
+	}
+	defer newIter.close()
+	dstMeta, err := c.dst.LoadMetaPage()
+	if err != nil {
+		return err
+	}
+	for oldIter.Valid() || newIter.Valid() {
+		cmp := 0
+		if !oldIter.Valid() {
+			cmp = 1
+		} else if !newIter.Valid() {
+			cmp = -1
+		} else {
+			cmp = compareKey(oldIter.current().key, newIter.current().key)
+		}
+		if cmp < 0 {
+			// Only in the old tree: deleted
+			if dstMeta, err = c.dst.Del(dstMeta, oldIter.current().key); err != nil {
+				return err
+			}
+			oldIter.next()
+			continue
+		}
+		if cmp > 0 || !sameValue(oldIter.current(), newIter.current()) {
+			// Only in the new tree, or changed
+			kv, err := newIter.deref()
+			if err != nil {
+				return err
+			}
+			if dstMeta, err = c.dst.Set(dstMeta, kv.key, kv.val); err != nil {
+				return err
+			}
+		}
+		if cmp == 0 {
+			oldIter.next()
+		}
+		newIter.next()
+	}
+	if err := errors.Join(oldIter.Err(), newIter.Err()); err != nil {
+		return err
+	}
+	return c.dst.WriteMetaPage(dstMeta)
+}
+
+// Values stored the same way: inline and equal, or in the same overflow chain.
+func sameValue(lhs *KeyVal, rhs *KeyVal) bool {
+	if lhs.overflow_ptr != 0 || rhs.overflow_ptr != 0 {
+		return lhs.overflow_ptr == rhs.overflow_ptr
+	}
+	return bytes.Equal(lhs.val, rhs.val)
+}
+
+// Catch up one last time and swap the sibling file in place of the database
+// file. Writes wait from the last catch up until the tree is open on the new
+// file, so that no commit is lost in the swap. Meta pages and iterators from
+// before cannot be used after this: load the meta page again. If it fails,
+// the tree is still on the old file, in WAL mode if it was.
+func (c *Compaction) Finish() error {
+	// Step 1: Catch up while writers go on, so that the last one is short
+	if err := c.CatchUp(); err != nil {
+		c.Abort()
+		return err
+	}
+	// Step 2: Last catch up, nothing is committed from here to the swap and
+	// no reader may still use the old file
+	tree := c.tree
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+	err := c.catchUp()
+	c.unpin()
+	if err != nil {
+		c.Abort()
+		return err
+	}
+	if tree.reclaim.pinned() > 0 {
+		c.Abort()
+		return errors.New("compaction: readers still open on the old file")
+	}
+	// Step 3: The log belongs to the old file: checkpoint it and start again
+	// after the swap
+	var walSize int64 = -1
+	restoreWAL := func() error {
+		if walSize < 0 {
+			return nil
+		}
+		return tree.enableWAL(walSize)
+	}
+	if tree.wal != nil {
+		walSize = tree.wal.checkpoint_size
+		if err := tree.disableWAL(); err != nil {
+			c.Abort()
+			return errors.Join(err, restoreWAL())
+		}
+	}
+	// Step 4: The sibling file is complete and durable
+	if err := c.dst.Close(); err != nil {
+		c.Abort()
+		return errors.Join(err, restoreWAL())
+	}
+	// Step 5: Atomic swap, then reopen the tree on the new file, or on the
+	// old one if the swap failed
+	fileName := tree.fileName
+	capacity := tree.cache.capacity
+	useMmap := tree.mmapEnabled()
+	oldKey := tree.key()
+	if err := tree.close(); err != nil {
+		c.Abort()
+		return errors.Join(err, tree.reopen(fileName, oldKey, capacity, useMmap, walSize))
+	}
+	if err := os.Rename(c.dstPath, fileName); err != nil {
+		c.Abort()
+		return errors.Join(err, tree.reopen(fileName, oldKey, capacity, useMmap, walSize))
+	}
+	syncDir(filepath.Dir(fileName))
+	c.done = true
+	return tree.reopen(fileName, c.key, capacity, useMmap, walSize)
+}
+
+// Open fileName in place of the closed tree, with the same cache size, mmap
+// and WAL mode (walSize < 0: not in WAL mode). The caller holds tree.mu, the
+// reopened tree keeps it: goroutines waiting for the closed tree go on with
+// the reopened one.
+func (tree *BPTreeDisk) reopen(fileName string, key []byte, capacity int, useMmap bool, walSize int64) error {
+	reopened, err := OpenBPTreeDiskWithKey(fileName, key)
+	if err != nil {
+		return err
+	}
+	reopened.mu = tree.mu
+	*tree = reopened
+	tree.SetCacheSize(capacity)
+	if walSize >= 0 {
+		if err := tree.enableWAL(walSize); err != nil {
+			return err
+		}
+	}
+	if useMmap {
+		return tree.enableMmap()
+	}
+	return nil
+}
+
+// Stop the compaction, unpin the copied tree and remove the sibling file.
+// Nothing to do once finished or aborted.
+func (c *Compaction) Abort() {
+	if c.done {
+		return
+	}
+	c.done = true
+	c.unpin()
+	c.dst.Close()
+	os.Remove(c.dstPath)
+}
+
+// Release the pin on copied, once. Only the reclaimer is locked: Finish holds
+// tree.mu when it unpins.
+func (c *Compaction) unpin() {
+	if c.pinned {
+		c.pinned = false
+		c.tree.reclaim.unpin(c.epoch)
+	}
+}
+
+// Make a rename durable, not every platform can sync a directory.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// Compact the database file in place, see StartCompaction.
+func (tree *BPTreeDisk) CompactOnline() error {
+	c, err := tree.StartCompaction()
+	if err != nil {
+		return err
+	}
+	return c.Finish()
+}
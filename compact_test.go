@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Fill a tree, then delete most of it without committing in between, so the
+// file keeps all the pages it grew to.
+func fragmentedTestTree(t *testing.T, maxNum int) (BPTreeDisk, MetaPage) {
+	test_db := must(NewBPTreeDisk(testDBPath(t)))(t)
+	meta := must(test_db.LoadMetaPage())(t)
+	for i := 1; i <= maxNum; i++ {
+		meta = must(test_db.Insert(meta, intToSlice(int64(i)), bytes.Repeat(intToSlice(int64(i)), 20)))(t)
+	}
+	for i := 1; i <= maxNum; i++ {
+		if i%10 != 0 {
+			meta = must(test_db.Del(meta, intToSlice(int64(i))))(t)
+		}
+	}
+	mustOK(t, test_db.WriteMetaPage(meta))
+	return test_db, meta
+}
+
+func checkTestKeys(t *testing.T, tree *BPTreeDisk, meta MetaPage, maxNum int, step int) {
+	count := 0
+	seq, seqErr := tree.All(meta)
+	for key, val := range seq {
+		count += 1
+		expected := intToSlice(int64(count * step))
+		if !bytes.Equal(key, expected) || !bytes.Equal(val, bytes.Repeat(expected, 20)) {
+			t.Fatalf("Key %v not expected, want %v", key, expected)
+		}
+	}
+	mustOK(t, seqErr())
+	if count != maxNum/step {
+		t.Errorf("Expected %d keys, got %d", maxNum/step, count)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	maxNum := 1500
+	test_db, _ := fragmentedTestTree(t, maxNum)
+	defer test_db.Close()
+	compactPath := filepath.Join(t.TempDir(), "test_compact.db")
+
+	if err := test_db.Compact(compactPath); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if err := test_db.Compact(test_db.fileName); err == nil {
+		t.Errorf("Compact onto the database file should fail")
+	}
+
+	compacted, err := OpenBPTreeDisk(compactPath)
+	if err != nil {
+		t.Fatalf("Open compacted failed: %v", err)
+	}
+	defer compacted.Close()
+	if compacted.pager.allocator().last_free*4 > test_db.pager.allocator().last_free {
+		t.Errorf("Expected a much smaller file, %v -> %v blocks", test_db.pager.allocator().last_free, compacted.pager.allocator().last_free)
+	}
+	checkTestKeys(t, &compacted, must(compacted.LoadMetaPage())(t), maxNum, 10)
+}
+
+func TestCompact_Online(t *testing.T) {
+	maxNum := 1500
+	test_db, meta := fragmentedTestTree(t, maxNum)
+	defer test_db.Close()
+	lastFree := test_db.pager.allocator().last_free
+
+	c, err := test_db.StartCompaction()
+	if err != nil {
+		t.Fatalf("StartCompaction failed: %v", err)
+	}
+	// Writes after the copy: updates, deletes and inserts
+	for i := 10; i <= maxNum; i += 10 {
+		meta = must(test_db.Set(meta, intToSlice(int64(i)), bytes.Repeat(intToSlice(int64(i)), 20)))(t)
+	}
+	mustOK(t, test_db.WriteMetaPage(meta))
+	c.CatchUp()
+	for i := 10; i <= maxNum; i += 10 {
+		if i%20 != 0 {
+			meta = must(test_db.Del(meta, intToSlice(int64(i))))(t)
+		}
+	}
+	for i := 1; i <= maxNum; i++ {
+		if i%20 == 0 {
+			meta = must(test_db.Set(meta, intToSlice(int64(i)), bytes.Repeat(intToSlice(int64(i)), 20)))(t)
+		}
+	}
+	mustOK(t, test_db.WriteMetaPage(meta))
+
+	// A reader still open keeps the old file
+	it := must(test_db.SeekFirst(meta))(t)
+	if err := c.Finish(); err == nil {
+		t.Fatalf("Finish with an open reader should fail")
+	}
+	it.Close()
+
+	if err := test_db.CompactOnline(); err != nil {
+		t.Fatalf("CompactOnline failed: %v", err)
+	}
+	if test_db.pager.allocator().last_free*4 > lastFree {
+		t.Errorf("Expected a much smaller file, %v -> %v blocks", lastFree, test_db.pager.allocator().last_free)
+	}
+	if _, err := os.Stat(test_db.fileName + ".compact"); !os.IsNotExist(err) {
+		t.Errorf("Sibling file should be gone")
+	}
+	checkTestKeys(t, &test_db, must(test_db.LoadMetaPage())(t), maxNum, 20)
+}
+
+func TestCompact_CatchUp(t *testing.T) {
+	maxNum := 1500
+	test_db, meta := fragmentedTestTree(t, maxNum)
+	defer test_db.Close()
+
+	c, err := test_db.StartCompaction()
+	if err != nil {
+		t.Fatalf("StartCompaction failed: %v", err)
+	}
+	for i := 10; i <= maxNum; i += 10 {
+		if i%20 != 0 {
+			meta = must(test_db.Del(meta, intToSlice(int64(i))))(t)
+		}
+	}
+	mustOK(t, test_db.WriteMetaPage(meta))
+	if err := c.Finish(); err != nil {
+		t.Fatalf("Finish failed: %v", err)
+	}
+	checkTestKeys(t, &test_db, must(test_db.LoadMetaPage())(t), maxNum, 20)
+}
+
+func TestCompact_Abort(t *testing.T) {
+	maxNum := 1000
+	test_db, meta := fragmentedTestTree(t, maxNum)
+	defer test_db.Close()
+	c := must(test_db.StartCompaction())(t)
+	// Pages retired while the compaction is pinned are kept
+	for i := 1; i <= maxNum; i += 2 {
+		meta = must(test_db.Set(meta, intToSlice(int64(i)), intToSlice(int64(-i))))(t)
+	}
+	mustOK(t, test_db.WriteMetaPage(meta))
+	if len(test_db.reclaim.retired) == 0 {
+		t.Fatalf("Expected pages retired while the compaction is pinned")
+	}
+	c.Abort()
+	c.Abort()
+	if _, err := os.Stat(c.dstPath); !os.IsNotExist(err) {
+		t.Errorf("Expected no sibling file after Abort, got %v", err)
+	}
+	if n := test_db.reclaim.pinned(); n != 0 {
+		t.Errorf("Expected no reader pinned after Abort, got %d", n)
+	}
+	// The next commit frees them
+	free := must(test_db.Check())(t).FreePages
+	mustOK(t, test_db.WriteMetaPage(meta))
+	if len(test_db.reclaim.retired) != 0 {
+		t.Errorf("Expected the retired pages freed after Abort, %d commits still hold some", len(test_db.reclaim.retired))
+	}
+	report := must(test_db.Check())(t)
+	if !report.OK() || report.FreePages <= free {
+		t.Errorf("Expected more than %d free pages, got %d, errors:\n%s", free, report.FreePages, checkErrors(report))
+	}
+}
+
+func TestCLI_Compact(t *testing.T) {
+	test_db, _ := fragmentedTestTree(t, 1000)
+	test_db.Close()
+	dbPath := test_db.fileName
+	compactPath := filepath.Join(t.TempDir(), "test_compact.db")
+
+	if code := runCommand([]string{"compact", dbPath, compactPath}, io.Discard, io.Discard); code != 0 {
+		t.Errorf("compact: exit code %d", code)
+	}
+	if code := runCommand([]string{"compact", "-online", dbPath}, io.Discard, io.Discard); code != 0 {
+		t.Errorf("compact -online: exit code %d", code)
+	}
+	if code := runCommand([]string{"compact", dbPath}, io.Discard, io.Discard); code == 0 {
+		t.Errorf("compact without <dst> should fail")
+	}
+	// Pages are BLOCK_SIZE, there is no page size to choose
+	errOut := new(strings.Builder)
+	if code := runCommand([]string{"compact", "-page-size", "8192", dbPath, compactPath}, io.Discard, errOut); code == 0 || !strings.Contains(errOut.String(), "-page-size") {
+		t.Errorf("compact -page-size should fail naming the flag, got %d, %q", code, errOut.String())
+	}
+	if code := runCommand([]string{"nope"}, io.Discard, io.Discard); code == 0 {
+		t.Errorf("Unknown command should fail")
+	}
+}
+
+func TestCompact_FinishFails(t *testing.T) {
+	maxNum := 1000
+	test_db, meta := fragmentedTestTree(t, maxNum)
+	defer test_db.Close()
+	mustOK(t, test_db.EnableWAL(0))
+	deleteOdd := func(meta MetaPage) MetaPage {
+		for i := 10; i <= maxNum; i += 20 {
+			if _, err := test_db.Find(meta, intToSlice(int64(i))); err == nil {
+				meta = must(test_db.Del(meta, intToSlice(int64(i))))(t)
+			}
+		}
+		mustOK(t, test_db.WriteMetaPage(meta))
+		return meta
+	}
+
+	// Catch up fails: the sibling file is closed
+	c := must(test_db.StartCompaction())(t)
+	meta = deleteOdd(meta)
+	c.dst.Close()
+	if err := c.Finish(); err == nil {
+		t.Fatalf("Finish with a closed sibling file should fail")
+	}
+	if test_db.wal == nil {
+		t.Errorf("Expected WAL mode after a failed Finish")
+	}
+	checkTestKeys(t, &test_db, must(test_db.LoadMetaPage())(t), maxNum, 20)
+
+	// Swap fails: the sibling file is gone, the tree goes on with the old file
+	c = must(test_db.StartCompaction())(t)
+	mustOK(t, os.Remove(c.dstPath))
+	if err := c.Finish(); err == nil {
+		t.Fatalf("Finish without the sibling file should fail")
+	}
+	if test_db.wal == nil {
+		t.Errorf("Expected WAL mode after a failed Finish")
+	}
+	checkTestKeys(t, &test_db, must(test_db.LoadMetaPage())(t), maxNum, 20)
+	meta = must(test_db.LoadMetaPage())(t)
+	mustOK(t, test_db.WriteMetaPage(must(test_db.Del(meta, intToSlice(20)))(t)))
+	mustOK(t, test_db.CompactOnline())
+	if _, err := test_db.Find(must(test_db.LoadMetaPage())(t), intToSlice(20)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected key 20 deleted, got %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// How leaf pages of a database are written, recorded in the meta page.
+const (
+	COMPRESSION_NONE  = 0
+	COMPRESSION_FLATE = 1
+)
+
+// Set in PageHeader.flags of a page written compressed
+const PAGE_FLAG_COMPRESSED = 1
+
+// A compressed leaf may hold more than PAGE_SIZE bytes, as long as it fits in
+// a page once compressed. Cell offsets are uint16, and a page can be
+// decompressed without reading more than this.
+const MAX_LEAF_SIZE = 4 * BLOCK_SIZE
+
+// Each compressed page is:
+// - Header, with PAGE_FLAG_COMPRESSED
+// - size (2): bytes after the header before compression
+// - deflate stream of those bytes
+// [header | size | deflate ... | 0 0 0 0 ... ]
+
+// flate.NewWriter takes hundreds of KB, keep them around
+var flateWriters = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+// Compressed form of a page, nil if it is not smaller.
+func compressPage(page []byte) []byte {
+	if len(page) > MAX_LEAF_SIZE {
+		return nil
+	}
+	out := bytes.NewBuffer(make([]byte, 0, BLOCK_SIZE))
+	out.Write(page[:PAGE_HEADER_SIZE])
+	if err := binaryWrite(out, uint16(len(page)-PAGE_HEADER_SIZE)); err != nil {
+		return nil
+	}
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(out)
+	if _, err := w.Write(page[PAGE_HEADER_SIZE:]); err != nil {
+		return nil
+	}
+	if err := w.Close(); err != nil {
+		return nil
+	}
+	if out.Len() >= len(page) {
+		return nil
+	}
+	compressed := out.Bytes()
+	compressed[FLAGS_OFFSET] |= PAGE_FLAG_COMPRESSED
+	return compressed
+}
+
+// Page as written by write_to_buffer from the compressed block read at ptr.
+// The block has passed verifyBlock, so a page that does not decompress is
+// corrupt.
+func decompressPage(block []byte, ptr uint64) ([]byte, error) {
+	size := int(binary.BigEndian.Uint16(block[PAGE_HEADER_SIZE:]))
+	if PAGE_HEADER_SIZE+size > MAX_LEAF_SIZE {
+		return nil, &ErrCorruptPage{Ptr: ptr, PageType: block[0], Reason: fmt.Sprintf("compressed page of %d bytes", size)}
+	}
+	page := make([]byte, PAGE_HEADER_SIZE+size)
+	copy(page, block[:PAGE_HEADER_SIZE])
+	r := flate.NewReader(bytes.NewReader(block[PAGE_HEADER_SIZE+2:]))
+	defer r.Close()
+	if _, err := io.ReadFull(r, page[PAGE_HEADER_SIZE:]); err != nil {
+		return nil, &ErrCorruptPage{Ptr: ptr, PageType: block[0], Reason: fmt.Sprintf("cannot decompress: %v", err)}
+	}
+	return page, nil
+}
+
+// Leaf page in buffer as it goes to its block: compressed if the database
+// compresses and that makes it smaller, as it is otherwise. The flag read
+// with the page is set again for the page written.
+func (tree *BPTreeDisk) encodeLeaf(buffer *bytes.Buffer) []byte {
+	return encodeLeafPage(buffer, tree.compression)
+}
+
+// Same as encodeLeaf, with the compression of another database
+func encodeLeafPage(buffer *bytes.Buffer, compression uint8) []byte {
+	page := buffer.Bytes()
+	page[FLAGS_OFFSET] &^= PAGE_FLAG_COMPRESSED
+	if compression == COMPRESSION_NONE {
+		return page
+	}
+	if compressed := compressPage(page); compressed != nil {
+		return compressed
+	}
+	return page
+}
+
+// Whether a leaf bigger than limit takes at most limit bytes once compressed.
+func (tree *BPTreeDisk) fitsCompressed(leaf *BTreeLeafPage, limit int) bool {
+	if tree.compression == COMPRESSION_NONE || leaf.size() > MAX_LEAF_SIZE {
+		return false
+	}
+	buffer := new(bytes.Buffer)
+	if err := leaf.write_to_buffer(buffer); err != nil {
+		return false
+	}
+	compressed := compressPage(buffer.Bytes())
+	return compressed != nil && len(compressed) <= limit
+}
+
+// Compress the leaf pages written from now on, COMPRESSION_NONE to stop.
+// Pages written before are read as they are. The choice is kept in the meta
+// page from the next WriteMetaPage.
+func (tree *BPTreeDisk) SetCompression(compression uint8) error {
+	if compression > COMPRESSION_FLATE {
+		return fmt.Errorf("unknown compression %d", compression)
+	}
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+	tree.compression = compression
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// Repetitive text, like the values we store
+func textValue(i int) []byte {
+	return []byte(fmt.Sprintf("user %d logged in from the office, status: active, plan: free; ", i%7) + "notes: nothing to report")
+}
+
+func TestCompression(t *testing.T) {
+	maxNum := 2000
+	trees := map[uint8]*BPTreeDisk{}
+	leaves := map[uint8]int{}
+	for _, compression := range []uint8{COMPRESSION_NONE, COMPRESSION_FLATE} {
+		dbPath := testDBPath(t) + fmt.Sprint(compression)
+		test_db := must(NewBPTreeDisk(dbPath))(t)
+		mustOK(t, test_db.SetCompression(compression))
+		meta := must(test_db.LoadMetaPage())(t)
+		for _, i := range rand.Perm(maxNum) {
+			meta = must(test_db.Insert(meta, intToSlice(int64(i)), textValue(i)))(t)
+		}
+		mustOK(t, test_db.WriteMetaPage(meta))
+		leaves[compression] = must(test_db.Check())(t).LeafPages
+		test_db.Close()
+
+		// The option is kept in the meta page
+		test_db = must(OpenBPTreeDisk(dbPath))(t)
+		defer test_db.Close()
+		if test_db.compression != compression {
+			t.Errorf("Expected compression %d after reopen, got %d", compression, test_db.compression)
+		}
+		meta = must(test_db.LoadMetaPage())(t)
+		for i := 0; i < maxNum; i++ {
+			kv, err := test_db.Find(meta, intToSlice(int64(i)))
+			if err != nil || !bytes.Equal(kv.val, textValue(i)) {
+				t.Fatalf("compression %d: Find key = %d failed: %v", compression, i, err)
+			}
+		}
+		// Delete most keys, compressed leaves get merged
+		for i := 0; i < maxNum; i++ {
+			if i%5 != 0 {
+				meta = must(test_db.Del(meta, intToSlice(int64(i))))(t)
+			}
+		}
+		mustOK(t, test_db.WriteMetaPage(meta))
+		if report := must(test_db.Check())(t); !report.OK() || report.Keys != maxNum/5 {
+			t.Errorf("compression %d: %d keys, errors:\n%s", compression, report.Keys, checkErrors(report))
+		}
+		trees[compression] = &test_db
+	}
+
+	if leaves[COMPRESSION_FLATE]*2 > leaves[COMPRESSION_NONE] {
+		t.Errorf("Expected less than half the leaves with compression, got %d and %d", leaves[COMPRESSION_FLATE], leaves[COMPRESSION_NONE])
+	}
+	tree := trees[COMPRESSION_FLATE]
+	dump := must(tree.Dump(must(tree.LoadMetaPage())(t), false))(t)
+	for _, page := range dump.Pages {
+		if page.Type == "leaf" && !page.Compressed {
+			t.Errorf("Leaf not compressed: %+v", page)
+		}
+		if page.Type == "internal" && page.Compressed {
+			t.Errorf("Only leaves are compressed: %+v", page)
+		}
+	}
+}
+
+func TestCompression_Mixed(t *testing.T) {
+	maxNum := 1000
+	test_db := newTestTree(t)
+	defer test_db.Close()
+	meta := must(test_db.BulkLoad(sortedTestPairs(maxNum), 1))(t)
+	mustOK(t, test_db.WriteMetaPage(meta))
+	before := must(test_db.Check())(t).LeafPages
+
+	// Pages written before stay readable, new ones get compressed
+	if err := test_db.SetCompression(7); err == nil {
+		t.Errorf("Expected an error for an unknown compression")
+	}
+	mustOK(t, test_db.SetCompression(COMPRESSION_FLATE))
+	expected := map[string][]byte{}
+	for key, val := range sortedTestPairs(maxNum) {
+		expected[string(key)] = val
+	}
+	for i := 1; i <= maxNum; i += 10 {
+		meta = must(test_db.Set(meta, intToSlice(int64(i)), textValue(i)))(t)
+		expected[string(intToSlice(int64(i)))] = textValue(i)
+	}
+	mustOK(t, test_db.WriteMetaPage(meta))
+	content := must(treeContent(&test_db, meta))(t)
+	if !maps.EqualFunc(content, expected, bytes.Equal) {
+		t.Errorf("Content not expected after writing compressed pages over plain ones")
+	}
+	if report := must(test_db.Check())(t); !report.OK() {
+		t.Errorf("Errors in a mixed tree:\n%s", checkErrors(report))
+	}
+
+	// Bulk load packs leaves by their compressed size, compaction keeps it
+	compacted := newTestTree(t)
+	defer compacted.Close()
+	mustOK(t, copyTree(&compacted, &test_db, meta))
+	if compacted.compression != COMPRESSION_FLATE {
+		t.Errorf("Compression not copied")
+	}
+	if after := must(compacted.Check())(t).LeafPages; after >= before {
+		t.Errorf("Expected fewer leaves after a compressed bulk load, got %d, was %d", after, before)
+	}
+	content = must(treeContent(&compacted, must(compacted.LoadMetaPage())(t)))(t)
+	if !maps.EqualFunc(content, expected, bytes.Equal) {
+		t.Errorf("Content not expected after compaction")
+	}
+}
+
+func TestCompression_Off(t *testing.T) {
+	maxNum := 300
+	value := func(i int) []byte {
+		return bytes.Repeat(textValue(i), 10)[:700]
+	}
+	test_db := newTestTree(t)
+	defer test_db.Close()
+	mustOK(t, test_db.SetCompression(COMPRESSION_FLATE))
+	meta := must(test_db.LoadMetaPage())(t)
+	expected := map[string][]byte{}
+	for i := 0; i < maxNum; i++ {
+		meta = must(test_db.Insert(meta, intToSlice(int64(i)), value(i)))(t)
+		expected[string(intToSlice(int64(i)))] = value(i)
+	}
+	mustOK(t, test_db.WriteMetaPage(meta))
+
+	// Leaves that held many values compressed are split into many pages
+	mustOK(t, test_db.SetCompression(COMPRESSION_NONE))
+	for _, i := range []int{188, 0, maxNum - 1, 100} {
+		meta = must(test_db.Set(meta, intToSlice(int64(i)), value(i+1)))(t)
+		expected[string(intToSlice(int64(i)))] = value(i + 1)
+	}
+	mustOK(t, test_db.WriteMetaPage(meta))
+	content := must(treeContent(&test_db, meta))(t)
+	if !maps.EqualFunc(content, expected, bytes.Equal) {
+		t.Errorf("Content not expected after turning compression off")
+	}
+	if report := must(test_db.Check())(t); !report.OK() {
+		t.Errorf("Errors after turning compression off:\n%s", checkErrors(report))
+	}
+}
+
+func TestCompressPage(t *testing.T) {
+	leaf := NewLPage()
+	for i := 0; i < 120; i++ {
+		leaf.InsertKV(&KeyVal{key: intToSlice(int64(i)), val: textValue(i)})
+	}
+	buffer := new(bytes.Buffer)
+	mustOK(t, leaf.write_to_buffer(buffer))
+	page := slices.Clone(buffer.Bytes())
+	compressed := compressPage(page)
+	if compressed == nil || len(compressed) > PAGE_SIZE {
+		t.Fatalf("Expected a %d bytes leaf to compress into a block", len(page))
+	}
+	block := make([]byte, BLOCK_SIZE)
+	copy(block, compressed)
+	decompressed := must(decompressPage(block, 0))(t)
+	decompressed[FLAGS_OFFSET] &^= PAGE_FLAG_COMPRESSED
+	if !bytes.Equal(decompressed, page) {
+		t.Errorf("Page not the same after decompression")
+	}
+	// Random bytes do not get smaller
+	r := rand.New(rand.NewSource(1))
+	if compressPage(append(page[:PAGE_HEADER_SIZE:PAGE_HEADER_SIZE], randomBytes(r, 3000, 3000)...)) != nil {
+		t.Errorf("Expected no compression for random bytes")
+	}
+}
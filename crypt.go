@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+)
+
+// How pages of a database are encrypted, recorded in the meta page.
+const (
+	ENCRYPTION_NONE    = 0
+	ENCRYPTION_AES_GCM = 1
+)
+
+// Each encrypted block is:
+// - nonce (12): random, new for each write
+// - the first PAGE_SIZE bytes of the block, encrypted
+// - tag (16)
+// [nonce | encrypted page ... | tag]
+// The page pointer is the associated data, a block copied to another place
+// does not decrypt. Meta pages stay in clear: they hold no data, and the key
+// is checked against them.
+const (
+	NONCE_SIZE     = 12
+	TAG_SIZE       = 16
+	CRYPT_OVERHEAD = NONCE_SIZE + TAG_SIZE
+)
+
+// Keys used for the pages of a database. The caller key is never used as is:
+// the page key and the key check value are derived from it and the salt of
+// the database.
+type pageCipher struct {
+	key       []byte // From the caller, to encrypt copies of the database
+	salt      [16]uint8
+	key_check [16]uint8
+	aead      cipher.AEAD
+}
+
+func newPageCipher(key []byte, salt [16]uint8) (*pageCipher, error) {
+	if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+		return nil, fmt.Errorf("encryption key of %d bytes, expected 16, 24 or 32", len(key))
+	}
+	block, err := aes.NewCipher(deriveKey(key, salt, "page"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	c := &pageCipher{
+		key:  bytes.Clone(key),
+		salt: salt,
+		aead: aead,
+	}
+	copy(c.key_check[:], deriveKey(key, salt, "check"))
+	return c, nil
+}
+
+// HMAC-SHA256 of salt and purpose, a 32 bytes key
+func deriveKey(key []byte, salt [16]uint8, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt[:])
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// Associated data of the block at ptr
+func blockAAD(ptr uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, ptr)
+}
+
+// Pager that encrypts the blocks of another one, all but the meta slots.
+// Pages are sealed with their checksum before they are encrypted, and
+// verified after they are decrypted.
+type CryptPager struct {
+	Pager
+	cipher *pageCipher
+}
+
+func isMetaSlot(ptr uint64) bool {
+	return ptr < META_SLOTS*BLOCK_SIZE
+}
+
+func (p *CryptPager) ReadPage(ptr uint64, buffer *bytes.Buffer) error {
+	if isMetaSlot(ptr) {
+		return p.Pager.ReadPage(ptr, buffer)
+	}
+	block := new(bytes.Buffer)
+	if err := p.Pager.ReadPage(ptr, block); err != nil {
+		return err
+	}
+	encrypted := block.Bytes()
+	if len(encrypted) != BLOCK_SIZE {
+		return &ErrCorruptPage{Ptr: ptr, Reason: fmt.Sprintf("encrypted block of %d bytes", len(encrypted))}
+	}
+	nonce := encrypted[:NONCE_SIZE]
+	page, err := p.cipher.aead.Open(nil, nonce, encrypted[NONCE_SIZE:], blockAAD(ptr))
+	if err != nil {
+		// Torn write, bit flip, block from another place or another key
+		return &ErrCorruptPage{Ptr: ptr, Reason: "cannot decrypt"}
+	}
+	buffer.Write(page)
+	buffer.Write(make([]byte, CRYPT_OVERHEAD))
+	return nil
+}
+
+func (p *CryptPager) WritePage(ptr uint64, block []byte) error {
+	if isMetaSlot(ptr) {
+		return p.Pager.WritePage(ptr, block)
+	}
+	encrypted, err := p.cipher.encrypt(block, ptr)
+	if err != nil {
+		return err
+	}
+	return p.Pager.WritePage(ptr, encrypted)
+}
+
+// Encrypted form of the sealed block to write at ptr
+func (c *pageCipher) encrypt(block []byte, ptr uint64) ([]byte, error) {
+	if len(block) != BLOCK_SIZE || !isZero(block[PAGE_SIZE:]) {
+		return nil, fmt.Errorf("page at %d does not leave room for encryption", ptr)
+	}
+	encrypted := make([]byte, NONCE_SIZE, BLOCK_SIZE)
+	if _, err := rand.Read(encrypted); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(encrypted, encrypted, block[:PAGE_SIZE], blockAAD(ptr)), nil
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// The pager under the WAL pages in memory and the encryption, or pager itself.
+func basePager(pager Pager) Pager {
+	if wal, ok := pager.(*walPager); ok {
+		pager = wal.Pager
+	}
+	if cryptPager, ok := pager.(*CryptPager); ok {
+		return cryptPager.Pager
+	}
+	return pager
+}
+
+// Encrypt the pages of the tree with key from now on, nil to keep them in
+// clear. Only for a tree with no page yet, the empty tree is committed so that
+// its meta page records the key. See Rekey for the others.
+func (tree *BPTreeDisk) encryptNewTree(key []byte) error {
+	if key == nil {
+		return nil
+	}
+	var salt [16]uint8
+	if _, err := rand.Read(salt[:]); err != nil {
+		return err
+	}
+	c, err := newPageCipher(key, salt)
+	if err != nil {
+		return err
+	}
+	tree.cipher = c
+	tree.pager = &CryptPager{Pager: tree.pager, cipher: c}
+	metaPage, err := tree.LoadMetaPage()
+	if err != nil {
+		return err
+	}
+	return tree.WriteMetaPage(metaPage)
+}
+
+// Check key against the meta page the tree is opened from, then decrypt the
+// pages with it. key has to be nil for a database that is not encrypted.
+func (tree *BPTreeDisk) openWithKey(metaPage MetaPage, key []byte) error {
+	if metaPage.encryption == ENCRYPTION_NONE {
+		if key != nil {
+			return fmt.Errorf("%w: the database is not encrypted", ErrWrongKey)
+		}
+		return nil
+	}
+	if key == nil {
+		return fmt.Errorf("%w: the database is encrypted", ErrWrongKey)
+	}
+	c, err := newPageCipher(key, metaPage.key_salt)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(c.key_check[:], metaPage.key_check[:]) != 1 {
+		return ErrWrongKey
+	}
+	tree.cipher = c
+	tree.pager = &CryptPager{Pager: tree.pager, cipher: c}
+	return nil
+}
+
+// Key the pages are encrypted with, nil if they are not.
+func (tree *BPTreeDisk) key() []byte {
+	if tree.cipher == nil {
+		return nil
+	}
+	return tree.cipher.key
+}
+
+// Write every page again encrypted with newKey, nil to keep them in clear.
+// The tree is copied to a sibling file that replaces the database file, as in
+// CompactOnline, so a crash leaves either key in use, never both. The
+// database has to be opened with newKey after this.
+func (tree *BPTreeDisk) Rekey(newKey []byte) error {
+	if newKey != nil {
+		if _, err := newPageCipher(newKey, [16]uint8{}); err != nil {
+			return err
+		}
+	}
+	c, err := tree.startCompaction(tree.fileName+".rekey", newKey)
+	if err != nil {
+		return err
+	}
+	return c.Finish()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+// Whether the database file holds the text of textValue in clear
+func fileHasText(t *testing.T, dbPath string) bool {
+	data, err := os.ReadFile(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Contains(data, []byte("logged in from the office"))
+}
+
+func fillTextTree(tb testing.TB, tree *BPTreeDisk, maxNum int) {
+	tb.Helper()
+	meta := must(tree.LoadMetaPage())(tb)
+	for i := 0; i < maxNum; i++ {
+		meta = must(tree.Insert(meta, intToSlice(int64(i)), textValue(i)))(tb)
+	}
+	// Big values go to overflow pages
+	meta = must(tree.Set(meta, intToSlice(0), bytes.Repeat(textValue(0), 100)))(tb)
+	mustOK(tb, tree.WriteMetaPage(meta))
+}
+
+// Check all keys of fillTextTree can be read back
+func checkTextTree(t *testing.T, tree *BPTreeDisk, maxNum int) {
+	meta := must(tree.LoadMetaPage())(t)
+	for i := 1; i < maxNum; i++ {
+		kv, err := tree.Find(meta, intToSlice(int64(i)))
+		if err != nil || !bytes.Equal(kv.val, textValue(i)) {
+			t.Fatalf("Find key = %d failed: %v", i, err)
+		}
+	}
+	if report := must(tree.Check())(t); !report.OK() || report.Keys != maxNum {
+		t.Errorf("%d keys, errors:\n%s", report.Keys, checkErrors(report))
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	maxNum := 500
+	dbPath := testDBPath(t)
+	test_db := must(OpenBPTreeDiskWithKey(dbPath, testKey))(t)
+	fillTextTree(t, &test_db, maxNum)
+	mustOK(t, test_db.Close())
+	if fileHasText(t, dbPath) {
+		t.Errorf("Values in clear in an encrypted file")
+	}
+
+	// The key is checked when opening
+	if _, err := OpenBPTreeDisk(dbPath); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Expected ErrWrongKey without a key, got %v", err)
+	}
+	wrongKey := bytes.Clone(testKey)
+	wrongKey[0] ^= 1
+	if _, err := OpenBPTreeDiskWithKey(dbPath, wrongKey); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Expected ErrWrongKey with another key, got %v", err)
+	}
+	if _, err := OpenBPTreeDiskWithKey(dbPath, testKey[:10]); err == nil {
+		t.Errorf("Expected an error for a key of 10 bytes")
+	}
+	test_db = must(OpenBPTreeDiskWithKey(dbPath, testKey))(t)
+	defer test_db.Close()
+	checkTextTree(t, &test_db, maxNum)
+
+	// A block copied over another one does not decrypt
+	meta := must(test_db.LoadMetaPage())(t)
+	root := meta.header.next_page_pointer
+	rootRaw := new(bytes.Buffer)
+	inner := basePager(test_db.pager)
+	mustOK(t, inner.ReadPage(root, rootRaw))
+	child := must(test_db.readRoot(meta, new(bytes.Buffer), test_db.pager))(t).children[0]
+	mustOK(t, inner.WritePage(child, rootRaw.Bytes()))
+	test_db.cache.invalidate(child)
+	if _, err := test_db.Find(meta, intToSlice(1)); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected ErrCorrupt for a block at the wrong place, got %v", err)
+	}
+}
+
+func TestEncryption_Rekey(t *testing.T) {
+	maxNum := 300
+	dbPath := testDBPath(t)
+	test_db := must(OpenBPTreeDisk(dbPath))(t)
+	mustOK(t, test_db.SetCompression(COMPRESSION_FLATE))
+	fillTextTree(t, &test_db, maxNum)
+
+	// Clear -> testKey -> otherKey -> clear
+	otherKey := []byte("another key of 24 bytes!")
+	for _, key := range [][]byte{testKey, otherKey, nil} {
+		if err := test_db.Rekey(key); err != nil {
+			t.Fatalf("Rekey failed: %v", err)
+		}
+		checkTextTree(t, &test_db, maxNum)
+		mustOK(t, test_db.Close())
+		if fileHasText(t, dbPath) != (key == nil) {
+			t.Errorf("Values in clear: %v, key: %q", !(key == nil), key)
+		}
+		test_db = must(OpenBPTreeDiskWithKey(dbPath, key))(t)
+		if test_db.compression != COMPRESSION_FLATE {
+			t.Errorf("Compression lost by Rekey")
+		}
+		checkTextTree(t, &test_db, maxNum)
+	}
+	if _, err := os.Stat(dbPath + ".rekey"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Sibling file left after Rekey: %v", err)
+	}
+	if err := test_db.Rekey([]byte("short")); err == nil {
+		t.Errorf("Expected an error for a short key")
+	}
+	mustOK(t, test_db.Close())
+}
+
+func TestEncryption_DB(t *testing.T) {
+	dbPath := testDBPath(t)
+	kv := &KV{fileName: dbPath, key: testKey}
+	mustOK(t, kv.Open())
+	meta := must(kv.LoadMetaPage())(t)
+	meta = must(kv.Set(meta, []byte("name"), []byte("Adam")))(t)
+	mustOK(t, kv.WriteMetaPage(meta))
+	mustOK(t, kv.Close())
+
+	db := DB{Path: dbPath}
+	if err := db.Open(nil); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Expected ErrWrongKey, got %v", err)
+	}
+	mustOK(t, db.Open(testKey))
+	defer db.Close()
+	val := must(db.kv.Get(must(db.kv.LoadMetaPage())(t), []byte("name")))(t)
+	if !bytes.Equal(val, []byte("Adam")) {
+		t.Errorf("Get: expected Adam, got %q", val)
+	}
+}
+
+func TestCLI_Key(t *testing.T) {
+	dbPath := testDBPath(t)
+	test_db := must(OpenBPTreeDiskWithKey(dbPath, testKey))(t)
+	fillTextTree(t, &test_db, 100)
+	test_db.Close()
+	keyPath := filepath.Join(t.TempDir(), "key")
+	mustOK(t, os.WriteFile(keyPath, testKey, 0600))
+	hexKey := hex.EncodeToString(testKey)
+
+	if code := runCommand([]string{"fsck", dbPath}, io.Discard, io.Discard); code == 0 {
+		t.Errorf("fsck without the key should fail")
+	}
+	if code := runCommand([]string{"fsck", "-key", hexKey, "-key-file", keyPath, dbPath}, io.Discard, io.Discard); code == 0 {
+		t.Errorf("fsck with 2 keys should fail")
+	}
+	backupPath := filepath.Join(t.TempDir(), "backup.db")
+	restorePath := filepath.Join(t.TempDir(), "restored.db")
+	for _, args := range [][]string{
+		{"fsck", "-key-file", keyPath, dbPath},
+		{"stats", "-key", hexKey, dbPath},
+		{"dump", "-key", hexKey, dbPath},
+		{"compact", "-key-file", keyPath, "-online", dbPath},
+		{"backup", "-key-file", keyPath, dbPath, backupPath},
+		{"restore", "-key-file", keyPath, backupPath, restorePath},
+	} {
+		out := new(bytes.Buffer)
+		if code := runCommand(args, out, out); code != 0 {
+			t.Errorf("%s: exit code %d, output:\n%s", args[0], code, out)
+		}
+	}
+	restored := must(OpenBPTreeDiskWithKey(restorePath, testKey))(t)
+	defer restored.Close()
+	checkTextTree(t, &restored, 100)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ========================== Tree dump ==========================
+// A description of every page of a tree, to render as Graphviz DOT or JSON
+// instead of printing raw structs with isDebugMode.
+
+type DumpPage struct {
+	Ptr      uint64   `json:"ptr"`
+	Type     string   `json:"type"`  // "internal" or "leaf"
+	Level    int      `json:"level"` // 0: first internal page
+	Keys     int      `json:"keys"`
+	Size     int      `json:"size"` // Bytes used in the block, before compression
+	Fill     float64  `json:"fill"` // Size / PAGE_SIZE, > 1 for some compressed leaves
+	FirstKey string   `json:"first_key"`
+	LastKey  string   `json:"last_key"`
+	Children []uint64 `json:"children,omitempty"`
+	Next     uint64   `json:"next,omitempty"` // next_page_pointer, with PAGE_FLAG_LINKED only
+	// Pages holding the big values of a leaf
+	OverflowPages int  `json:"overflow_pages,omitempty"`
+	Compressed    bool `json:"compressed,omitempty"`
+}
+
+type TreeDump struct {
+	Generation uint64     `json:"generation"`
+	Root       uint64     `json:"root"`
+	Height     int        `json:"height"`
+	Pages      []DumpPage `json:"pages"` // Level by level, in key order
+}
+
+// Describe the pages of the tree of metaPage. If decodeKeys, keys are shown
+// as encodeKey tuples, else as hex.
+func (tree *BPTreeDisk) Dump(metaPage MetaPage, decodeKeys bool) (TreeDump, error) {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+	buffer := new(bytes.Buffer) // Buffer size = 0
+	pager, err := tree.getPager()
+	if err != nil {
+		return TreeDump{}, err
+	}
+	dump := TreeDump{
+		Generation: metaPage.generation,
+		Root:       metaPage.header.next_page_pointer,
+		Pages:      []DumpPage{},
+	}
+	// Links of a tree written since BulkLoad are stale on older files
+	linked := metaPage.header.flags&PAGE_FLAG_LINKED != 0
+	formatKey := formatKeyHex
+	if decodeKeys {
+		formatKey = formatKeyTuple
+	}
+	// Level by level from the first internal page
+	level := []uint64{}
+	if dump.Root != 0 {
+		level = append(level, dump.Root)
+	}
+	for len(level) > 0 {
+		next := []uint64{}
+		for _, ptr := range level {
+			page := DumpPage{Ptr: ptr, Level: dump.Height}
+			node, err := tree.readNode(ptr, buffer, pager)
+			if err != nil {
+				return dump, err
+			}
+			if convert, ok := node.(*BTreeInternalPage); ok {
+				page.Type = "internal"
+				page.Keys = int(convert.nkey)
+				page.Size = convert.size()
+				if linked {
+					page.Next = convert.header.next_page_pointer
+				}
+				page.Children = convert.children
+				if convert.nkey > 0 {
+					page.FirstKey = formatKey(convert.keys[0].data)
+					page.LastKey = formatKey(convert.keys[convert.nkey-1].data)
+				}
+				next = append(next, convert.children...)
+			} else {
+				convert := node.(*BTreeLeafPage)
+				page.Type = "leaf"
+				page.Keys = int(convert.nkv)
+				page.Size = convert.size()
+				if linked {
+					page.Next = convert.header.next_page_pointer
+				}
+				page.Compressed = convert.header.flags&PAGE_FLAG_COMPRESSED != 0
+				if convert.nkv > 0 {
+					page.FirstKey = formatKey(convert.kv[0].key)
+					page.LastKey = formatKey(convert.kv[convert.nkv-1].key)
+				}
+				for i := range convert.kv {
+					if convert.kv[i].overflow_ptr != 0 {
+						page.OverflowPages += int((convert.kv[i].overflow_len + OVERFLOW_MAX_DATA - 1) / OVERFLOW_MAX_DATA)
+					}
+				}
+			}
+			page.Fill = float64(page.Size) / PAGE_SIZE
+			dump.Pages = append(dump.Pages, page)
+		}
+		dump.Height += 1
+		level = next
+	}
+	return dump, nil
+}
+
+func formatKeyHex(key []byte) string {
+	return fmt.Sprintf("%x", key)
+}
+
+// Show a key made by encodeKey as prefix:(v0, v1, ...), or as hex if it is
+// not one.
+func formatKeyTuple(key []byte) string {
+	prefix, vals, ok := parseTuple(key)
+	if !ok {
+		return formatKeyHex(key)
+	}
+	parts := []string{}
+	for _, v := range vals {
+		if v.Type == TYPE_INT64 {
+			parts = append(parts, fmt.Sprint(v.I64))
+		} else {
+			parts = append(parts, fmt.Sprintf("%q", v.Str))
+		}
+	}
+	return fmt.Sprintf("%d:(%s)", prefix, strings.Join(parts, ", "))
+}
+
+// Same as decodeVals, but checks the data instead of trusting it.
+func parseTuple(data []byte) (uint8, []Value, bool) {
+	if len(data) < 2 {
+		return 0, nil, false
+	}
+	prefix, n := data[0], int(data[1])
+	data = data[2:]
+	vals := make([]Value, 0, n)
+	for i := 0; i < n; i++ {
+		if len(data) < 1 {
+			return 0, nil, false
+		}
+		v := Value{Type: data[0]}
+		data = data[1:]
+		if v.Type == TYPE_INT64 {
+			if len(data) < 8 {
+				return 0, nil, false
+			}
+			v.I64 = int64(binary.BigEndian.Uint64(data))
+			data = data[8:]
+		} else if v.Type == TYPE_BYTES {
+			if len(data) < 1 || len(data) < 1+int(data[0]) {
+				return 0, nil, false
+			}
+			v.Str = data[1 : 1+int(data[0])]
+			data = data[1+int(data[0]):]
+		} else {
+			return 0, nil, false
+		}
+		vals = append(vals, v)
+	}
+	return prefix, vals, len(data) == 0
+}
+
+func (d *TreeDump) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(d)
+}
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// Pages are boxes, one rank per level. Solid edges go to children, dashed
+// edges follow next_page_pointer.
+func (d *TreeDump) WriteDOT(w io.Writer) error {
+	out := new(bytes.Buffer)
+	fmt.Fprintf(out, "digraph btree {\n")
+	fmt.Fprintf(out, "  label=\"generation %d\";\n", d.Generation)
+	fmt.Fprintf(out, "  node [shape=box, fontname=monospace];\n")
+	pages := make(map[uint64]bool)
+	for _, page := range d.Pages {
+		pages[page.Ptr] = true
+	}
+	for level := 0; level < d.Height; level++ {
+		fmt.Fprintf(out, "  { rank=same;")
+		for _, page := range d.Pages {
+			if page.Level == level {
+				fmt.Fprintf(out, " p%d;", page.Ptr/BLOCK_SIZE)
+			}
+		}
+		fmt.Fprintf(out, " }\n")
+	}
+	for _, page := range d.Pages {
+		label := fmt.Sprintf("%s %d\\n%d keys, %.0f%% full\\n%s ..\\n%s",
+			page.Type, page.Ptr/BLOCK_SIZE, page.Keys, page.Fill*100,
+			dotEscaper.Replace(page.FirstKey), dotEscaper.Replace(page.LastKey))
+		if page.OverflowPages > 0 {
+			label += fmt.Sprintf("\\n+%d overflow pages", page.OverflowPages)
+		}
+		if page.Compressed {
+			label += "\\ncompressed"
+		}
+		fmt.Fprintf(out, "  p%d [label=\"%s\"];\n", page.Ptr/BLOCK_SIZE, label)
+		for _, child := range page.Children {
+			fmt.Fprintf(out, "  p%d -> p%d;\n", page.Ptr/BLOCK_SIZE, child/BLOCK_SIZE)
+		}
+		if page.Next != 0 && pages[page.Next] {
+			fmt.Fprintf(out, "  p%d -> p%d [style=dashed, constraint=false];\n", page.Ptr/BLOCK_SIZE, page.Next/BLOCK_SIZE)
+		}
+	}
+	fmt.Fprintf(out, "}\n")
+	_, err := w.Write(out.Bytes())
+	return err
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDump(t *testing.T) {
+	maxNum := 500
+	test_db := newTestTree(t)
+	defer test_db.Close()
+	meta := must(test_db.BulkLoad(sortedTestPairs(maxNum), 0.5))(t)
+	mustOK(t, test_db.WriteMetaPage(meta))
+
+	dump := must(test_db.Dump(meta, false))(t)
+	if dump.Height < 2 || len(dump.Pages) == 0 || dump.Pages[0].Ptr != meta.header.next_page_pointer {
+		t.Fatalf("Dump not expected: height %d, %d pages", dump.Height, len(dump.Pages))
+	}
+	keys := 0
+	for _, page := range dump.Pages {
+		if page.Type == "leaf" {
+			keys += page.Keys
+			if page.Level != dump.Height-1 || page.Fill <= 0 || page.Fill > 1 {
+				t.Errorf("Leaf not expected: %+v", page)
+			}
+		}
+	}
+	if keys != maxNum {
+		t.Errorf("Expected %d keys in leaves, got %d", maxNum, keys)
+	}
+	if dump.Pages[len(dump.Pages)-1].LastKey != formatKeyHex(intToSlice(int64(maxNum))) {
+		t.Errorf("Last key not expected: %v", dump.Pages[len(dump.Pages)-1].LastKey)
+	}
+
+	// JSON reads back the same
+	out := new(bytes.Buffer)
+	if err := dump.WriteJSON(out); err != nil {
+		t.Fatalf("WriteJSON failed: %v", err)
+	}
+	decoded := TreeDump{}
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil || len(decoded.Pages) != len(dump.Pages) {
+		t.Errorf("JSON does not read back: %v", err)
+	}
+
+	// DOT has a node per page and a dashed edge per leaf link
+	out.Reset()
+	if err := dump.WriteDOT(out); err != nil {
+		t.Fatalf("WriteDOT failed: %v", err)
+	}
+	dot := out.String()
+	if !strings.HasPrefix(dot, "digraph btree {") || strings.Count(dot, "[label=") != len(dump.Pages) {
+		t.Errorf("DOT not expected:\n%s", dot)
+	}
+	if strings.Count(dot, "style=dashed") == 0 {
+		t.Errorf("Expected the leaf chain in DOT")
+	}
+}
+
+func TestDump_DecodeKeys(t *testing.T) {
+	key := encodeKey(11, []Value{{Type: TYPE_INT64, I64: 10}, {Type: TYPE_BYTES, Str: []byte("Adam")}})
+	if got := formatKeyTuple(key); got != `11:(10, "Adam")` {
+		t.Errorf("Decoded key not expected: %s", got)
+	}
+	// Not a tuple: shown as hex
+	if got := formatKeyTuple([]byte{11, 1, TYPE_INT64, 0}); got != "0b010200" {
+		t.Errorf("Expected hex for a bad tuple, got %s", got)
+	}
+}
+
+func TestCLI_Dump(t *testing.T) {
+	dbPath := testDBPath(t)
+	test_db := must(NewBPTreeDisk(dbPath))(t)
+	mustOK(t, test_db.WriteMetaPage(must(test_db.BulkLoad(sortedTestPairs(100), 1))(t)))
+	test_db.Close()
+	out := new(bytes.Buffer)
+	if code := runCommand([]string{"dump", "-format", "json", "-decode", dbPath}, out, out); code != 0 {
+		t.Errorf("dump: exit code %d, output:\n%s", code, out)
+	}
+	// Errors do not go to the output, which can be piped
+	out.Reset()
+	errOut := new(bytes.Buffer)
+	if code := runCommand([]string{"dump", "-format", "svg", dbPath}, out, errOut); code == 0 {
+		t.Errorf("dump with an unknown format should fail")
+	}
+	if out.Len() != 0 || !strings.Contains(errOut.String(), "usage: dump") {
+		t.Errorf("Expected the error on errOut only, output:\n%s\nerrors:\n%s", out, errOut)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Errors returned by BPTreeDisk, KV and DB are wrapped around these, test
+// them with errors.Is.
+var (
+	ErrNotFound    = errors.New("key not found")
+	ErrKeyTooLarge = errors.New("key too large")
+	ErrKeyExists   = errors.New("key already exists")
+	ErrCorrupt     = errors.New("database file is corrupt")
+	ErrClosed      = errors.New("database is closed")
+	ErrWrongKey    = errors.New("wrong encryption key")
+	ErrConflict    = errors.New("transaction conflict")
+	ErrInvalidIter = errors.New("iterator is not on a key")
+)
+
+// Write each value in order, stop at the first error.
+func binaryWrite(buffer *bytes.Buffer, values ...any) error {
+	for _, v := range values {
+		if err := binary.Write(buffer, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read each value in order, stop at the first error. Pages are read from
+// whole blocks, so running out of data means the page is corrupt.
+func binaryRead(buffer *bytes.Buffer, values ...any) error {
+	for _, v := range values {
+		if err := binary.Read(buffer, binary.BigEndian, v); err != nil {
+			return fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"maps"
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+)
+
+var errInjected = errors.New("injected I/O error")
+
+// Pager for crash tests. Writes stay in pending, like in the OS page cache,
+// until Sync puts them on disk. Crash loses, keeps or tears each pending
+// write, then the tree can be opened again on the same pager.
+type FaultPager struct {
+	disk    *MemPager         // What survives a crash
+	pending map[uint64][]byte // Written, not synced yet
+	r       *rand.Rand
+	calls   int // ReadPage, WritePage and Sync calls so far
+	failAt  int // Call that returns errInjected, 0: none
+}
+
+func NewFaultPager(r *rand.Rand) *FaultPager {
+	return &FaultPager{
+		disk:    NewMemPager(),
+		pending: make(map[uint64][]byte),
+		r:       r,
+	}
+}
+
+// The n-th I/O call from now fails, once.
+func (p *FaultPager) FailAfter(n int) {
+	p.failAt = p.calls + n
+}
+
+func (p *FaultPager) inject() error {
+	p.calls += 1
+	if p.calls == p.failAt {
+		return errInjected
+	}
+	return nil
+}
+
+func (p *FaultPager) ReadPage(ptr uint64, buffer *bytes.Buffer) error {
+	if err := p.inject(); err != nil {
+		return err
+	}
+	if block, ok := p.pending[ptr]; ok {
+		buffer.Write(block)
+		return nil
+	}
+	size, err := p.Size()
+	if err != nil {
+		return err
+	}
+	diskSize, err := p.disk.Size()
+	if err != nil {
+		return err
+	}
+	if ptr < size && ptr >= diskSize {
+		// Only written after this block, not synced yet
+		buffer.Write(make([]byte, BLOCK_SIZE))
+		return nil
+	}
+	return p.disk.ReadPage(ptr, buffer)
+}
+
+func (p *FaultPager) WritePage(ptr uint64, block []byte) error {
+	if err := p.inject(); err != nil {
+		return err
+	}
+	p.pending[ptr] = bytes.Clone(block)
+	return nil
+}
+
+func (p *FaultPager) Sync() error {
+	if err := p.inject(); err != nil {
+		return err
+	}
+	for _, ptr := range slices.Sorted(maps.Keys(p.pending)) {
+		if err := p.disk.WritePage(ptr, p.pending[ptr]); err != nil {
+			return err
+		}
+	}
+	clear(p.pending)
+	return nil
+}
+
+func (p *FaultPager) Alloc() uint64 {
+	return p.disk.Alloc()
+}
+
+func (p *FaultPager) Free(ptr uint64) {
+	p.disk.Free(ptr)
+}
+
+// Like a process exit: nothing is synced.
+func (p *FaultPager) Close() error {
+	return nil
+}
+
+func (p *FaultPager) Size() (uint64, error) {
+	size, err := p.disk.Size()
+	if err != nil {
+		return 0, err
+	}
+	for ptr, block := range p.pending {
+		size = max(size, ptr+uint64(len(block)))
+	}
+	return size, nil
+}
+
+func (p *FaultPager) allocator() *FileAllocator {
+	return p.disk.allocator()
+}
+
+// Power loss: each pending write is lost, done, or torn at a random byte
+// with the start of the new block over the end of the old one.
+func (p *FaultPager) Crash() error {
+	for _, ptr := range slices.Sorted(maps.Keys(p.pending)) {
+		block := p.pending[ptr]
+		switch p.r.Intn(3) {
+		case 0:
+			continue
+		case 1:
+			if err := p.disk.WritePage(ptr, block); err != nil {
+				return err
+			}
+		case 2:
+			old := new(bytes.Buffer)
+			if p.disk.ReadPage(ptr, old) != nil {
+				old.Write(make([]byte, BLOCK_SIZE))
+			}
+			cut := p.r.Intn(len(block))
+			torn := append(bytes.Clone(block[:cut]), old.Bytes()[cut:]...)
+			if err := p.disk.WritePage(ptr, torn); err != nil {
+				return err
+			}
+		}
+	}
+	clear(p.pending)
+	p.failAt = 0
+	return nil
+}
+
+// All key value pairs of the tree of metaPage.
+func treeContent(tree *BPTreeDisk, metaPage MetaPage) (map[string][]byte, error) {
+	content := make(map[string][]byte)
+	seq, seqErr := tree.All(metaPage)
+	for key, val := range seq {
+		content[string(key)] = val
+	}
+	return content, seqErr()
+}
+
+// Random Insert / Set / Del with commits, I/O errors and crashes. After each
+// crash the tree opens again to the last committed state, or to the state of
+// a commit that failed half way.
+func TestFaultPager_Crash(t *testing.T) {
+	seed := time.Now().UnixNano()
+	r := rand.New(rand.NewSource(seed))
+	crashes := 0
+	for range 20 {
+		pager := NewFaultPager(r)
+		tree := must(NewBPTreeDiskWithPager(pager))(t)
+		meta := must(tree.LoadMetaPage())(t)
+		committed := map[string][]byte{}
+		working := map[string][]byte{}
+		var inDoubt map[string][]byte // Commit that failed, may be on disk or not
+
+		restart := func() {
+			crashes += 1
+			mustOK(t, pager.Crash())
+			reopened, err := OpenBPTreeDiskWithPager(pager)
+			if err != nil {
+				t.Fatalf("seed %d: reopen after crash failed: %v", seed, err)
+			}
+			tree = reopened
+			meta = must(tree.LoadMetaPage())(t)
+			content, err := treeContent(&tree, meta)
+			if err != nil {
+				t.Fatalf("seed %d: read after crash failed: %v", seed, err)
+			}
+			if inDoubt != nil && maps.EqualFunc(content, inDoubt, bytes.Equal) {
+				committed = inDoubt
+			} else if !maps.EqualFunc(content, committed, bytes.Equal) {
+				t.Fatalf("seed %d: reopened with %d keys, last commit has %d", seed, len(content), len(committed))
+			}
+			if report := must(tree.Check())(t); !report.OK() {
+				t.Fatalf("seed %d: errors after crash:\n%s", seed, checkErrors(report))
+			}
+			inDoubt = nil
+			working = maps.Clone(committed)
+		}
+
+		for range 300 {
+			if r.Intn(20) == 0 {
+				pager.FailAfter(1 + r.Intn(30))
+			}
+			key := intToSlice(int64(r.Intn(200)))
+			val := randomBytes(r, 0, 100)
+			if r.Intn(10) == 0 {
+				val = randomBytes(r, MAX_INLINE_VAL_SIZE, 2*BLOCK_SIZE)
+			}
+			_, exists := working[string(key)]
+			var newMeta MetaPage
+			var err error
+			if !exists && r.Intn(2) == 0 {
+				newMeta, err = tree.Insert(meta, key, val)
+			} else if exists && r.Intn(3) == 0 {
+				newMeta, err = tree.Del(meta, key)
+				val = nil
+			} else {
+				newMeta, err = tree.Set(meta, key, val)
+			}
+			if err != nil {
+				if !errors.Is(err, errInjected) {
+					t.Fatalf("seed %d: %v", seed, err)
+				}
+				restart()
+				continue
+			}
+			meta = newMeta
+			if val == nil {
+				delete(working, string(key))
+			} else {
+				working[string(key)] = val
+			}
+
+			if r.Intn(10) == 0 {
+				if err := tree.WriteMetaPage(meta); err != nil {
+					if !errors.Is(err, errInjected) {
+						t.Fatalf("seed %d: %v", seed, err)
+					}
+					inDoubt = working
+					restart()
+					continue
+				}
+				committed = maps.Clone(working)
+			}
+			if r.Intn(50) == 0 {
+				restart()
+			}
+		}
+		restart()
+	}
+	if crashes < 100 {
+		t.Errorf("seed %d: only %d crashes", seed, crashes)
+	}
+}
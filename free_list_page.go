@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Each free list page takes:
+// - Header (PAGE_HEADER_SIZE)
+// - nblock (2)
+// - list of free block numbers: n * 8
+const FREE_LIST_MAX_BLOCK = (PAGE_SIZE - (PAGE_HEADER_SIZE + 2)) / 8
+
+// Free list pages form a chain starting at MetaPage.free_list_pointer,
+// linked through header.next_page_pointer.
+// [header | nblock | b0 b1 b2 ... | 0 0 0 0 ... ]
+type FreeListPage struct {
+	header PageHeader
+	nblock uint16
+	blocks [FREE_LIST_MAX_BLOCK]uint64
+}
+
+func NewFLPage() FreeListPage {
+	var new_blocks [FREE_LIST_MAX_BLOCK]uint64
+	return FreeListPage{
+		header: PageHeader{
+			page_type:         3,
+			next_page_pointer: 0,
+		},
+		nblock: 0,
+		blocks: new_blocks,
+	}
+}
+
+func (p *FreeListPage) write_to_buffer(buffer *bytes.Buffer) error {
+	if err := p.header.write_to_buffer(buffer); err != nil {
+		return err
+	}
+	return binaryWrite(buffer, p.nblock, p.blocks[:p.nblock])
+}
+
+func (p *FreeListPage) read_from_buffer(buffer *bytes.Buffer, isReadHeader bool) error {
+	if isReadHeader {
+		if err := p.header.read_from_buffer(buffer); err != nil {
+			return err
+		}
+	}
+	if err := binaryRead(buffer, &p.nblock); err != nil {
+		return err
+	}
+	if p.nblock > FREE_LIST_MAX_BLOCK {
+		return fmt.Errorf("%w: %d blocks in a free list page", ErrCorrupt, p.nblock)
+	}
+	return binaryRead(buffer, p.blocks[:p.nblock])
+}
@@ -3,61 +3,109 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"slices"
 )
 
 // 0: Meta Page
 // 1: Internal Page
 // 2: Leaf Page
+// 3: Free List Page
+// 4: Overflow Page
 // ...: not support
+// flags: PAGE_FLAG_COMPRESSED for a leaf written compressed, see encodeLeaf,
+// PAGE_FLAG_LINKED for a meta page whose tree has valid links, see BulkLoad.
+// checksum and page_ptr are filled when the page is written to its block,
+// see sealBlock.
 type PageHeader struct {
 	page_type         uint8
+	flags             uint8
 	next_page_pointer uint64
+	checksum          uint32 // CRC32C of the whole block, with this field as 0
+	page_ptr          uint64 // Where the page is written, to catch misdirected writes
 }
 
-func (h *PageHeader) write_to_buffer(buffer *bytes.Buffer) {
+func (h *PageHeader) write_to_buffer(buffer *bytes.Buffer) error {
 	// int 183746238746
 	// big endian:    [0 0 0 0 0 0 0 ... 255 255 255 1 2 3 4 5]
 	// little endian: [5 4 3 2 1 255 255 255 ... 0 0 0 0 0 0 0]
-	var err error
-	err = binary.Write(buffer, binary.BigEndian, h.page_type)
-	err = binary.Write(buffer, binary.BigEndian, h.next_page_pointer)
-	if err != nil {
-		panic(err)
-	}
 	// {page_type = 1, next = 1024} -> [ 1 0 0 0 0 0 0 255 255 ]
+	return binaryWrite(buffer, h.page_type, h.flags, h.next_page_pointer, h.checksum, h.page_ptr)
 }
 
-func (h *PageHeader) read_from_buffer(buffer *bytes.Buffer) {
-	var err error
-	err = binary.Read(buffer, binary.BigEndian, &h.page_type)
-	err = binary.Read(buffer, binary.BigEndian, &h.next_page_pointer)
-	if err != nil {
-		panic(err)
-	}
+func (h *PageHeader) read_from_buffer(buffer *bytes.Buffer) error {
 	// {page_type = 1, next = 1024}, buffer = [ 1 0 0 0 0 0 0 255 255 ]
+	return binaryRead(buffer, &h.page_type, &h.flags, &h.next_page_pointer, &h.checksum, &h.page_ptr)
 }
 
 // =========================================================================
 
+// Written at the start of every meta page, used to recognise our files.
+const META_SIGNATURE = "MINIDBGO"
+
+// Two copies of the meta page are kept, one in each of the first 2 blocks.
+// A commit writes to the slot of the older one, so a torn write never
+// touches the last committed root.
+const META_SLOTS = 2
+
+// header.next_page_pointer points to the first internal page (the root).
+// last_free and free_list_pointer persist the FileAllocator state.
+// generation increases with each commit, the newest valid slot wins.
+// compression is the COMPRESSION_* of leaf pages written to this database.
+// encryption is the ENCRYPTION_* of all other pages, key_check tells if a key
+// is the one they are encrypted with, see pageCipher.
 type MetaPage struct {
-	header PageHeader
+	header            PageHeader
+	signature         [8]uint8
+	generation        uint64
+	last_free         uint64
+	free_list_pointer uint64
+	compression       uint8
+	encryption        uint8
+	key_salt          [16]uint8
+	key_check         [16]uint8
+	// In memory only: the write that made this meta page, see Reclaimer
+	version uint64
+}
+
+func NewMetaPage() MetaPage {
+	metaPage := MetaPage{
+		header: PageHeader{
+			page_type:         0,
+			next_page_pointer: 0,
+		},
+		generation:        0,
+		last_free:         META_SLOTS,
+		free_list_pointer: 0,
+		compression:       COMPRESSION_NONE,
+		encryption:        ENCRYPTION_NONE,
+	}
+	copy(metaPage.signature[:], META_SIGNATURE)
+	return metaPage
 }
 
-func (p *MetaPage) write_to_buffer(buffer *bytes.Buffer) {
-	p.header.write_to_buffer(buffer)
+func (p *MetaPage) write_to_buffer(buffer *bytes.Buffer) error {
+	if err := p.header.write_to_buffer(buffer); err != nil {
+		return err
+	}
+	return binaryWrite(buffer, p.signature, p.generation, p.last_free, p.free_list_pointer, p.compression, p.encryption, p.key_salt, p.key_check)
 }
 
-func (p *MetaPage) read_from_buffer(buffer *bytes.Buffer) {
-	p.header.read_from_buffer(buffer)
+func (p *MetaPage) read_from_buffer(buffer *bytes.Buffer) error {
+	if err := p.header.read_from_buffer(buffer); err != nil {
+		return err
+	}
+	return binaryRead(buffer, &p.signature, &p.generation, &p.last_free, &p.free_list_pointer, &p.compression, &p.encryption, &p.key_salt, &p.key_check)
 }
 
 // =========================================================================
 
-// 3: [1, 7, 255]
-// [0 0 0 0 0 0 1 7 255]
+// Each key takes:
+// - len (2)
+// - data (len)
+// 3: [1, 7, 255] -> [0 3 1 7 255]
 type KeyEntry struct {
-	len  uint16
-	data [MAX_KEY_SIZE]uint8 // Big endian storage
+	data []uint8
 }
 
 func NewKeyEntryFromInt(input int64) KeyEntry {
@@ -67,105 +115,132 @@ func NewKeyEntryFromInt(input int64) KeyEntry {
 	return NewKeyEntryFromBytes(data_slice)
 }
 
-// our key: [0 0 0 0 255 255 1 2]
-// input  : [0 0 0 0 0 0 1 2]
 func NewKeyEntryFromBytes(input []byte) KeyEntry {
-	data_len := len(input)
-	var data [MAX_KEY_SIZE]uint8
-	for i := MAX_KEY_SIZE - data_len; i < MAX_KEY_SIZE; i += 1 {
-		data[i] = input[i-(MAX_KEY_SIZE-data_len)] // data[10] = slice[0] | data[11] = slice[1] ...
-	}
 	return KeyEntry{
-		len:  uint16(data_len),
-		data: data,
+		data: slices.Clone(input),
 	}
 }
 
-func (k *KeyEntry) write_to_buffer(buffer *bytes.Buffer) {
-	var err error
-	err = binary.Write(buffer, binary.BigEndian, k.len)
-	for i := MAX_KEY_SIZE - k.len; i < MAX_KEY_SIZE; i += 1 {
-		err = binary.Write(buffer, binary.BigEndian, k.data[i])
-	}
-	if err != nil {
-		panic(err)
-	}
+// Bytes taken by this key in a page
+func (k *KeyEntry) size() int {
+	return 2 + len(k.data)
 }
 
-func (k *KeyEntry) read_from_buffer(buffer *bytes.Buffer) {
-	var err error
-	err = binary.Read(buffer, binary.BigEndian, &k.len)
-	for i := MAX_KEY_SIZE - k.len; i < MAX_KEY_SIZE; i += 1 {
-		err = binary.Read(buffer, binary.BigEndian, &k.data[i])
+func (k *KeyEntry) write_to_buffer(buffer *bytes.Buffer) error {
+	if err := binaryWrite(buffer, uint16(len(k.data))); err != nil {
+		return err
 	}
-	if err != nil {
-		panic(err)
+	buffer.Write(k.data)
+	return nil
+}
+
+func (k *KeyEntry) read_from_buffer(buffer *bytes.Buffer) error {
+	var data_len uint16
+	if err := binaryRead(buffer, &data_len); err != nil {
+		return err
 	}
+	k.data = make([]uint8, data_len)
+	return binaryRead(buffer, k.data)
 }
 
 func (k *KeyEntry) compare(rhs *KeyEntry) int {
-	res := 0
-	for i := 0; i < MAX_KEY_SIZE; i += 1 {
-		if k.data[i] < rhs.data[i] {
-			return -1
-		}
-		if k.data[i] > rhs.data[i] {
-			return 1
-		}
-	}
-	return res
+	return compareKey(k.data, rhs.data)
 }
 
 // =========================================================================
 
-// [header | u8 u8 | k0 k1 k2 ... | 0 0 0 0 0 0 ... ]
+// Each internal page is a slotted page:
+// - Header
+// - nkey (2)
+// - list of offsets: n * 2, position of each cell from the start of the cells
+// - list of cells: (child pointer (8), key)
+// [header | nkey | off_0 off_1 ... | c0 k0 c1 k1 ... | 0 0 0 0 ... ]
 type BTreeInternalPage struct {
 	header   PageHeader
 	nkey     uint16
-	keys     [INTERNAL_MAX_KEY]KeyEntry
-	children [INTERNAL_MAX_KEY]uint64
+	keys     []KeyEntry
+	children []uint64
 }
 
-func (p *BTreeInternalPage) write_to_buffer(buffer *bytes.Buffer) {
-	var err error
-	p.header.write_to_buffer(buffer)
-	err = binary.Write(buffer, binary.BigEndian, p.nkey)
-	for i := 0; i < int(p.nkey); i += 1 {
-		p.keys[i].write_to_buffer(buffer)
+// Copy that can be changed without touching this page
+func (p *BTreeInternalPage) clone() BTreeInternalPage {
+	return BTreeInternalPage{
+		header:   p.header,
+		nkey:     p.nkey,
+		keys:     slices.Clone(p.keys),
+		children: slices.Clone(p.children),
 	}
+}
+
+// Bytes taken by this page once written, has to be <= PAGE_SIZE
+func (p *BTreeInternalPage) size() int {
+	sz := PAGE_HEADER_SIZE + 2
 	for i := 0; i < int(p.nkey); i += 1 {
-		err = binary.Write(buffer, binary.BigEndian, p.children[i])
+		sz += 2 + 8 + p.keys[i].size()
 	}
-	if err != nil {
-		panic(err)
+	return sz
+}
+
+func (p *BTreeInternalPage) write_to_buffer(buffer *bytes.Buffer) error {
+	if err := p.header.write_to_buffer(buffer); err != nil {
+		return err
+	}
+	if err := binaryWrite(buffer, p.nkey); err != nil {
+		return err
+	}
+	cells := new(bytes.Buffer)
+	for i := 0; i < int(p.nkey); i += 1 {
+		if err := binaryWrite(buffer, uint16(cells.Len())); err != nil {
+			return err
+		}
+		if err := binaryWrite(cells, p.children[i]); err != nil {
+			return err
+		}
+		if err := p.keys[i].write_to_buffer(cells); err != nil {
+			return err
+		}
 	}
+	buffer.Write(cells.Bytes())
+	return nil
 }
 
 // isReadHeader also read a header, used in case it's not yet read.
-func (p *BTreeInternalPage) read_from_buffer(buffer *bytes.Buffer, isReadHeader bool) {
-	var err error
+func (p *BTreeInternalPage) read_from_buffer(buffer *bytes.Buffer, isReadHeader bool) error {
 	if isReadHeader {
-		p.header.read_from_buffer(buffer)
+		if err := p.header.read_from_buffer(buffer); err != nil {
+			return err
+		}
 	}
-	err = binary.Read(buffer, binary.BigEndian, &p.nkey)
-	for i := 0; i < int(p.nkey); i += 1 {
-		p.keys[i].read_from_buffer(buffer)
+	if err := binaryRead(buffer, &p.nkey); err != nil {
+		return err
 	}
-	for i := 0; i < int(p.nkey); i += 1 {
-		err = binary.Read(buffer, binary.BigEndian, &p.children[i])
+	offsets := make([]uint16, p.nkey)
+	if err := binaryRead(buffer, offsets); err != nil {
+		return err
 	}
-	if err != nil {
-		panic(err)
+	cells := buffer.Bytes()
+	p.keys = make([]KeyEntry, p.nkey)
+	p.children = make([]uint64, p.nkey)
+	for i := 0; i < int(p.nkey); i += 1 {
+		if int(offsets[i]) > len(cells) {
+			return fmt.Errorf("%w: cell offset %d out of the page", ErrCorrupt, offsets[i])
+		}
+		cell := bytes.NewBuffer(cells[offsets[i]:])
+		if err := binaryRead(cell, &p.children[i]); err != nil {
+			return err
+		}
+		if err := p.keys[i].read_from_buffer(cell); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 func NewIPage() BTreeInternalPage {
-	var new_keys [INTERNAL_MAX_KEY]KeyEntry
-	var new_children [INTERNAL_MAX_KEY]uint64
 	return BTreeInternalPage{
 		nkey:     0,
-		keys:     new_keys,
-		children: new_children,
+		keys:     []KeyEntry{},
+		children: []uint64{},
 		header: PageHeader{
 			page_type:         1,
 			next_page_pointer: 0,
@@ -175,61 +250,54 @@ func NewIPage() BTreeInternalPage {
 
 // Find last position so that the key <= find_key
 func (node *BTreeInternalPage) FindLastLE(findKey *KeyEntry) int {
-	pos := -1
-	for i := 0; i < int(node.nkey); i++ {
-		if node.keys[i].compare(findKey) <= 0 {
-			pos = i
-		}
-	}
-	return pos
+	return findLastLE(int(node.nkey), findKey.data, func(i int) []byte {
+		return node.keys[i].data
+	})
 }
 
 // Insert a key-children pair into the Internal Node
 func (node *BTreeInternalPage) InsertKV(insertKey *KeyEntry, insertChildPPtr uint64) {
 	// Find last less or equal as position to insert
 	pos := node.FindLastLE(insertKey)
-	for i := int(node.nkey) - 1; i > pos; i-- {
-		node.keys[i+1] = node.keys[i]
-		node.children[i+1] = node.children[i]
-	}
-	node.keys[pos+1] = *insertKey
-	node.children[pos+1] = insertChildPPtr
+	node.keys = slices.Insert(node.keys, pos+1, *insertKey)
+	node.children = slices.Insert(node.children, pos+1, insertChildPPtr)
 	node.nkey += 1
 }
 
 func (node *BTreeInternalPage) DelKVAtPos(pos int) {
-	for i := pos + 1; i < int(node.nkey)-1; i++ {
-		node.keys[i] = node.keys[i+1]
-		node.children[i] = node.children[i+1]
-	}
+	node.keys = slices.Delete(node.keys, pos, pos+1)
+	node.children = slices.Delete(node.children, pos, pos+1)
 	node.nkey -= 1
-	node.keys[int(node.nkey)] = KeyEntry{}
-	node.children[int(node.nkey)] = 0
 }
 
-// Split a node into 2 equal part
+// Move all key-children pairs of the next page to the end of this one
+func (node *BTreeInternalPage) Merge(right *BTreeInternalPage) {
+	node.keys = append(node.keys, right.keys...)
+	node.children = append(node.children, right.children...)
+	node.nkey += right.nkey
+	node.header.next_page_pointer = right.header.next_page_pointer
+}
+
+// Split a node into 2 part of about the same size in bytes
 func (node *BTreeInternalPage) Split() BTreeInternalPage {
-	var newKeys [INTERNAL_MAX_KEY]KeyEntry
-	var newChildren [INTERNAL_MAX_KEY]uint64
-	// Split in the middle
-	pos := node.nkey / 2
-	// [ 1 , 2 , 0 , 0 ] -> pos = 2
-	// [ 3 , 4 , 0 , 0 ]
-	for i := pos; i < node.nkey; i++ {
-		newKeys[i-pos] = node.keys[i] // n[0] = o[2]
-		newChildren[i-pos] = node.children[i]
-		node.keys[i] = KeyEntry{}
-		node.children[i] = 0
+	sizes := make([]int, node.nkey)
+	for i := 0; i < int(node.nkey); i++ {
+		sizes[i] = 2 + 8 + node.keys[i].size()
 	}
+	pos := findSplitPos(sizes)
+	// [ 1 , 2 , 3 , 4 ] -> pos = 2
+	// [ 1 , 2 ] [ 3 , 4 ]
 	newNode := BTreeInternalPage{
 		header: PageHeader{
 			page_type:         1,
 			next_page_pointer: 0,
 		},
-		nkey:     node.nkey - pos,
-		keys:     newKeys,
-		children: newChildren,
+		nkey:     node.nkey - uint16(pos),
+		keys:     slices.Clone(node.keys[pos:]),
+		children: slices.Clone(node.children[pos:]),
 	}
-	node.nkey = pos
+	node.keys = slices.Clip(node.keys[:pos])
+	node.children = slices.Clip(node.children[:pos])
+	node.nkey = uint16(pos)
 	return newNode
 }
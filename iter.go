@@ -2,7 +2,6 @@ package main
 
 import (
 	"bytes"
-	"os"
 )
 
 type PathData struct {
@@ -10,93 +9,178 @@ type PathData struct {
 	position int
 }
 
+// Path from the first internal page down to a leaf, with the position taken
+// in each page. An empty path means the iterator went past either end, or
+// failed to read a page: see Err.
+// Pages of the tree it reads stay pinned until Close.
 type BIter struct {
-	path []PathData
-	tree *BPTreeDisk
-	file *os.File
+	path   []PathData
+	tree   *BPTreeDisk
+	epoch  uint64
+	closed bool
+	err    error
 }
 
-// Get: Do not convert size [0 0 0 0 1 2 3 54 ...]
-func (i *BIter) Deref() KeyVal {
+// Number of keys in an internal page or key value pairs in a leaf page
+func nodeLen(node any) int {
+	if convert, ok := node.(*BTreeInternalPage); ok {
+		return int(convert.nkey)
+	}
+	return int(node.(*BTreeLeafPage).nkv)
+}
+
+// Is the iterator on a key value pair, false after moving past either end.
+func (i *BIter) Valid() bool {
+	if len(i.path) == 0 {
+		return false
+	}
 	pd := i.path[len(i.path)-1]
-	lastNode := pd.node
+	convert, ok := pd.node.(*BTreeLeafPage)
+	return ok && pd.position >= 0 && pd.position < int(convert.nkv)
+}
+
+// Key value pair at the current position, without reading overflow pages.
+func (i *BIter) current() *KeyVal {
+	pd := i.path[len(i.path)-1]
+	return &pd.node.(*BTreeLeafPage).kv[pd.position]
+}
+
+// Error that made the iterator stop, nil if it only went past either end.
+func (i *BIter) Err() error {
+	return i.err
+}
+
+// Stop on an error, the iterator is not valid anymore.
+func (i *BIter) fail(err error) {
+	i.err = err
+	i.path = nil
+}
+
+// Return the iterator of a Seek, or the error it got while moving.
+func (i *BIter) checkSeek() (*BIter, error) {
+	if i.err != nil {
+		i.close()
+		return nil, i.err
+	}
+	return i, nil
+}
+
+// Get: Do not convert size [0 0 0 0 1 2 3 54 ...]
+// Return the error that stopped the iterator, or ErrInvalidIter if it is
+// past either end.
+func (i *BIter) Deref() (KeyVal, error) {
+	i.tree.mu.RLock()
+	defer i.tree.mu.RUnlock()
+	return i.deref()
+}
+
+func (i *BIter) deref() (KeyVal, error) {
+	if !i.Valid() {
+		if i.err != nil {
+			return KeyVal{}, i.err
+		}
+		return KeyVal{}, ErrInvalidIter
+	}
 	// Last node has to be a leaf
-	convert := lastNode.(*BTreeLeafPage)
-	// fmt.Println("Position = ", pd.position, ", node = ", convert, ", path len = ", len(i.path))
-	kv := convert.kv[pd.position]
-	return kv
+	kv := *i.current()
+	// Big value: read it back from overflow pages
+	pager, err := i.tree.getPager()
+	if err != nil {
+		return KeyVal{}, err
+	}
+	return i.tree.loadLeafKV(kv, new(bytes.Buffer), pager)
 }
 
-func (i *BIter) Next() {
+// Load pages from the child at the position of the last page down to a leaf,
+// taking the first position in each (last position if toLast).
+func (i *BIter) descend(toLast bool) {
+	buffer := new(bytes.Buffer) // Buffer size = 0
+	pager, err := i.tree.getPager()
+	if err != nil {
+		i.fail(err)
+		return
+	}
 	for {
-		if len(i.path) == 0 {
-			return // Nothing to do
-		}
 		pd := i.path[len(i.path)-1]
-		lastNode := pd.node
-		if convert, ok := lastNode.(*BTreeInternalPage); ok {
-			if pd.position == int(convert.nkey)-1 {
-				// Need to move up, a level, by just pop it
-				i.path = i.path[:len(i.path)-1]
-				continue
-			} else {
-				break
-			}
-		} else {
-			convert := lastNode.(*BTreeLeafPage)
-			if pd.position == int(convert.nkv)-1 {
-				// Need to move up, a level, by just pop it
-				i.path = i.path[:len(i.path)-1]
-				continue
-			} else {
-				break
-			}
+		convert, ok := pd.node.(*BTreeInternalPage)
+		if !ok {
+			return
+		}
+		buffer.Reset()
+		childNode, err := i.tree.readNode(convert.children[pd.position], buffer, pager)
+		if err != nil {
+			i.fail(err)
+			return
 		}
+		pos := 0
+		if toLast {
+			pos = nodeLen(childNode) - 1
+		}
+		i.path = append(i.path, PathData{
+			node:     childNode,
+			position: pos,
+		})
 	}
-	// Start to recursively load
-	i.path[len(i.path)-1].position += 1 // Update
-	pd := i.path[len(i.path)-1]
-	lastNode := pd.node
+}
 
-	// Load + add until leaf
-	buffer := new(bytes.Buffer) // Buffer size = 0
-	for {
-		if convert, ok := lastNode.(*BTreeInternalPage); ok {
-			buffer.Reset()
-			child := convert.children[pd.position]
-			i.tree.readBlockAtPointer(child, buffer, i.file)
-			// Load child
-			header := PageHeader{}
-			header.read_from_buffer(buffer)
-			var childNode any
-			if header.page_type == 1 {
-				// Internal page
-				ipage := BTreeInternalPage{header: header}
-				ipage.read_from_buffer(buffer, false)
-				// fmt.Printf("read ipage = %v", ipage)
-				childNode = &ipage
-			} else {
-				// Leaf page
-				lpage := BTreeLeafPage{header: header}
-				lpage.read_from_buffer(buffer, false)
-				childNode = &lpage
-			}
-			// Load deeper node with first position
-			new_pd := PathData{
-				node:     childNode,
-				position: 0,
-			}
-			i.path = append(i.path, new_pd)
-			pd = new_pd
-			lastNode = childNode
-		} else {
+func (i *BIter) Next() {
+	i.tree.mu.RLock()
+	defer i.tree.mu.RUnlock()
+	i.next()
+}
+
+func (i *BIter) next() {
+	// Need to move up, pop all pages already at their last position
+	for len(i.path) > 0 {
+		pd := i.path[len(i.path)-1]
+		if pd.position < nodeLen(pd.node)-1 {
 			break
 		}
+		i.path = i.path[:len(i.path)-1]
 	}
+	if len(i.path) == 0 {
+		return // Past the last key, not valid anymore
+	}
+	// Move right, then load the first position until leaf
+	i.path[len(i.path)-1].position += 1
+	i.descend(false)
+}
+
+func (i *BIter) Prev() {
+	i.tree.mu.RLock()
+	defer i.tree.mu.RUnlock()
+	i.prev()
 }
 
-func (i *BIter) Prev() {}
+func (i *BIter) prev() {
+	// Need to move up, pop all pages already at their first position
+	for len(i.path) > 0 {
+		pd := i.path[len(i.path)-1]
+		if pd.position > 0 {
+			break
+		}
+		i.path = i.path[:len(i.path)-1]
+	}
+	if len(i.path) == 0 {
+		return // Before the first key, not valid anymore
+	}
+	// Move left, then load the last position until leaf
+	i.path[len(i.path)-1].position -= 1
+	i.descend(true)
+}
 
+// Let the pages of the tree go, the iterator cannot be used after this.
 func (i *BIter) Close() {
-	i.file.Close()
+	i.tree.mu.RLock()
+	defer i.tree.mu.RUnlock()
+	i.close()
+}
+
+func (i *BIter) close() {
+	if i.closed {
+		return
+	}
+	i.closed = true
+	i.path = nil
+	i.tree.reclaim.unpin(i.epoch)
 }
@@ -1,79 +1,223 @@
 package main
 
+import (
+	"bytes"
+	"errors"
+	"io"
+	"iter"
+)
+
 type KV struct {
 	fileName string
+	key      []byte // Encryption key, nil: not encrypted
 	tree     BPTreeDisk
 	history  []CommittedTX
 }
 
-func (kv *KV) Open() {
+func (kv *KV) Open() error {
 	// Load or create new
-	kv.tree = NewBPTreeDisk(kv.fileName)
+	tree, err := OpenBPTreeDiskWithKey(kv.fileName, kv.key)
+	if err != nil {
+		return err
+	}
+	kv.tree = tree
+	return nil
 }
 
-func (kv *KV) LoadMetaPage() MetaPage {
-	return kv.tree.LoadMetaPage()
+func (kv *KV) Close() error {
+	return kv.tree.Close()
 }
 
-func (kv *KV) WriteMetaPage(metaPage MetaPage) {
-	kv.tree.WriteMetaPage(metaPage)
+// Encrypt the database with newKey from now on, nil to decrypt it, see
+// BPTreeDisk.Rekey. Meta pages loaded before cannot be used after this.
+func (kv *KV) Rekey(newKey []byte) error {
+	if err := kv.tree.Rekey(newKey); err != nil {
+		return err
+	}
+	kv.key = newKey
+	return nil
 }
 
-func (kv *KV) Get(metaPage MetaPage, key []byte) ([]byte, bool) {
-	res := kv.tree.Find(metaPage, key)
-	if res == nil {
-		var valueBytes []byte = make([]byte, 0)
-		return valueBytes, false
+// Stream a backup of the committed tree to w, see BPTreeDisk.Backup.
+func (kv *KV) Backup(w io.Writer) error {
+	return kv.tree.Backup(w)
+}
+
+// Stream a backup of the snapshot of tx to w, see BPTreeDisk.BackupSnapshot.
+// tx keeps the snapshot pinned until it ends.
+func (kv *KV) BackupSnapshot(tx *KVTX, w io.Writer) error {
+	return kv.tree.BackupSnapshot(tx.snapshot, w)
+}
+
+// Write a backup of the committed tree to dstPath, see BPTreeDisk.BackupFile.
+func (kv *KV) BackupFile(dstPath string) error {
+	return kv.tree.BackupFile(dstPath)
+}
+
+// Replace the database with the backup read from r, encrypted with the same
+// key, see RestoreBackup. The database is open again after this, on the old
+// file if the backup is not valid. Meta pages loaded before cannot be used.
+func (kv *KV) Restore(r io.Reader) error {
+	if err := kv.Close(); err != nil {
+		return err
 	}
-	var valueBytes []byte = make([]byte, res.vallen)
-	for i := 0; i < int(res.vallen); i++ {
-		valueBytes[i] = res.val[i+(MAX_VAL_SIZE-int(res.vallen))]
+	err := RestoreBackup(r, kv.fileName, kv.key)
+	return errors.Join(err, kv.Open())
+}
+
+// Statistics of the tree of metaPage, see BPTreeDisk.Stats.
+func (kv *KV) Stats(metaPage MetaPage) (TreeStats, error) {
+	return kv.tree.Stats(metaPage)
+}
+
+func (kv *KV) LoadMetaPage() (MetaPage, error) {
+	return kv.tree.LoadMetaPage()
+}
+
+func (kv *KV) WriteMetaPage(metaPage MetaPage) error {
+	return kv.tree.WriteMetaPage(metaPage)
+}
+
+// Return the value of key, an error wrapping ErrNotFound if there is none.
+func (kv *KV) Get(metaPage MetaPage, key []byte) ([]byte, error) {
+	res, err := kv.tree.Find(metaPage, key)
+	if err != nil {
+		return nil, err
 	}
-	return valueBytes, true
+	return res.val, nil
 }
 
-func (kv *KV) GetRange(metaPage MetaPage, keyStart []byte, keyEnd []byte) ([][]byte, bool) {
+func (kv *KV) GetRange(metaPage MetaPage, keyStart []byte, keyEnd []byte) ([][]byte, error) {
 	res := make([][]byte, 0)
-	iter := kv.tree.SeekGE(metaPage, keyStart)
-	if iter == nil {
-		return res, false
+	iter, err := kv.tree.SeekGE(metaPage, keyStart)
+	if err != nil {
+		return nil, err
 	}
-	for {
-		kv := iter.Deref()
-		// Compare 2 keys
-		var bigger = false
-		for i := range len(kv.key) {
-			if kv.key[i] > keyEnd[i] {
-				bigger = true
-				break
-			}
+	defer iter.Close()
+	for ; iter.Valid(); iter.Next() {
+		kv, err := iter.Deref()
+		if err != nil {
+			return nil, err
 		}
-		if bigger {
+		// Compare 2 keys
+		if compareKey(kv.key, keyEnd) > 0 {
 			break
 		}
-		var valueBytes []byte = make([]byte, len(res))
-		for i := 0; i < int(kv.vallen); i++ {
-			valueBytes[i] = kv.val[i+(MAX_VAL_SIZE-int(kv.vallen))]
+		res = append(res, kv.val)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ======================= Range-over-func iterators =====================
+// Each producer also returns a function giving the error that stopped the
+// last loop over the sequence, nil if it ended normally:
+//
+//	seq, seqErr := kv.All(metaPage)
+//	for key, val := range seq { ... }
+//	if err := seqErr(); err != nil { ... }
+
+// Yield key value pairs from the BIter made by seek, moving with step, while
+// keep is true. The BIter is closed when the loop ends, also on break. An
+// error stops the loop and is kept in *errp.
+func seqFromIter(seek func() (*BIter, error), step func(*BIter), keep func(key []byte) bool, errp *error) iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		it, err := seek()
+		*errp = err
+		if err != nil {
+			return
+		}
+		defer it.Close()
+		for ; it.Valid(); step(it) {
+			pair, err := it.Deref()
+			if err != nil {
+				*errp = err
+				return
+			}
+			if !keep(pair.key) || !yield(pair.key, pair.val) {
+				return
+			}
 		}
-		res = append(res, valueBytes)
+		*errp = it.Err()
 	}
-	return res, true
 }
 
-func (kv *KV) Set(metaPage MetaPage, key []byte, val []byte) MetaPage {
+func keepAll(key []byte) bool {
+	return true
+}
+
+// All key value pairs of a tree in ascending order of key.
+func (tree *BPTreeDisk) All(metaPage MetaPage) (iter.Seq2[[]byte, []byte], func() error) {
+	var err error
+	seek := func() (*BIter, error) {
+		return tree.SeekFirst(metaPage)
+	}
+	return seqFromIter(seek, (*BIter).Next, keepAll, &err), func() error { return err }
+}
+
+// All key value pairs in ascending order of key.
+func (kv *KV) All(metaPage MetaPage) (iter.Seq2[[]byte, []byte], func() error) {
+	return kv.tree.All(metaPage)
+}
+
+// All key value pairs in descending order of key.
+func (kv *KV) Backward(metaPage MetaPage) (iter.Seq2[[]byte, []byte], func() error) {
+	var err error
+	seek := func() (*BIter, error) {
+		return kv.tree.SeekLast(metaPage)
+	}
+	return seqFromIter(seek, (*BIter).Prev, keepAll, &err), func() error { return err }
+}
+
+// Key value pairs with start <= key <= end, in ascending order, like GetRange.
+func (kv *KV) Range(metaPage MetaPage, start []byte, end []byte) (iter.Seq2[[]byte, []byte], func() error) {
+	var err error
+	seek := func() (*BIter, error) {
+		return kv.tree.SeekGE(metaPage, start)
+	}
+	inRange := func(key []byte) bool {
+		return compareKey(key, end) <= 0
+	}
+	return seqFromIter(seek, (*BIter).Next, inRange, &err), func() error { return err }
+}
+
+// Key value pairs whose key starts with prefix, in ascending order.
+func (kv *KV) Prefix(metaPage MetaPage, prefix []byte) (iter.Seq2[[]byte, []byte], func() error) {
+	var err error
+	seek := func() (*BIter, error) {
+		return kv.tree.SeekGE(metaPage, prefix)
+	}
+	hasPrefix := func(key []byte) bool {
+		return bytes.HasPrefix(key, prefix)
+	}
+	return seqFromIter(seek, (*BIter).Next, hasPrefix, &err), func() error { return err }
+}
+
+// Build a new tree from sorted key value pairs, see BPTreeDisk.BulkLoad.
+func (kv *KV) BulkLoad(sortedPairs iter.Seq2[[]byte, []byte], fillFactor float64) (MetaPage, error) {
+	return kv.tree.BulkLoad(sortedPairs, fillFactor)
+}
+
+func (kv *KV) Set(metaPage MetaPage, key []byte, val []byte) (MetaPage, error) {
 	return kv.tree.Set(metaPage, key, val)
 }
 
-func (kv *KV) Del(metaPage MetaPage, key []byte) (bool, MetaPage) {
+// Delete key, return an error wrapping ErrNotFound if there is none.
+func (kv *KV) Del(metaPage MetaPage, key []byte) (MetaPage, error) {
 	return kv.tree.Del(metaPage, key)
 }
 
-func (kv *KV) CommitToDisk() {
+func (kv *KV) CommitToDisk() error {
 	// TODO: Rollback with snapshot in the beginning of the transaction
-	for {
+	for len(kv.history) > 0 {
 		committedTx := kv.history[0]
 		// Need to commit
-		kv.WriteMetaPage(committedTx.mt)
+		if err := kv.WriteMetaPage(committedTx.mt); err != nil {
+			return err
+		}
 		kv.history = kv.history[1:]
 	}
+	return nil
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func newTestKV(t *testing.T, maxNum int) (*KV, MetaPage) {
+	dbPath := testDBPath(t)
+	kv := &KV{fileName: dbPath}
+	mustOK(t, kv.Open())
+	t.Cleanup(func() { kv.Close() })
+	meta := must(kv.LoadMetaPage())(t)
+	for i := 1; i <= maxNum; i++ {
+		meta = must(kv.Set(meta, intToSlice(int64(i)), intToSlice(int64(i))))(t)
+	}
+	return kv, meta
+}
+
+func TestKV_GetRange(t *testing.T) {
+	kv, meta := newTestKV(t, 100)
+	// Range ending after the last key stops at the end of the tree
+	vals := must(kv.GetRange(meta, intToSlice(90), intToSlice(1000)))(t)
+	if len(vals) != 11 {
+		t.Errorf("GetRange: expected 11 values, got %d", len(vals))
+	}
+	vals = must(kv.GetRange(meta, intToSlice(10), intToSlice(19)))(t)
+	if len(vals) != 10 || !bytes.Equal(vals[0], intToSlice(10)) {
+		t.Errorf("GetRange: expected 10 values from 10, got %v", vals)
+	}
+}
+
+func TestKV_Get(t *testing.T) {
+	kv, meta := newTestKV(t, 10)
+	if val, err := kv.Get(meta, intToSlice(5)); err != nil || !bytes.Equal(val, intToSlice(5)) {
+		t.Errorf("Get: expected 5, got %v, %v", val, err)
+	}
+	if _, err := kv.Get(meta, intToSlice(11)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get: expected ErrNotFound, got %v", err)
+	}
+	if _, err := kv.Del(meta, intToSlice(11)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Del: expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestKV_Seq(t *testing.T) {
+	maxNum := 2000
+	kv, meta := newTestKV(t, maxNum)
+
+	// All and Backward see every key, in opposite orders
+	forward := [][]byte{}
+	all, allErr := kv.All(meta)
+	for key, val := range all {
+		if !bytes.Equal(key, val) {
+			t.Fatalf("All: val not expected for key %v", key)
+		}
+		forward = append(forward, key)
+	}
+	mustOK(t, allErr())
+	backward := [][]byte{}
+	latest, latestErr := kv.Backward(meta)
+	for key := range latest {
+		backward = append(backward, key)
+	}
+	mustOK(t, latestErr())
+	if len(forward) != maxNum || len(backward) != maxNum {
+		t.Fatalf("Expected %d keys, got %d forward, %d backward", maxNum, len(forward), len(backward))
+	}
+	slices.Reverse(backward)
+	for i := range forward {
+		if !bytes.Equal(forward[i], intToSlice(int64(i+1))) || !bytes.Equal(forward[i], backward[i]) {
+			t.Fatalf("Order not expected at %d", i)
+		}
+	}
+
+	// Range is inclusive on both ends
+	count := 0
+	inRange, _ := kv.Range(meta, intToSlice(500), intToSlice(599))
+	for range inRange {
+		count += 1
+	}
+	if count != 100 {
+		t.Errorf("Range: expected 100 keys, got %d", count)
+	}
+
+	// Prefix: keys are big endian, so 256..511 share the first 7 bytes
+	count = 0
+	withPrefix, _ := kv.Prefix(meta, intToSlice(256)[:7])
+	for key := range withPrefix {
+		if !bytes.HasPrefix(key, intToSlice(256)[:7]) {
+			t.Fatalf("Prefix: key %v without prefix", key)
+		}
+		count += 1
+	}
+	if count != 256 {
+		t.Errorf("Prefix: expected 256 keys, got %d", count)
+	}
+
+	// Early break: latest 5, and the sequence can be ranged again
+	for range 2 {
+		got := []int{}
+		for key := range latest {
+			got = append(got, int(key[7])+int(key[6])*256)
+			if len(got) == 5 {
+				break
+			}
+		}
+		if !slices.Equal(got, []int{2000, 1999, 1998, 1997, 1996}) {
+			t.Errorf("Backward with break: got %v", got)
+		}
+	}
+}
+
+func TestKV_CommitToDisk(t *testing.T) {
+	kv, meta := newTestKV(t, 10)
+	// Nothing to commit
+	mustOK(t, kv.CommitToDisk())
+	kv.history = append(kv.history, CommittedTX{mt: meta})
+	meta = must(kv.Set(meta, intToSlice(11), intToSlice(11)))(t)
+	kv.history = append(kv.history, CommittedTX{mt: meta})
+	mustOK(t, kv.CommitToDisk())
+	if len(kv.history) != 0 {
+		t.Errorf("Expected an empty history, got %d transactions", len(kv.history))
+	}
+	mustOK(t, kv.Close())
+	mustOK(t, kv.Open())
+	if val, err := kv.Get(must(kv.LoadMetaPage())(t), intToSlice(11)); err != nil || !bytes.Equal(val, intToSlice(11)) {
+		t.Errorf("Get after CommitToDisk: expected 11, got %v, %v", val, err)
+	}
+}
@@ -3,188 +3,200 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"slices"
+	"sort"
 )
 
 // =========================================================================
 
-// 3: [1, 7, 255]
-// [0 0 0 0 0 0 1 7 255]
+// Each cell takes:
+// - keylen, vallen (2 + 2)
+// - key, val (keylen + vallen)
+// [0 3 0 1 | 1 7 255 | 9]
+// Or, if the value is in overflow pages (vallen = VAL_OVERFLOW):
+// - keylen, vallen (2 + 2)
+// - key, overflow_len, overflow_ptr (keylen + 8 + 8)
 type KeyVal struct {
-	keylen uint16
-	vallen uint16
-	key    [MAX_KEY_SIZE]uint8 // Big endian storage
-	val    [MAX_VAL_SIZE]uint8 // Big endian storage
+	key []uint8
+	val []uint8
+	// Value too big to be inline, stored in overflow pages, else 0
+	overflow_len uint64
+	overflow_ptr uint64
 }
 
+// Marker in vallen for a value stored in overflow pages
+const VAL_OVERFLOW = 0xFFFF
+
 func NewKeyValFromInt(inputKey int64, inputVal int64) KeyVal {
 	buf := new(bytes.Buffer)
 	binary.Write(buf, binary.BigEndian, inputKey)
-	data_slice := buf.Bytes()
-	key_len := len(data_slice)
-	var key [MAX_KEY_SIZE]uint8
-	for i := MAX_KEY_SIZE - key_len; i < MAX_KEY_SIZE; i += 1 {
-		key[i] = data_slice[i-(MAX_KEY_SIZE-key_len)] // data[10] = slice[0] | data[11] = slice[1] ...
-	}
+	key := buf.Bytes()
 	buf = new(bytes.Buffer)
 	binary.Write(buf, binary.BigEndian, inputVal)
-	data_slice = buf.Bytes()
-	val_len := len(data_slice)
-	var val [MAX_VAL_SIZE]uint8
-	for i := MAX_VAL_SIZE - val_len; i < MAX_VAL_SIZE; i += 1 {
-		val[i] = data_slice[i-(MAX_VAL_SIZE-val_len)] // data[10] = slice[0] | data[11] = slice[1] ...
-	}
+	val := buf.Bytes()
 	return KeyVal{
-		keylen: uint16(key_len),
-		vallen: uint16(val_len),
-		key:    key,
-		val:    val,
+		key: key,
+		val: val,
 	}
 }
 
 func NewKeyValFromBytes(inputKey []byte, inputVal []byte) KeyVal {
-	key_len := len(inputKey)
-	var key [MAX_KEY_SIZE]uint8
-	for i := MAX_KEY_SIZE - key_len; i < MAX_KEY_SIZE; i += 1 {
-		key[i] = inputKey[i-(MAX_KEY_SIZE-key_len)] // data[10] = slice[0] | data[11] = slice[1] ...
-	}
-	val_len := len(inputVal)
-	var val [MAX_VAL_SIZE]uint8
-	for i := MAX_VAL_SIZE - val_len; i < MAX_VAL_SIZE; i += 1 {
-		val[i] = inputVal[i-(MAX_VAL_SIZE-val_len)] // data[10] = slice[0] | data[11] = slice[1] ...
-	}
 	return KeyVal{
-		keylen: uint16(key_len),
-		vallen: uint16(val_len),
-		key:    key,
-		val:    val,
+		key: slices.Clone(inputKey),
+		val: slices.Clone(inputVal),
 	}
 }
 
-func (k *KeyVal) write_to_buffer(buffer *bytes.Buffer) {
-	var err error
-	err = binary.Write(buffer, binary.BigEndian, k.keylen)
-	err = binary.Write(buffer, binary.BigEndian, k.vallen)
-	for i := MAX_KEY_SIZE - k.keylen; i < MAX_KEY_SIZE; i += 1 {
-		err = binary.Write(buffer, binary.BigEndian, k.key[i])
+// Bytes taken by this cell in a page
+func (k *KeyVal) size() int {
+	if k.overflow_ptr != 0 {
+		return 2 + 2 + len(k.key) + 8 + 8
 	}
-	for i := MAX_VAL_SIZE - k.vallen; i < MAX_VAL_SIZE; i += 1 {
-		err = binary.Write(buffer, binary.BigEndian, k.val[i])
+	return 2 + 2 + len(k.key) + len(k.val)
+}
+
+func (k *KeyVal) write_to_buffer(buffer *bytes.Buffer) error {
+	if k.overflow_ptr != 0 {
+		if err := binaryWrite(buffer, uint16(len(k.key)), uint16(VAL_OVERFLOW)); err != nil {
+			return err
+		}
+		buffer.Write(k.key)
+		return binaryWrite(buffer, k.overflow_len, k.overflow_ptr)
 	}
-	if err != nil {
-		panic(err)
+	if err := binaryWrite(buffer, uint16(len(k.key)), uint16(len(k.val))); err != nil {
+		return err
 	}
+	buffer.Write(k.key)
+	buffer.Write(k.val)
+	return nil
 }
 
-func (k *KeyVal) read_from_buffer(buffer *bytes.Buffer) {
-	var err error
-	err = binary.Read(buffer, binary.BigEndian, &k.keylen)
-	err = binary.Read(buffer, binary.BigEndian, &k.vallen)
-	for i := MAX_KEY_SIZE - k.keylen; i < MAX_KEY_SIZE; i += 1 {
-		err = binary.Read(buffer, binary.BigEndian, &k.key[i])
+func (k *KeyVal) read_from_buffer(buffer *bytes.Buffer) error {
+	var keylen, vallen uint16
+	if err := binaryRead(buffer, &keylen, &vallen); err != nil {
+		return err
 	}
-	for i := MAX_VAL_SIZE - k.vallen; i < MAX_VAL_SIZE; i += 1 {
-		err = binary.Read(buffer, binary.BigEndian, &k.val[i])
+	k.key = make([]uint8, keylen)
+	if err := binaryRead(buffer, k.key); err != nil {
+		return err
 	}
-	if err != nil {
-		panic(err)
+	if vallen == VAL_OVERFLOW {
+		k.val = nil
+		return binaryRead(buffer, &k.overflow_len, &k.overflow_ptr)
 	}
+	k.val = make([]uint8, vallen)
+	return binaryRead(buffer, k.val)
 }
 
 func (k *KeyVal) compare(rhs *KeyVal) int {
-	for i := 0; i < MAX_KEY_SIZE; i += 1 {
-		if k.key[i] < rhs.key[i] {
-			return -1
-		}
-		if k.key[i] > rhs.key[i] {
-			return 1
-		}
-	}
-	return 0
+	return compareKey(k.key, rhs.key)
 }
 
 // =========================================================================
 
+// Each leaf page is a slotted page:
+// - Header
+// - nkv (2)
+// - list of offsets: n * 2, position of each cell from the start of the cells
+// - list of cells: packed KeyVal
+// [header | nkv | off_0 off_1 ... | kv_0 kv_1 ... | 0 0 0 0 ... ]
 type BTreeLeafPage struct {
 	header PageHeader
 	nkv    uint16
-	kv     [LEAF_MAX_KV]KeyVal
+	kv     []KeyVal
 }
 
 func NewLPage() BTreeLeafPage {
-	var new_kv [LEAF_MAX_KV]KeyVal
 	return BTreeLeafPage{
 		header: PageHeader{
 			page_type:         2,
 			next_page_pointer: 0,
 		},
 		nkv: 0,
-		kv:  new_kv,
+		kv:  []KeyVal{},
 	}
 }
 
-func (p *BTreeLeafPage) write_to_buffer(buffer *bytes.Buffer) {
-	var err error
-	p.header.write_to_buffer(buffer)
-	err = binary.Write(buffer, binary.BigEndian, p.nkv)
+// Copy that can be changed without touching this page
+func (p *BTreeLeafPage) clone() BTreeLeafPage {
+	return BTreeLeafPage{
+		header: p.header,
+		nkv:    p.nkv,
+		kv:     slices.Clone(p.kv),
+	}
+}
+
+// Bytes taken by this page once written, has to be <= PAGE_SIZE unless the
+// page is compressed, see fitsCompressed
+func (p *BTreeLeafPage) size() int {
+	sz := PAGE_HEADER_SIZE + 2
 	for i := 0; i < int(p.nkv); i += 1 {
-		p.kv[i].write_to_buffer(buffer)
+		sz += 2 + p.kv[i].size()
+	}
+	return sz
+}
+
+func (p *BTreeLeafPage) write_to_buffer(buffer *bytes.Buffer) error {
+	if err := p.header.write_to_buffer(buffer); err != nil {
+		return err
 	}
-	if err != nil {
-		panic(err)
+	if err := binaryWrite(buffer, p.nkv); err != nil {
+		return err
 	}
+	cells := new(bytes.Buffer)
+	for i := 0; i < int(p.nkv); i += 1 {
+		if err := binaryWrite(buffer, uint16(cells.Len())); err != nil {
+			return err
+		}
+		if err := p.kv[i].write_to_buffer(cells); err != nil {
+			return err
+		}
+	}
+	buffer.Write(cells.Bytes())
+	return nil
 }
 
-func (p *BTreeLeafPage) read_from_buffer(buffer *bytes.Buffer, isReadHeader bool) {
-	var err error
+func (p *BTreeLeafPage) read_from_buffer(buffer *bytes.Buffer, isReadHeader bool) error {
 	if isReadHeader {
-		p.header.read_from_buffer(buffer)
+		if err := p.header.read_from_buffer(buffer); err != nil {
+			return err
+		}
 	}
-	err = binary.Read(buffer, binary.BigEndian, &p.nkv)
-	for i := 0; i < int(p.nkv); i += 1 {
-		p.kv[i].read_from_buffer(buffer)
+	if err := binaryRead(buffer, &p.nkv); err != nil {
+		return err
 	}
-	if err != nil {
-		panic(err)
+	offsets := make([]uint16, p.nkv)
+	if err := binaryRead(buffer, offsets); err != nil {
+		return err
 	}
+	cells := buffer.Bytes()
+	p.kv = make([]KeyVal, p.nkv)
+	for i := 0; i < int(p.nkv); i += 1 {
+		if int(offsets[i]) > len(cells) {
+			return fmt.Errorf("%w: cell offset %d out of the page", ErrCorrupt, offsets[i])
+		}
+		if err := p.kv[i].read_from_buffer(bytes.NewBuffer(cells[offsets[i]:])); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Find last position so that the key <= find_key
 func (node *BTreeLeafPage) FindLastLE(findKV *KeyVal) int {
-	pos := -1
-	for i := 0; i < int(node.nkv); i++ {
-		if node.kv[i].compare(findKV) <= 0 {
-			pos = i
-		}
-	}
-	return pos
+	return findLastLE(int(node.nkv), findKV.key, func(i int) []byte {
+		return node.kv[i].key
+	})
 }
 
 // Insert a key-children pair into the Leaf Node
 func (node *BTreeLeafPage) InsertKV(insertKV *KeyVal) {
 	// Find last less or equal as position to insert
-	pos := node.FindLastLE(insertKV)
-	if pos == -1 {
-		// Insert in the 0 position
-		pos = 0
-		if node.nkv > 0 {
-			for i := node.nkv - 1; int(i) >= 0; i-- {
-				node.kv[i+1] = node.kv[i]
-				if i == 0 {
-					break
-				}
-			}
-		}
-		node.kv[pos] = *insertKV
-		node.nkv += 1
-		return
-	}
-	// [ 1,4,7,| | ] -> insert 3
-	// [ 1,| |,4,7 ] -> insert 3
-	for i := node.nkv - 1; int(i) > pos; i-- {
-		node.kv[i+1] = node.kv[i]
-	}
-	node.kv[pos+1] = *insertKV
+	// [ 1,4,7 ] -> insert 3
 	// [ 1,3,4,7 ]
+	pos := node.FindLastLE(insertKV)
+	node.kv = slices.Insert(node.kv, pos+1, *insertKV)
 	node.nkv += 1
 }
 
@@ -193,32 +205,73 @@ func (node *BTreeLeafPage) InsertKV(insertKV *KeyVal) {
 func (node *BTreeLeafPage) DelKV(delKV *KeyVal) {
 	// Find last less or equal as position to delete
 	pos := node.FindLastLE(delKV)
-	for i := pos; i < int(node.nkv)-1; i++ {
-		node.kv[i] = node.kv[i+1]
-	}
+	node.kv = slices.Delete(node.kv, pos, pos+1)
 	node.nkv -= 1
-	node.kv[int(node.nkv)] = KeyVal{}
 }
 
-// Split a node into 2 equal part
+// Split a node into 2 part of about the same size in bytes
 func (node *BTreeLeafPage) Split() BTreeLeafPage {
-	var newKV [LEAF_MAX_KV]KeyVal
-	// Split in the middle
-	pos := node.nkv / 2
-	// [ 1 , 2 , 0 , 0 ] -> pos = 2
-	// [ 3 , 4 , 0 , 0 ]
-	for i := pos; i < node.nkv; i++ {
-		newKV[i-pos] = node.kv[i] // n[0] = o[2]
-		node.kv[i] = KeyVal{}
+	sizes := make([]int, node.nkv)
+	for i := 0; i < int(node.nkv); i++ {
+		sizes[i] = 2 + node.kv[i].size()
 	}
+	pos := findSplitPos(sizes)
+	// [ 1 , 2 , 3 , 4 ] -> pos = 2
+	// [ 1 , 2 ] [ 3 , 4 ]
 	newNode := BTreeLeafPage{
 		header: PageHeader{
 			page_type:         2,
 			next_page_pointer: 0,
 		},
-		nkv: node.nkv - pos,
-		kv:  newKV,
+		nkv: node.nkv - uint16(pos),
+		kv:  slices.Clone(node.kv[pos:]),
 	}
-	node.nkv = pos
+	node.kv = slices.Clip(node.kv[:pos])
+	node.nkv = uint16(pos)
 	return newNode
 }
+
+// Move all key value pairs of the next page to the end of this one
+func (node *BTreeLeafPage) Merge(right *BTreeLeafPage) {
+	node.kv = append(node.kv, right.kv...)
+	node.nkv += right.nkv
+	node.header.next_page_pointer = right.header.next_page_pointer
+}
+
+// Find a position to split cells into 2 parts as balanced as possible.
+// The most balanced split also has the smallest bigger part, so both parts fit
+// in a page if any split does. sizes: bytes taken by each cell.
+func findSplitPos(sizes []int) int {
+	total := 0
+	for _, sz := range sizes {
+		total += sz
+	}
+	pos := len(sizes) / 2
+	bestDiff := -1
+	left := 0
+	for i := 1; i < len(sizes); i++ {
+		left += sizes[i-1]
+		right := total - left
+		diff := max(left-right, right-left)
+		if bestDiff == -1 || diff < bestDiff {
+			pos = i
+			bestDiff = diff
+		}
+	}
+	return pos
+}
+
+// Order of keys in every page, internal and leaf.
+func compareKey(lhs []byte, rhs []byte) int {
+	return bytes.Compare(lhs, rhs)
+}
+
+// Binary search for the last position i < n so that keyAt(i) <= key, -1 if
+// there is none. Keys of a page are sorted, keyAt returns the key at i.
+func findLastLE(n int, key []byte, keyAt func(i int) []byte) int {
+	// First position with a bigger key, the one before is the last <=
+	pos := sort.Search(n, func(i int) bool {
+		return compareKey(keyAt(i), key) > 0
+	})
+	return pos - 1
+}
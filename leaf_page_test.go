@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLeafPage(t *testing.T) {
+	node := NewLPage()
+	kv_10 := NewKeyValFromBytes([]byte("10"), []byte("ten"))
+	kv_3 := NewKeyValFromBytes([]byte("3"), []byte("three"))
+	kv_5 := NewKeyValFromBytes([]byte("5"), []byte{})
+	kv_12 := NewKeyValFromBytes([]byte("12"), bytes.Repeat([]byte("x"), 300))
+	node.InsertKV(&kv_3)
+	node.InsertKV(&kv_10)
+	node.InsertKV(&kv_5)
+	node.InsertKV(&kv_12)
+	// ["10", "12", "3", "5"]
+	if node.nkv != 4 {
+		t.Errorf("got nkv = %v, expect %v", node.nkv, 4)
+	}
+	expected := []KeyVal{kv_10, kv_12, kv_3, kv_5}
+	for i := range expected {
+		if node.kv[i].compare(&expected[i]) != 0 {
+			t.Errorf("got kv[%v] = %v, expect %v", i, node.kv[i].key, expected[i].key)
+		}
+	}
+	expectedSize := PAGE_HEADER_SIZE + 2
+	for i := range expected {
+		expectedSize += 2 + 4 + len(expected[i].key) + len(expected[i].val)
+	}
+	if node.size() != expectedSize {
+		t.Errorf("got size = %v, expect %v", node.size(), expectedSize)
+	}
+
+	// Slotted page round trip
+	buf := new(bytes.Buffer)
+	node.write_to_buffer(buf)
+	if buf.Len() != expectedSize {
+		t.Errorf("got written size = %v, expect %v", buf.Len(), expectedSize)
+	}
+	clonedNode := NewLPage()
+	clonedNode.read_from_buffer(buf, true)
+	if clonedNode.nkv != 4 {
+		t.Errorf("got nkv = %v, expect %v", clonedNode.nkv, 4)
+	}
+	for i := range expected {
+		if !isSameKV(clonedNode.kv[i], expected[i]) {
+			t.Errorf("got kv[%v] = %v, expect %v", i, clonedNode.kv[i], expected[i])
+		}
+	}
+
+	// Split by bytes: the big value stays alone on one side
+	newNode := node.Split()
+	if node.nkv+newNode.nkv != 4 {
+		t.Errorf("got nkv = %v + %v, expect %v", node.nkv, newNode.nkv, 4)
+	}
+	if node.nkv != 2 || newNode.kv[0].compare(&kv_3) != 0 {
+		t.Errorf("got split at %v, expect %v", node.nkv, 2)
+	}
+
+	node.DelKV(&kv_10)
+	if node.nkv != 1 || node.kv[0].compare(&kv_12) != 0 {
+		t.Errorf("got kv[0] = %v after delete, expect %v", node.kv[0].key, kv_12.key)
+	}
+}
+
+func TestLeafPage_FindLastLE(t *testing.T) {
+	// Even keys only, so odd keys are between 2 slots
+	node := NewLPage()
+	for i := int64(2); i <= 200; i += 2 {
+		kv := NewKeyValFromInt(i, i)
+		node.InsertKV(&kv)
+	}
+	keyAt := func(i int) []byte { return node.kv[i].key }
+	for i := int64(0); i <= 202; i++ {
+		kv := NewKeyValFromInt(i, 0)
+		expected := linearFindLastLE(int(node.nkv), kv.key, keyAt)
+		if pos := node.FindLastLE(&kv); pos != expected {
+			t.Errorf("FindLastLE(%d) = %d, expect %d", i, pos, expected)
+		}
+	}
+}
@@ -1,18 +1,24 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"os"
+)
 
 type Node any
 
+// Fan-out of the in-memory tree
+const NODE_MAX_KEY = 16
+
 type BTreeInternalNode struct {
 	nkey     int
-	keys     [INTERNAL_MAX_KEY]int
-	children [INTERNAL_MAX_KEY]*Node
+	keys     [NODE_MAX_KEY]int
+	children [NODE_MAX_KEY]*Node
 }
 
 func NewINode() BTreeInternalNode {
-	var new_keys [INTERNAL_MAX_KEY]int
-	var new_children [INTERNAL_MAX_KEY]*Node
+	var new_keys [NODE_MAX_KEY]int
+	var new_children [NODE_MAX_KEY]*Node
 	return BTreeInternalNode{
 		nkey:     0,
 		keys:     new_keys,
@@ -49,8 +55,8 @@ func (node *BTreeInternalNode) InsertKV(insertKey int, insertChild Node) {
 
 // Split a node into 2 equal part
 func (node *BTreeInternalNode) Split() BTreeInternalNode {
-	var newKeys [INTERNAL_MAX_KEY]int
-	var newChildren [INTERNAL_MAX_KEY]*Node
+	var newKeys [NODE_MAX_KEY]int
+	var newChildren [NODE_MAX_KEY]*Node
 	// Split in the middle
 	pos := node.nkey / 2
 	// [ 1 , 2 , 0 , 0 ] -> pos = 2
@@ -73,13 +79,13 @@ func (node *BTreeInternalNode) Split() BTreeInternalNode {
 // Define leaf node
 type BTreeLeafNode struct {
 	nkey   int
-	keys   [INTERNAL_MAX_KEY]int
-	values [INTERNAL_MAX_KEY]int
+	keys   [NODE_MAX_KEY]int
+	values [NODE_MAX_KEY]int
 }
 
 func NewLNode() BTreeLeafNode {
-	var new_keys [INTERNAL_MAX_KEY]int
-	var new_vals [INTERNAL_MAX_KEY]int
+	var new_keys [NODE_MAX_KEY]int
+	var new_vals [NODE_MAX_KEY]int
 	return BTreeLeafNode{
 		nkey:   0,
 		keys:   new_keys,
@@ -116,8 +122,8 @@ func (node *BTreeLeafNode) InsertKV(insertKey int, insertValue int) {
 
 // Split a node into 2 equal part
 func (node *BTreeLeafNode) Split() BTreeLeafNode {
-	var newKeys [INTERNAL_MAX_KEY]int
-	var newValues [INTERNAL_MAX_KEY]int
+	var newKeys [NODE_MAX_KEY]int
+	var newValues [NODE_MAX_KEY]int
 	// Split in the middle
 	pos := node.nkey / 2
 	// [ 1 , 2 , 0 , 0 ] -> pos = 2
@@ -188,7 +194,7 @@ func (tree *BPTree) insertRecursive(node Node, insertKey int, insertValue int) N
 				}
 			}
 			// After insert, check if need split.
-			if convert.nkey == INTERNAL_MAX_KEY {
+			if convert.nkey == NODE_MAX_KEY {
 				newInternal := convert.Split()
 				return &newInternal
 			}
@@ -198,7 +204,7 @@ func (tree *BPTree) insertRecursive(node Node, insertKey int, insertValue int) N
 		convert.InsertKV(insertKey, insertValue)
 
 		// After insert, check if need split.
-		if convert.nkey == INTERNAL_MAX_KEY {
+		if convert.nkey == NODE_MAX_KEY {
 			newLeaf := convert.Split()
 			return &newLeaf
 		}
@@ -222,5 +228,8 @@ func (tree *BPTree) Insert(insertKey int, insertValue int) {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:], os.Stdout, os.Stderr))
+	}
 	fmt.Println("Hello word")
 }
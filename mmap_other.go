@@ -0,0 +1,24 @@
+//go:build !unix
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+)
+
+// No mmap on this platform, pages are always read with file.ReadAt.
+type MmapReader struct{}
+
+func NewMmapReader(file *os.File) (*MmapReader, error) {
+	return nil, errors.New("mmap is not supported on this platform")
+}
+
+func (m *MmapReader) readBlock(ptr uint64, buffer *bytes.Buffer) error {
+	return errors.New("mmap is not supported on this platform")
+}
+
+func (m *MmapReader) Close() error {
+	return nil
+}
@@ -0,0 +1,99 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// Read only mapping of the whole database file. Pages are written with
+// file.WriteAt, so the mapping is MAP_SHARED to see them, and it is remapped
+// when a read falls after its end because the file grew.
+// Readers of the tree share the reader: blocks are copied under the read lock
+// of mu, the old mapping is only unmapped under its write lock.
+type MmapReader struct {
+	mu   sync.RWMutex
+	file *os.File
+	data []byte
+}
+
+func NewMmapReader(file *os.File) (*MmapReader, error) {
+	m := &MmapReader{file: file}
+	if err := m.remap(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Map the file again with its current size.
+func (m *MmapReader) remap() error {
+	info, err := m.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := int(info.Size())
+	if size == 0 {
+		return m.unmap()
+	}
+	data, err := syscall.Mmap(int(m.file.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	if err := m.unmap(); err != nil {
+		syscall.Munmap(data)
+		return err
+	}
+	m.data = data
+	return nil
+}
+
+func (m *MmapReader) unmap() error {
+	if m.data == nil {
+		return nil
+	}
+	err := syscall.Munmap(m.data)
+	m.data = nil
+	return err
+}
+
+// Remap if the mapping still ends before end, another reader may have done
+// it already.
+func (m *MmapReader) grow(end uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if end <= uint64(len(m.data)) {
+		return nil
+	}
+	return m.remap()
+}
+
+// Copy a block to the buffer, the part after the end of the file is 0.
+// Buffer size = BLOCK_SIZE
+func (m *MmapReader) readBlock(ptr uint64, buffer *bytes.Buffer) error {
+	m.mu.RLock()
+	if ptr+BLOCK_SIZE > uint64(len(m.data)) {
+		m.mu.RUnlock()
+		if err := m.grow(ptr + BLOCK_SIZE); err != nil {
+			return err
+		}
+		m.mu.RLock()
+	}
+	defer m.mu.RUnlock()
+	if ptr >= uint64(len(m.data)) {
+		return io.EOF
+	}
+	end := min(ptr+BLOCK_SIZE, uint64(len(m.data)))
+	buffer.Write(m.data[ptr:end])
+	buffer.Write(make([]byte, BLOCK_SIZE-(end-ptr)))
+	return nil
+}
+
+func (m *MmapReader) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.unmap()
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+)
+
+// Each overflow page takes:
+// - Header (PAGE_HEADER_SIZE)
+// - nbyte (2)
+// - data: nbyte
+const OVERFLOW_MAX_DATA = PAGE_SIZE - (PAGE_HEADER_SIZE + 2)
+
+// Values bigger than MAX_INLINE_VAL_SIZE are cut into a chain of overflow
+// pages, linked through header.next_page_pointer.
+// [header | nbyte | data ... | 0 0 0 0 ... ]
+type OverflowPage struct {
+	header PageHeader
+	nbyte  uint16
+	data   []uint8
+}
+
+func NewOPage() OverflowPage {
+	return OverflowPage{
+		header: PageHeader{
+			page_type:         4,
+			next_page_pointer: 0,
+		},
+		nbyte: 0,
+		data:  []uint8{},
+	}
+}
+
+func (p *OverflowPage) write_to_buffer(buffer *bytes.Buffer) error {
+	if err := p.header.write_to_buffer(buffer); err != nil {
+		return err
+	}
+	if err := binaryWrite(buffer, p.nbyte); err != nil {
+		return err
+	}
+	buffer.Write(p.data)
+	return nil
+}
+
+func (p *OverflowPage) read_from_buffer(buffer *bytes.Buffer, isReadHeader bool) error {
+	if isReadHeader {
+		if err := p.header.read_from_buffer(buffer); err != nil {
+			return err
+		}
+	}
+	if err := binaryRead(buffer, &p.nbyte); err != nil {
+		return err
+	}
+	p.data = make([]uint8, p.nbyte)
+	return binaryRead(buffer, p.data)
+}
+
+// ========================== Overflow chain ==========================
+
+// Write a value to a new overflow chain, return a pointer to the first page.
+// The pages already written are freed if it fails.
+func (tree *BPTreeDisk) writeOverflow(val []byte, buffer *bytes.Buffer, pager Pager) (uint64, error) {
+	// Write from the last page back, so each page knows the next one.
+	var next_ptr uint64 = 0
+	written := []uint64{}
+	nchunk := (len(val) + OVERFLOW_MAX_DATA - 1) / OVERFLOW_MAX_DATA
+	for i := nchunk - 1; i >= 0; i-- {
+		oPage := NewOPage()
+		oPage.data = val[i*OVERFLOW_MAX_DATA : min((i+1)*OVERFLOW_MAX_DATA, len(val))]
+		oPage.nbyte = uint16(len(oPage.data))
+		oPage.header.next_page_pointer = next_ptr
+		buffer.Reset()
+		err := oPage.write_to_buffer(buffer)
+		var ptr uint64
+		if err == nil {
+			ptr, err = tree.writeBufferToFile(buffer, pager)
+		}
+		if err != nil {
+			for _, ptr := range written {
+				pager.Free(ptr)
+			}
+			return 0, err
+		}
+		written = append(written, ptr)
+		next_ptr = ptr
+	}
+	return next_ptr, nil
+}
+
+// Call visit on each page of the overflow chain of a key value pair, in
+// order. The walk is bounded by the pages the value needs: a longer chain
+// (e.g. a cycle), a page of another type or a chain holding another number
+// of bytes than the value is corrupt.
+func (tree *BPTreeDisk) walkOverflow(kv *KeyVal, buffer *bytes.Buffer, pager Pager, visit func(ptr uint64, oPage *OverflowPage)) error {
+	npage := (kv.overflow_len + OVERFLOW_MAX_DATA - 1) / OVERFLOW_MAX_DATA
+	var total uint64 = 0
+	ptr := kv.overflow_ptr
+	for i := uint64(0); ptr != 0; i++ {
+		if i == npage {
+			return &ErrCorruptPage{Ptr: kv.overflow_ptr, PageType: 4, Reason: fmt.Sprintf("overflow chain longer than %d pages", npage)}
+		}
+		if err := tree.readBlockAtPointer(ptr, buffer, pager); err != nil {
+			return err
+		}
+		oPage := OverflowPage{}
+		if err := oPage.header.read_from_buffer(buffer); err != nil {
+			return err
+		}
+		if oPage.header.page_type != 4 {
+			return &ErrCorruptPage{Ptr: ptr, PageType: oPage.header.page_type, Reason: "not an overflow page"}
+		}
+		if err := oPage.read_from_buffer(buffer, false); err != nil {
+			return err
+		}
+		total += uint64(oPage.nbyte)
+		visit(ptr, &oPage)
+		ptr = oPage.header.next_page_pointer
+	}
+	if total != kv.overflow_len {
+		return &ErrCorruptPage{Ptr: kv.overflow_ptr, PageType: 4, Reason: fmt.Sprintf("overflow chain holds %d bytes, expected %d", total, kv.overflow_len)}
+	}
+	return nil
+}
+
+// Read back the whole value of a key value pair stored in overflow pages.
+func (tree *BPTreeDisk) readOverflow(kv *KeyVal, buffer *bytes.Buffer, pager Pager) ([]byte, error) {
+	val := make([]byte, 0, kv.overflow_len)
+	err := tree.walkOverflow(kv, buffer, pager, func(ptr uint64, oPage *OverflowPage) {
+		val = append(val, oPage.data...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+// Retire the overflow pages of a key value pair, like the pages of a path.
+func (tree *BPTreeDisk) freeOverflow(kv *KeyVal, buffer *bytes.Buffer, pager Pager, deletedPtr *[]uint64) error {
+	return tree.walkOverflow(kv, buffer, pager, func(ptr uint64, oPage *OverflowPage) {
+		*deletedPtr = append(*deletedPtr, ptr)
+	})
+}
+
+// Make the key value pair to store in a leaf, moving a big value out to
+// overflow pages.
+func (tree *BPTreeDisk) newLeafKV(key []byte, val []byte, buffer *bytes.Buffer, pager Pager) (KeyVal, error) {
+	if len(val) <= MAX_INLINE_VAL_SIZE {
+		return NewKeyValFromBytes(key, val), nil
+	}
+	ptr, err := tree.writeOverflow(val, buffer, pager)
+	if err != nil {
+		return KeyVal{}, err
+	}
+	return KeyVal{
+		key:          slices.Clone(key),
+		val:          nil,
+		overflow_len: uint64(len(val)),
+		overflow_ptr: ptr,
+	}, nil
+}
+
+// Return the key value pair with its whole value, as the caller sees it.
+func (tree *BPTreeDisk) loadLeafKV(kv KeyVal, buffer *bytes.Buffer, pager Pager) (KeyVal, error) {
+	if kv.overflow_ptr == 0 {
+		return kv, nil
+	}
+	val, err := tree.readOverflow(&kv, buffer, pager)
+	if err != nil {
+		return KeyVal{}, err
+	}
+	kv.val = val
+	return kv, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Number of decoded pages kept by default
+const DEFAULT_CACHE_PAGES = 256
+
+// LRU cache of decoded pages (*BTreeInternalPage / *BTreeLeafPage) keyed by
+// their pointer on disk. Pages are copy-on-write, so a cached page only gets
+// stale when its block is written again. Readers of the tree share it, so it
+// has its own lock.
+type PageCache struct {
+	mu       sync.Mutex
+	capacity int
+	items    map[uint64]*list.Element
+	lru      *list.List // Front: most recently used
+	stats    CacheStats
+}
+
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Pages     int // Pages in the cache now
+}
+
+type cacheEntry struct {
+	ptr  uint64
+	node any
+}
+
+func NewPageCache(capacity int) *PageCache {
+	return &PageCache{
+		capacity: capacity,
+		items:    make(map[uint64]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// Return the cached page, counting a hit or a miss.
+func (c *PageCache) get(ptr uint64) (any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[ptr]; ok {
+		c.stats.Hits += 1
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*cacheEntry).node, true
+	}
+	c.stats.Misses += 1
+	return nil, false
+}
+
+// Add a page, evicting the least recently used one if full.
+func (c *PageCache) put(ptr uint64, node any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.capacity <= 0 {
+		return
+	}
+	if elem, ok := c.items[ptr]; ok {
+		elem.Value.(*cacheEntry).node = node
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.items[ptr] = c.lru.PushFront(&cacheEntry{ptr: ptr, node: node})
+	for c.lru.Len() > c.capacity {
+		last := c.lru.Back()
+		c.lru.Remove(last)
+		delete(c.items, last.Value.(*cacheEntry).ptr)
+		c.stats.Evictions += 1
+	}
+}
+
+// Drop a page, its block got written again.
+func (c *PageCache) invalidate(ptr uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[ptr]; ok {
+		c.lru.Remove(elem)
+		delete(c.items, ptr)
+	}
+}
+
+// Change the capacity, evicting pages if needed.
+func (c *PageCache) resize(capacity int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.capacity = capacity
+	for c.lru.Len() > max(c.capacity, 0) {
+		last := c.lru.Back()
+		c.lru.Remove(last)
+		delete(c.items, last.Value.(*cacheEntry).ptr)
+		c.stats.Evictions += 1
+	}
+}
+
+func (c *PageCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Pages = c.lru.Len()
+	return stats
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPageCache(t *testing.T) {
+	cache := NewPageCache(2)
+	page_1 := NewLPage()
+	page_2 := NewIPage()
+	page_3 := NewLPage()
+	cache.put(1*BLOCK_SIZE, &page_1)
+	cache.put(2*BLOCK_SIZE, &page_2)
+	// Use 1, so 2 is the least recently used
+	if node, ok := cache.get(1 * BLOCK_SIZE); !ok || node != &page_1 {
+		t.Errorf("Expected page 1 in cache")
+	}
+	cache.put(3*BLOCK_SIZE, &page_3)
+	if _, ok := cache.get(2 * BLOCK_SIZE); ok {
+		t.Errorf("Expected page 2 to be evicted")
+	}
+	if _, ok := cache.get(3 * BLOCK_SIZE); !ok {
+		t.Errorf("Expected page 3 in cache")
+	}
+	cache.invalidate(3 * BLOCK_SIZE)
+	if _, ok := cache.get(3 * BLOCK_SIZE); ok {
+		t.Errorf("Expected page 3 to be invalidated")
+	}
+	stats := cache.Stats()
+	expected := CacheStats{Hits: 2, Misses: 2, Evictions: 1, Pages: 1}
+	if stats != expected {
+		t.Errorf("got stats = %v, expect %v", stats, expected)
+	}
+}
+
+func TestBTreeDisk_Cache(t *testing.T) {
+	maxNum := 500
+	test_db := newTestTree(t)
+	defer test_db.Close()
+	meta := must(test_db.LoadMetaPage())(t)
+	for i := 1; i <= maxNum; i++ {
+		meta = must(test_db.Insert(meta, intToSlice(int64(i)), intToSlice(int64(i))))(t)
+	}
+	// Hot key: only the first lookup reads from the file
+	test_db.Find(meta, intToSlice(42))
+	before := test_db.CacheStats()
+	for range 10 {
+		if kv, _ := test_db.Find(meta, intToSlice(42)); kv == nil {
+			t.Fatalf("Find test failed: Cannot find key = %d", 42)
+		}
+	}
+	after := test_db.CacheStats()
+	if after.Misses != before.Misses {
+		t.Errorf("Expected no miss on a hot key, got %v misses", after.Misses-before.Misses)
+	}
+	if after.Hits <= before.Hits {
+		t.Errorf("Expected hits on a hot key")
+	}
+	// Tiny cache: still correct, reused blocks are not served stale
+	test_db.SetCacheSize(3)
+	for i := 1; i <= maxNum; i++ {
+		meta = must(test_db.Set(meta, intToSlice(int64(i)), intToSlice(int64(i+5))))(t)
+	}
+	if pages := test_db.CacheStats().Pages; pages > 3 {
+		t.Errorf("got %v pages in cache, expect at most %v", pages, 3)
+	}
+	for i := 1; i <= maxNum; i++ {
+		kv, _ := test_db.Find(meta, intToSlice(int64(i)))
+		expected := NewKeyValFromInt(int64(i), int64(i+5))
+		if kv == nil || !isSameKV(*kv, expected) {
+			t.Fatalf("Find test failed for key = %d", i)
+		}
+	}
+	// No cache: every page is a miss
+	test_db.SetCacheSize(0)
+	before = test_db.CacheStats()
+	test_db.Find(meta, intToSlice(42))
+	after = test_db.CacheStats()
+	if after.Hits != before.Hits || after.Pages != 0 {
+		t.Errorf("Expected no hit without cache, got stats %v", after)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// Position of the flags, checksum and page_ptr fields in a block, see PageHeader.
+const (
+	FLAGS_OFFSET    = 1
+	CHECKSUM_OFFSET = FLAGS_OFFSET + 1 + 8
+	PAGE_PTR_OFFSET = CHECKSUM_OFFSET + 4
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// A page that does not pass verifyBlock: torn write, bit flip, or a block
+// written at the wrong place.
+type ErrCorruptPage struct {
+	Ptr      uint64 // Where the page was read
+	PageType uint8  // page_type as found on disk, may be garbage too
+	Reason   string
+}
+
+func (e *ErrCorruptPage) Error() string {
+	return fmt.Sprintf("corrupt page at %d (type %d): %s", e.Ptr, e.PageType, e.Reason)
+}
+
+func (e *ErrCorruptPage) Unwrap() error {
+	return ErrCorrupt
+}
+
+// CRC32C of the block, computed as if the checksum field was 0.
+func blockChecksum(block []byte) uint32 {
+	crc := crc32.Update(0, crc32cTable, block[:CHECKSUM_OFFSET])
+	crc = crc32.Update(crc, crc32cTable, make([]byte, 4))
+	return crc32.Update(crc, crc32cTable, block[CHECKSUM_OFFSET+4:])
+}
+
+// Stamp the page pointer and the checksum into a block of BLOCK_SIZE bytes,
+// just before it is written at ptr.
+func sealBlock(block []byte, ptr uint64) {
+	binary.BigEndian.PutUint64(block[PAGE_PTR_OFFSET:], ptr)
+	binary.BigEndian.PutUint32(block[CHECKSUM_OFFSET:], blockChecksum(block))
+}
+
+// Check a block of BLOCK_SIZE bytes just read from ptr.
+func verifyBlock(block []byte, ptr uint64) error {
+	pageType := block[0]
+	if stored := binary.BigEndian.Uint32(block[CHECKSUM_OFFSET:]); stored != blockChecksum(block) {
+		return &ErrCorruptPage{Ptr: ptr, PageType: pageType, Reason: "checksum mismatch"}
+	}
+	if stored := binary.BigEndian.Uint64(block[PAGE_PTR_OFFSET:]); stored != ptr {
+		return &ErrCorruptPage{Ptr: ptr, PageType: pageType, Reason: fmt.Sprintf("page written for %d", stored)}
+	}
+	return nil
+}
+
+// Pad the page in buffer to a whole block and seal it for ptr.
+func sealBuffer(buffer *bytes.Buffer, ptr uint64) ([]byte, error) {
+	if buffer.Len() > PAGE_SIZE {
+		return nil, fmt.Errorf("page of %d bytes does not fit in a block", buffer.Len())
+	}
+	block := make([]byte, BLOCK_SIZE)
+	copy(block, buffer.Bytes())
+	sealBlock(block, ptr)
+	return block, nil
+}
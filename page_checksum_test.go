@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestPageChecksum(t *testing.T) {
+	lpage := NewLPage()
+	for i := 1; i <= 10; i++ {
+		kv := NewKeyValFromInt(int64(i), int64(i))
+		lpage.InsertKV(&kv)
+	}
+	buffer := new(bytes.Buffer)
+	lpage.write_to_buffer(buffer)
+	block := must(sealBuffer(buffer, 5*BLOCK_SIZE))(t)
+	if err := verifyBlock(block, 5*BLOCK_SIZE); err != nil {
+		t.Fatalf("Expected valid block, got %v", err)
+	}
+	// Decoded page is the same
+	decoded := BTreeLeafPage{}
+	decoded.read_from_buffer(bytes.NewBuffer(block), true)
+	if decoded.header.page_ptr != 5*BLOCK_SIZE || decoded.nkv != 10 {
+		t.Errorf("Decode failed, got header = %v, nkv = %v", decoded.header, decoded.nkv)
+	}
+
+	// Bit flip anywhere in the block, even after the page data
+	var corrupt *ErrCorruptPage
+	for _, pos := range []int{0, 20, 100, BLOCK_SIZE - 1} {
+		flipped := bytes.Clone(block)
+		flipped[pos] ^= 0x10
+		err := verifyBlock(flipped, 5*BLOCK_SIZE)
+		if !errors.As(err, &corrupt) || corrupt.Ptr != 5*BLOCK_SIZE {
+			t.Errorf("Expected ErrCorruptPage for flip at %d, got %v", pos, err)
+		}
+	}
+	// Good block at the wrong place
+	err := verifyBlock(block, 6*BLOCK_SIZE)
+	if !errors.As(err, &corrupt) || corrupt.PageType != 2 {
+		t.Errorf("Expected ErrCorruptPage for misdirected page, got %v", err)
+	}
+	// Never written block
+	if err := verifyBlock(make([]byte, BLOCK_SIZE), 0); err == nil {
+		t.Errorf("Expected error for zero block")
+	}
+}
+
+func TestBTreeDisk_CorruptPage(t *testing.T) {
+	dbPath := testDBPath(t)
+	maxNum := 300
+	test_db := must(NewBPTreeDisk(dbPath))(t)
+	defer test_db.Close()
+	test_db.SetCacheSize(0)
+	meta := must(test_db.LoadMetaPage())(t)
+	for i := 1; i <= maxNum; i++ {
+		meta = must(test_db.Insert(meta, intToSlice(int64(i)), intToSlice(int64(i))))(t)
+	}
+	mustOK(t, test_db.WriteMetaPage(meta))
+
+	// Flip a byte in the root page
+	root := meta.header.next_page_pointer
+	flipByte(t, test_db.pager, root+100, 0xFF)
+
+	_, err := test_db.Find(meta, intToSlice(1))
+	var corrupt *ErrCorruptPage
+	if !errors.As(err, &corrupt) || !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Expected ErrCorruptPage, got %v", err)
+	}
+	if corrupt.Ptr != root || corrupt.PageType != 1 {
+		t.Errorf("Expected corrupt internal page at %d, got %v", root, corrupt)
+	}
+	if _, err := test_db.Insert(meta, intToSlice(int64(maxNum+1)), nil); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected ErrCorrupt on insert, got %v", err)
+	}
+
+	// Corrupt meta pages: open fails with an error
+	for slot := uint64(0); slot < META_SLOTS; slot++ {
+		flipByte(t, test_db.pager, slot*BLOCK_SIZE+100, 0xFF)
+	}
+	test_db.Close()
+	if _, err := OpenBPTreeDisk(dbPath); err == nil {
+		t.Errorf("Expected error when opening a file with a corrupt meta page")
+	}
+}
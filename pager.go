@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// ========================== Pager ==========================
+// Where the blocks of a tree are kept. The tree reads and writes whole blocks
+// at block aligned pointers, checksums and the page cache stay in the tree.
+// Blocks are handed out by the FileAllocator of the pager, which the tree
+// writes as the free list on commit.
+type Pager interface {
+	// Append the block at ptr to buffer, Buffer size = BLOCK_SIZE
+	ReadPage(ptr uint64, buffer *bytes.Buffer) error
+	WritePage(ptr uint64, block []byte) error
+	// Pointer to a block to write to
+	Alloc() uint64
+	// The block is reused once no committed meta page can reach it
+	Free(ptr uint64)
+	// Blocks written so far are durable
+	Sync() error
+	Close() error
+	// Bytes in use, blocks after the last one written are not counted
+	Size() (uint64, error)
+	allocator() *FileAllocator
+}
+
+// Pager that keeps the pointers of the blocks it hands out, so that a write
+// that fails can free them: no tree reaches them.
+type allocTracker struct {
+	Pager
+	allocated []uint64
+}
+
+func (p *allocTracker) Alloc() uint64 {
+	ptr := p.Pager.Alloc()
+	p.allocated = append(p.allocated, ptr)
+	return ptr
+}
+
+// Free every block handed out so far.
+func (p *allocTracker) freeAll() {
+	for _, ptr := range p.allocated {
+		p.Pager.Free(ptr)
+	}
+	p.allocated = nil
+}
+
+// Blocks in a database file.
+type FilePager struct {
+	file          *os.File
+	mmap          *MmapReader // nil: read with file.ReadAt
+	fileAllocator FileAllocator
+}
+
+func NewFilePager(file *os.File) *FilePager {
+	return &FilePager{
+		file:          file,
+		fileAllocator: NewFileAllocator(),
+	}
+}
+
+func (p *FilePager) ReadPage(ptr uint64, buffer *bytes.Buffer) error {
+	if p.mmap != nil {
+		return p.mmap.readBlock(ptr, buffer)
+	}
+	inbuf := make([]byte, BLOCK_SIZE)
+	sz, err := p.file.ReadAt(inbuf, int64(ptr))
+	if err != nil {
+		// Not a eof problem
+		if sz == 0 {
+			return err
+		}
+	}
+	buffer.Write(inbuf)
+	return nil
+}
+
+func (p *FilePager) WritePage(ptr uint64, block []byte) error {
+	_, err := p.file.WriteAt(block, int64(ptr))
+	return err
+}
+
+func (p *FilePager) Alloc() uint64 {
+	return p.fileAllocator.alloc()
+}
+
+func (p *FilePager) Free(ptr uint64) {
+	p.fileAllocator.free(ptr)
+}
+
+func (p *FilePager) Sync() error {
+	return p.file.Sync()
+}
+
+func (p *FilePager) Close() error {
+	if p.mmap != nil {
+		p.mmap.Close()
+		p.mmap = nil
+	}
+	return p.file.Close()
+}
+
+func (p *FilePager) Size() (uint64, error) {
+	info, err := p.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(info.Size()), nil
+}
+
+func (p *FilePager) allocator() *FileAllocator {
+	return &p.fileAllocator
+}
+
+// Read pages from a memory mapping of the file instead of file.ReadAt.
+func (p *FilePager) enableMmap() error {
+	if p.mmap != nil {
+		return nil
+	}
+	reader, err := NewMmapReader(p.file)
+	if err != nil {
+		return err
+	}
+	p.mmap = reader
+	return nil
+}
+
+// Blocks in memory, gone on Close. For tests and trees that do not need to
+// outlive the process.
+type MemPager struct {
+	blocks        map[uint64][]byte
+	size          uint64
+	fileAllocator FileAllocator
+}
+
+func NewMemPager() *MemPager {
+	return &MemPager{
+		blocks:        make(map[uint64][]byte),
+		fileAllocator: NewFileAllocator(),
+	}
+}
+
+// Same as a file: a block never written before the last one is 0.
+func (p *MemPager) ReadPage(ptr uint64, buffer *bytes.Buffer) error {
+	if ptr >= p.size {
+		return io.EOF
+	}
+	block, ok := p.blocks[ptr]
+	if !ok {
+		block = make([]byte, BLOCK_SIZE)
+	}
+	buffer.Write(block)
+	return nil
+}
+
+func (p *MemPager) WritePage(ptr uint64, block []byte) error {
+	p.blocks[ptr] = bytes.Clone(block)
+	p.size = max(p.size, ptr+uint64(len(block)))
+	return nil
+}
+
+func (p *MemPager) Alloc() uint64 {
+	return p.fileAllocator.alloc()
+}
+
+func (p *MemPager) Free(ptr uint64) {
+	p.fileAllocator.free(ptr)
+}
+
+func (p *MemPager) Sync() error {
+	return nil
+}
+
+func (p *MemPager) Close() error {
+	p.blocks = nil
+	p.size = 0
+	return nil
+}
+
+func (p *MemPager) Size() (uint64, error) {
+	return p.size, nil
+}
+
+func (p *MemPager) allocator() *FileAllocator {
+	return &p.fileAllocator
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPager(t *testing.T) {
+	file, err := os.Create(testDBPath(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, pager := range map[string]Pager{"file": NewFilePager(file), "memory": NewMemPager()} {
+		block := bytes.Repeat([]byte{7}, BLOCK_SIZE)
+		mustOK(t, pager.WritePage(3*BLOCK_SIZE, block))
+		if size := must(pager.Size())(t); size != 4*BLOCK_SIZE {
+			t.Errorf("%s: expected size %d, got %d", name, 4*BLOCK_SIZE, size)
+		}
+		buffer := new(bytes.Buffer)
+		if err := pager.ReadPage(3*BLOCK_SIZE, buffer); err != nil || !bytes.Equal(buffer.Bytes(), block) {
+			t.Errorf("%s: read back failed: %v", name, err)
+		}
+		// Never written before the last block: 0
+		buffer.Reset()
+		if err := pager.ReadPage(BLOCK_SIZE, buffer); err != nil || !bytes.Equal(buffer.Bytes(), make([]byte, BLOCK_SIZE)) {
+			t.Errorf("%s: expected a zero block, got %v", name, err)
+		}
+		// After the last block
+		buffer.Reset()
+		if err := pager.ReadPage(4*BLOCK_SIZE, buffer); !errors.Is(err, io.EOF) {
+			t.Errorf("%s: expected EOF, got %v", name, err)
+		}
+		mustOK(t, pager.Close())
+	}
+}
+
+// Readers share the mapping: one remaps it when the file grew while the
+// others copy blocks from it.
+func TestMmapReader_ConcurrentGrow(t *testing.T) {
+	file, err := os.Create(testDBPath(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	block := bytes.Repeat([]byte{7}, BLOCK_SIZE)
+	mustOK(t, NewFilePager(file).WritePage(0, block))
+	reader, err := NewMmapReader(file)
+	if err != nil {
+		t.Skipf("mmap not available: %v", err)
+	}
+	defer reader.Close()
+	var blocks atomic.Uint64
+	blocks.Store(1)
+	errs := make(chan error, 4)
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buffer := new(bytes.Buffer)
+			for n := blocks.Load(); n < 50; n = blocks.Load() {
+				buffer.Reset()
+				if err := reader.readBlock((n-1)*BLOCK_SIZE, buffer); err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(buffer.Bytes(), block) {
+					errs <- errors.New("block read from the mapping changed")
+					return
+				}
+				runtime.Gosched()
+			}
+		}()
+	}
+	for n := uint64(1); n < 50; n++ {
+		mustOK(t, NewFilePager(file).WritePage(n*BLOCK_SIZE, block))
+		blocks.Store(n + 1)
+		runtime.Gosched()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Read while the file grows failed: %v", err)
+	}
+}
+
+func TestBTreeDisk_MemPager(t *testing.T) {
+	maxNum := 500
+	pager := NewMemPager()
+	test_db := must(NewBPTreeDiskWithPager(pager))(t)
+	meta := must(test_db.LoadMetaPage())(t)
+	for i := 1; i <= maxNum; i++ {
+		meta = must(test_db.Insert(meta, intToSlice(int64(i)), intToSlice(int64(i))))(t)
+	}
+	mustOK(t, test_db.WriteMetaPage(meta))
+
+	// Same pager, opened again: the committed tree and its free list are back
+	reopened := must(OpenBPTreeDiskWithPager(pager))(t)
+	meta = must(reopened.LoadMetaPage())(t)
+	for i := 1; i <= maxNum; i++ {
+		if kv, _ := reopened.Find(meta, intToSlice(int64(i))); kv == nil {
+			t.Fatalf("Find after reopen failed: Cannot find key = %d", i)
+		}
+	}
+	if report := must(reopened.Check())(t); !report.OK() {
+		t.Errorf("Errors on a memory tree:\n%s", checkErrors(report))
+	}
+	// File only features
+	if err := reopened.EnableMmap(); err == nil {
+		t.Errorf("Expected mmap to fail without a file")
+	}
+	if err := reopened.CompactOnline(); err == nil {
+		t.Errorf("Expected online compaction to fail without a file")
+	}
+	mustOK(t, reopened.Close())
+	if _, err := reopened.Find(meta, intToSlice(1)); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
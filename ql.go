@@ -1,6 +1,27 @@
 package main
 
-import "math"
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Node types, literal values use the type of their Value
+const (
+	QL_UNINIT = 0
+	QL_STR    = TYPE_BYTES
+	QL_I64    = TYPE_INT64
+	// comparisons
+	QL_CMP_GE = 10 // >=
+	QL_CMP_GT = 11 // >
+	QL_CMP_LT = 12 // <
+	QL_CMP_LE = 13 // <=
+	QL_CMP_EQ = 14 // ==
+	// unary ops
+	QL_NEG = 20
+	// others
+	QL_SYM = 100 // column
+)
 
 type QLNode struct {
 	Type     uint32 // tagged union
@@ -44,6 +65,14 @@ type Parser struct {
 	query []byte
 	start int
 	end   int
+	err   error // the first error
+}
+
+// Keep the first error of a parse
+func pErr(p *Parser, format string, args ...any) {
+	if p.err == nil {
+		p.err = fmt.Errorf(format, args...)
+	}
 }
 
 // Check for all keywords at start and
@@ -69,8 +98,14 @@ func pMustSym(p *Parser) string {
 	return ""
 }
 
+// CREATE TABLE name (...)
+func pCreateTable(p *Parser) *TableDef {
+	// TODO: columns and indexes
+	return &TableDef{name: pMustSym(p)}
+}
+
 // Parse statement into a structure
-func pStmt(p *Parser) (r interface{}) {
+func pStmt(p *Parser) (r interface{}, err error) {
 	switch {
 	case pKeyword(p, "create", "table"):
 		r = pCreateTable(p)
@@ -78,7 +113,10 @@ func pStmt(p *Parser) (r interface{}) {
 		r = pSelect(p)
 		// ...
 	}
-	return r
+	if p.err != nil {
+		return nil, p.err
+	}
+	return r, nil
 }
 
 // ================ Select ====================
@@ -121,8 +159,25 @@ func pScan(p *Parser, node *QLScan) {
 	}
 }
 
+// INDEX BY a > 1 AND a < 5
+func pIndexBy(p *Parser, node *QLScan) {
+	// TODO
+	pErr(p, "INDEX BY is not supported yet")
+}
+
+// LIMIT offset, count
+func pLimit(p *Parser, node *QLScan) {
+	// TODO
+	pErr(p, "LIMIT is not supported yet")
+}
+
 // =============== Expression ===================
 
+// Put the OR expression as node, the lowest priority
+func pExprOr(p *Parser, node *QLNode) {
+	*node = pAdd(p)
+}
+
 // Take this token as a column
 func pCol(p *Parser) QLNode {
 	col := pMustSym(p)
@@ -137,7 +192,7 @@ func pCol(p *Parser) QLNode {
 func pAdd(p *Parser) QLNode {
 	node := pMul(p)
 	// Keep finding the next '+'
-	for next('+') {
+	for pKeyword(p, "+") {
 		right := pMul(p)
 		node = QLNode{
 			Type:     '+',
@@ -151,7 +206,7 @@ func pAdd(p *Parser) QLNode {
 func pMul(p *Parser) QLNode {
 	node := pCol(p)
 	// Keep finding the next '*'
-	for next('*') {
+	for pKeyword(p, "*") {
 		right := pCol(p)
 		node = QLNode{
 			Type:     '*',
@@ -169,6 +224,14 @@ type QLEvalContex struct {
 	err error
 }
 
+// Keep the first error of an evaluation
+func qlErr(ctx *QLEvalContex, format string, args ...any) {
+	if ctx.err == nil {
+		ctx.out.Type = QL_UNINIT
+		ctx.err = fmt.Errorf(format, args...)
+	}
+}
+
 // Evaluate the expression on a record
 func qlEval(ctx *QLEvalContex, node QLNode) {
 	switch node.Type {
@@ -181,7 +244,7 @@ func qlEval(ctx *QLEvalContex, node QLNode) {
 		}
 	// a literal value
 	case QL_I64, QL_STR:
-		ctx.out = node.Value
+		ctx.out = Value{Type: uint8(node.Type), I64: node.I64, Str: node.Str}
 	// operators
 	case QL_NEG:
 		qlEval(ctx, node.Children[0])
@@ -196,8 +259,26 @@ func qlEval(ctx *QLEvalContex, node QLNode) {
 	}
 }
 
+// Evaluate each expression on a record
+func qlEvalMulti(rec Record, exprs []QLNode) ([]Value, error) {
+	vals := []Value{}
+	for _, node := range exprs {
+		ctx := QLEvalContex{rec: rec}
+		qlEval(&ctx, node)
+		if ctx.err != nil {
+			return nil, ctx.err
+		}
+		vals = append(vals, ctx.out)
+	}
+	return vals, nil
+}
+
 func qlEvalScanKey(node QLNode) (Record, int, error) {
+	if node.Type == QL_UNINIT {
+		return Record{}, 0, nil
+	}
 	// TODO
+	return Record{}, 0, errors.New("INDEX BY is not supported yet")
 }
 
 // Initiate a scanner with a QLScan.
@@ -302,7 +383,9 @@ func isMatch(rec *Record, filter QLNode) bool {
 func (iter *qlScanIter) Deref(rec *Record) error {
 	for {
 		// Put temp result in self Record
-		iter.sc.Deref(&iter.rec)
+		if err := iter.sc.Deref(&iter.rec); err != nil {
+			return err
+		}
 		// Check if it meets the filter
 		if isMatch(&iter.rec, iter.req.Filter) {
 			*rec = iter.rec
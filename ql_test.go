@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+)
+
+// INDEX BY and LIMIT are not parsed yet, each is an error rather than ignored
+func TestQL_UnsupportedClauses(t *testing.T) {
+	for _, clause := range []func(*Parser, *QLScan){pIndexBy, pLimit} {
+		p := Parser{}
+		clause(&p, &QLScan{})
+		if p.err == nil {
+			t.Errorf("Expected a parse error")
+		}
+	}
+	// The first error is kept
+	p := Parser{}
+	pIndexBy(&p, &QLScan{})
+	pLimit(&p, &QLScan{})
+	if _, err := pStmt(&p); err == nil || err.Error() != "INDEX BY is not supported yet" {
+		t.Errorf("Expected the INDEX BY error, got %v", err)
+	}
+}
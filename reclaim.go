@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// ========================== Page reclamation ==========================
+// A write never changes a page in place, it retires the pages of the old
+// path instead. Retired pages only go back to the FileAllocator once nothing
+// can read them anymore:
+// - the write is part of a committed meta page: a version that is never
+//   committed retired pages that the committed tree still uses,
+// - no reader (KVTX, BIter) pinned before that commit is still open.
+// A commit that only goes to the write-ahead log holds the retired pages of
+// the checkpointed tree until the next checkpoint: the meta page on disk still
+// uses them. Pages written since the checkpoint are only in memory (see
+// walPager), they are retired as on any commit.
+
+// Pages retired by the write that made a version, and the version it was
+// made from (0: unknown). write is what to log for it in WAL mode, nil if it
+// cannot be logged.
+type versionInfo struct {
+	parent  uint64
+	retired []uint64
+	write   *walWrite
+}
+
+// Pages retired by the commit that ended epoch, free once no reader pinned
+// at epoch or before is left.
+type retiredPages struct {
+	epoch uint64
+	ptrs  []uint64
+}
+
+type Reclaimer struct {
+	last_version      uint64
+	committed_version uint64
+	versions          map[uint64]versionInfo // Versions made since the last commit
+	epoch             uint64                 // Number of commits
+	readers           map[uint64]int         // Number of readers pinned at each epoch
+	readers_mu        *sync.Mutex            // Readers pin and unpin under the read lock of the tree
+	retired           []retiredPages
+	held              []uint64 // Retired by commits to the log since the checkpoint
+}
+
+func NewReclaimer() *Reclaimer {
+	r := &Reclaimer{
+		versions:   make(map[uint64]versionInfo),
+		readers:    make(map[uint64]int),
+		readers_mu: new(sync.Mutex),
+		retired:    []retiredPages{},
+	}
+	r.committed_version = r.newVersion(0, nil, nil)
+	return r
+}
+
+// Record a new version made from parent, return its number.
+func (r *Reclaimer) newVersion(parent uint64, retired []uint64, write *walWrite) uint64 {
+	r.last_version += 1
+	r.versions[r.last_version] = versionInfo{
+		parent:  parent,
+		retired: retired,
+		write:   write,
+	}
+	return r.last_version
+}
+
+// Writes that made version from the committed version, oldest first. false
+// if one of them cannot be logged, or version was not made from the
+// committed version.
+func (r *Reclaimer) writesSince(version uint64) ([]walWrite, bool) {
+	writes := []walWrite{}
+	v := version
+	for v != r.committed_version {
+		info, ok := r.versions[v]
+		if !ok || info.write == nil {
+			return nil, false
+		}
+		writes = append(writes, *info.write)
+		v = info.parent
+	}
+	slices.Reverse(writes)
+	return writes, true
+}
+
+// Commit a version to the log only, see writesSince. Retired pages the
+// checkpointed tree uses are held until the next commit, which is a
+// checkpoint. Return the pages that can be freed now, as commit.
+func (r *Reclaimer) commitLogged(version uint64, checkpointed func(ptr uint64) bool) []uint64 {
+	ptrs := []uint64{}
+	for v := version; v != r.committed_version; v = r.versions[v].parent {
+		for _, ptr := range r.versions[v].retired {
+			if checkpointed(ptr) {
+				r.held = append(r.held, ptr)
+			} else {
+				ptrs = append(ptrs, ptr)
+			}
+		}
+	}
+	clear(r.versions)
+	r.committed_version = version
+	return r.retire(ptrs)
+}
+
+// Commit a version, return the pages that can be freed now.
+func (r *Reclaimer) commit(version uint64) []uint64 {
+	// Step 1: Collect pages retired from the last committed version to this
+	// one. If it was not made from the last committed version, free nothing:
+	// leaking pages is better than freeing pages still in use.
+	ptrs := []uint64{}
+	v := version
+	for v != r.committed_version {
+		info, ok := r.versions[v]
+		if !ok {
+			ptrs = nil
+			break
+		}
+		ptrs = append(ptrs, info.retired...)
+		v = info.parent
+	}
+	if isDebugMode && ptrs == nil {
+		fmt.Printf("version %d not made from the committed version %d\n", version, r.committed_version)
+	}
+	if ptrs != nil {
+		ptrs = append(ptrs, r.held...)
+	}
+	r.held = nil
+	// Step 2: Versions not committed now can not be committed safely later
+	clear(r.versions)
+	r.committed_version = version
+	return r.retire(ptrs)
+}
+
+// Retire the pages of the commit that ends the current epoch, return the
+// pages no pinned reader can reach anymore.
+func (r *Reclaimer) retire(ptrs []uint64) []uint64 {
+	if len(ptrs) > 0 {
+		r.retired = append(r.retired, retiredPages{epoch: r.epoch, ptrs: ptrs})
+	}
+	r.epoch += 1
+	oldest := r.epoch
+	for epoch := range r.readers {
+		oldest = min(oldest, epoch)
+	}
+	free := []uint64{}
+	keep := []retiredPages{}
+	for _, pages := range r.retired {
+		if pages.epoch < oldest {
+			free = append(free, pages.ptrs...)
+		} else {
+			keep = append(keep, pages)
+		}
+	}
+	r.retired = keep
+	return free
+}
+
+// Copy of the commit state, to go back to if a commit fails. Readers are
+// shared: they do not change during a commit.
+func (r *Reclaimer) clone() Reclaimer {
+	saved := *r
+	saved.versions = maps.Clone(r.versions)
+	saved.retired = slices.Clone(r.retired)
+	saved.held = slices.Clone(r.held)
+	return saved
+}
+
+func (r *Reclaimer) pin() uint64 {
+	r.readers_mu.Lock()
+	defer r.readers_mu.Unlock()
+	r.readers[r.epoch] += 1
+	return r.epoch
+}
+
+func (r *Reclaimer) unpin(epoch uint64) {
+	r.readers_mu.Lock()
+	defer r.readers_mu.Unlock()
+	r.readers[epoch] -= 1
+	if r.readers[epoch] <= 0 {
+		delete(r.readers, epoch)
+	}
+}
+
+// Number of readers still pinned.
+func (r *Reclaimer) pinned() int {
+	r.readers_mu.Lock()
+	defer r.readers_mu.Unlock()
+	count := 0
+	for _, n := range r.readers {
+		count += n
+	}
+	return count
+}
+
+// Free the pages retired while a reader was pinned, once none is left: no
+// commit follows on close to free them. The committed meta page is written
+// again with the allocator it was committed with, as uncommitted writes may
+// have taken blocks from it since. In WAL mode the log replays the commits
+// that retired them instead.
+func (tree *BPTreeDisk) freeRetired() error {
+	if len(tree.reclaim.retired) == 0 || tree.reclaim.pinned() > 0 {
+		return nil
+	}
+	metaPage, err := tree.loadMetaPage()
+	if err != nil {
+		return err
+	}
+	allocator, err := LoadFileAllocator(tree.pager, metaPage)
+	if err != nil {
+		return err
+	}
+	*tree.pager.allocator() = allocator
+	return tree.writeMetaPage(metaPage)
+}
+
+// Keep every page readable from the meta pages known now, until Unpin.
+// Return the token to give to Unpin.
+func (tree *BPTreeDisk) Pin() uint64 {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+	return tree.reclaim.pin()
+}
+
+func (tree *BPTreeDisk) Unpin(epoch uint64) {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+	tree.reclaim.unpin(epoch)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestReclaim_WriteHeavy(t *testing.T) {
+	dbPath := testDBPath(t)
+	maxNum := 300
+	test_db := must(NewBPTreeDisk(dbPath))(t)
+	defer test_db.Close()
+	meta := must(test_db.LoadMetaPage())(t)
+	model := make(map[int][]byte)
+	for i := 1; i <= maxNum; i++ {
+		model[i] = intToSlice(int64(i))
+		meta = must(test_db.Insert(meta, intToSlice(int64(i)), model[i]))(t)
+	}
+	mustOK(t, test_db.WriteMetaPage(meta))
+	lastFree := test_db.pager.allocator().last_free
+
+	// Updates, a commit for each: the file does not grow
+	r := rand.New(rand.NewSource(1))
+	for range 1000 {
+		i := r.Intn(maxNum) + 1
+		model[i] = randomBytes(r, 0, 2*BLOCK_SIZE)
+		meta = must(test_db.Set(meta, intToSlice(int64(i)), model[i]))(t)
+		mustOK(t, test_db.WriteMetaPage(meta))
+	}
+	// Room for the overflow pages of the new values, and a few more
+	if test_db.pager.allocator().last_free > lastFree+200 {
+		t.Errorf("Expected old pages to be reused, last_free %v -> %v", lastFree, test_db.pager.allocator().last_free)
+	}
+	test_db.Close()
+
+	reopened, err := OpenBPTreeDisk(dbPath)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer reopened.Close()
+	meta = must(reopened.LoadMetaPage())(t)
+	for i := 1; i <= maxNum; i++ {
+		kv, _ := reopened.Find(meta, intToSlice(int64(i)))
+		if kv == nil || !bytes.Equal(kv.val, model[i]) {
+			t.Fatalf("Find test failed: val not expected for key = %d", i)
+		}
+	}
+}
+
+func TestReclaim_PinnedReader(t *testing.T) {
+	maxNum := 500
+	test_db := newTestTree(t)
+	defer test_db.Close()
+	meta := must(test_db.LoadMetaPage())(t)
+	for i := 1; i <= maxNum; i++ {
+		meta = must(test_db.Insert(meta, intToSlice(int64(i)), intToSlice(int64(i))))(t)
+	}
+	mustOK(t, test_db.WriteMetaPage(meta))
+
+	// Snapshots held by an iterator and by a pin, as KVTX does
+	snapshot := must(test_db.LoadMetaPage())(t)
+	iter := must(test_db.SeekFirst(snapshot))(t)
+	epoch := test_db.Pin()
+	for round := 1; round <= 5; round++ {
+		for i := 1; i <= maxNum; i++ {
+			meta = must(test_db.Set(meta, intToSlice(int64(i)), intToSlice(int64(-round))))(t)
+		}
+		mustOK(t, test_db.WriteMetaPage(meta))
+	}
+	for i := 1; i <= maxNum; i++ {
+		kv, _ := test_db.Find(snapshot, intToSlice(int64(i)))
+		if kv == nil || !bytes.Equal(kv.val, intToSlice(int64(i))) {
+			t.Fatalf("Pinned snapshot changed for key = %d", i)
+		}
+	}
+	for i := 1; i <= maxNum; i++ {
+		if !iter.Valid() || !bytes.Equal(must(iter.Deref())(t).val, intToSlice(int64(i))) {
+			t.Fatalf("Pinned iterator changed at key = %d", i)
+		}
+		iter.Next()
+	}
+
+	// Readers gone: pages retired while they were pinned are freed too
+	iter.Close()
+	test_db.Unpin(epoch)
+	meta = must(test_db.Set(meta, intToSlice(1), intToSlice(1)))(t)
+	mustOK(t, test_db.WriteMetaPage(meta))
+	lastFree := test_db.pager.allocator().last_free
+	if len(test_db.reclaim.retired) != 0 {
+		t.Errorf("Expected all retired pages to be freed, %d commits left", len(test_db.reclaim.retired))
+	}
+	for i := 1; i <= maxNum; i++ {
+		meta = must(test_db.Set(meta, intToSlice(int64(i)), intToSlice(int64(i))))(t)
+	}
+	mustOK(t, test_db.WriteMetaPage(meta))
+	if test_db.pager.allocator().last_free != lastFree {
+		t.Errorf("Expected freed pages to be reused, last_free %v -> %v", lastFree, test_db.pager.allocator().last_free)
+	}
+}
+
+func TestReclaim_UncommittedVersion(t *testing.T) {
+	maxNum := 500
+	test_db := newTestTree(t)
+	defer test_db.Close()
+	meta := must(test_db.LoadMetaPage())(t)
+	for i := 1; i <= maxNum; i++ {
+		meta = must(test_db.Insert(meta, intToSlice(int64(i)), intToSlice(int64(i))))(t)
+	}
+	mustOK(t, test_db.WriteMetaPage(meta))
+
+	// Versions that are dropped, like an aborted transaction: the pages they
+	// retired are still used by the committed tree
+	dropped := meta
+	for i := 1; i <= maxNum; i += 2 {
+		dropped = must(test_db.Del(dropped, intToSlice(int64(i))))(t)
+	}
+	// Many commits from the committed tree, reusing every free page
+	for round := 0; round < 5; round++ {
+		for i := 2; i <= maxNum; i += 2 {
+			meta = must(test_db.Set(meta, intToSlice(int64(i)), intToSlice(int64(i+round))))(t)
+		}
+		mustOK(t, test_db.WriteMetaPage(meta))
+	}
+	for i := 1; i <= maxNum; i++ {
+		expected := intToSlice(int64(i))
+		if i%2 == 0 {
+			expected = intToSlice(int64(i + 4))
+		}
+		kv, _ := test_db.Find(meta, intToSlice(int64(i)))
+		if kv == nil || !bytes.Equal(kv.val, expected) {
+			t.Fatalf("Find test failed: val not expected for key = %d", i)
+		}
+	}
+}
+
+func TestReclaim_RetiredOnClose(t *testing.T) {
+	dbPath := testDBPath(t)
+	maxNum := 500
+	test_db := must(NewBPTreeDisk(dbPath))(t)
+	meta := must(test_db.LoadMetaPage())(t)
+	for i := 1; i <= maxNum; i++ {
+		meta = must(test_db.Insert(meta, intToSlice(int64(i)), intToSlice(int64(i))))(t)
+	}
+	mustOK(t, test_db.WriteMetaPage(meta))
+
+	// The last commit retires pages while a reader is pinned, nothing
+	// commits after the unpin
+	epoch := test_db.Pin()
+	for i := 1; i <= maxNum; i++ {
+		meta = must(test_db.Set(meta, intToSlice(int64(i)), intToSlice(int64(-i))))(t)
+	}
+	mustOK(t, test_db.WriteMetaPage(meta))
+	retired := 0
+	for _, pages := range test_db.reclaim.retired {
+		retired += len(pages.ptrs)
+	}
+	if retired == 0 {
+		t.Fatalf("Expected pages retired while pinned")
+	}
+	// Free pages and the pages of the free list, which grows to hold them
+	report := must(test_db.Check())(t)
+	before := report.FreePages + report.FreeListPages
+	test_db.Unpin(epoch)
+	// Uncommitted writes do not keep the blocks they took
+	must(test_db.Set(meta, []byte("lost"), []byte("lost")))(t)
+	mustOK(t, test_db.Close())
+
+	test_db = must(OpenBPTreeDisk(dbPath))(t)
+	defer test_db.Close()
+	report = must(test_db.Check())(t)
+	if !report.OK() {
+		t.Errorf("Expected no leaked pages after reopen:\n%s", checkErrors(report))
+	}
+	if after := report.FreePages + report.FreeListPages; after != before+retired {
+		t.Errorf("Expected %d + %d free pages, got %d", before, retired, after)
+	}
+}
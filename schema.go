@@ -3,6 +3,8 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"slices"
 )
 
 // [INT, STRING (Not UTF-8)], BLOB, UUID, FLOAT, ...
@@ -74,6 +76,16 @@ func (r *Record) AddInt64(col string, val int64) *Record {
 	return r
 }
 
+// Value of a column, nil if the record does not have it
+func (r *Record) Get(col string) *Value {
+	for i, c := range r.Cols {
+		if c == col {
+			return &r.Vals[i]
+		}
+	}
+	return nil
+}
+
 // Asume the 2 slice have the same number of elements
 func compareRecord(lhs []Value, rhs []Value) int {
 	for i := range lhs {
@@ -125,11 +137,24 @@ type DB struct {
 	kv   KV
 }
 
-func (db *DB) Open() {
+// Open the database at Path, encrypted with key (16, 24 or 32 bytes), or nil
+// to keep it in clear. A new database is created with this key.
+func (db *DB) Open(key []byte) error {
 	db.kv = KV{
 		fileName: db.Path,
+		key:      key,
 	}
-	db.kv.Open()
+	return db.kv.Open()
+}
+
+// Encrypt the database with newKey, nil to decrypt it. Open it with newKey
+// from now on.
+func (db *DB) Rekey(newKey []byte) error {
+	return db.kv.Rekey(newKey)
+}
+
+func (db *DB) Close() error {
+	return db.kv.Close()
 }
 
 // ======================= Record functions =====================
@@ -153,68 +178,71 @@ func checkRecord(tdef *TableDef, rec *Record) bool {
 // 10, ["Adam", 30] -> [10 4 A d a m 8 0 0 0 0 0 0 0 30 0]
 // Contain all values in order.
 func encodeKey(prefix uint8, Vals []Value) []byte {
-	// Prepare a buffer for bytes writing
-	var err error
+	// Prepare a buffer for bytes writing. Writes to a bytes.Buffer do not
+	// fail, so there is no error to return.
 	buffer := new(bytes.Buffer) // Buffer size = 0
 	// First: Write the prefix
-	err = binary.Write(buffer, binary.BigEndian, prefix)
+	buffer.WriteByte(prefix)
 	// How many vals are there
-	err = binary.Write(buffer, binary.BigEndian, uint8(len(Vals)))
+	buffer.WriteByte(uint8(len(Vals)))
 	for _, v := range Vals {
 		// For each v, write data:
 		// First, the type
-		err = binary.Write(buffer, binary.BigEndian, uint8(v.Type))
+		buffer.WriteByte(uint8(v.Type))
 		if v.Type == TYPE_INT64 {
 			// Just write the int64
-			err = binary.Write(buffer, binary.BigEndian, v.I64)
+			buffer.Write(binary.BigEndian.AppendUint64(nil, uint64(v.I64)))
 		} else {
 			// Write the len
-			err = binary.Write(buffer, binary.BigEndian, uint8(len(v.Str)))
+			buffer.WriteByte(uint8(len(v.Str)))
 			// Write the rest of the data.
 			buffer.Write(v.Str)
 		}
 	}
-	// No error handing here, just panic
-	if err != nil {
-		panic(err)
-	}
 	return buffer.Bytes() // Escape outside, will allocate on heap
 }
 
-func decodeVals(data []byte) []Value {
+// Values read back from the database, an error wrapping ErrCorrupt if they
+// were not made by encodeKey.
+func decodeVals(data []byte) ([]Value, error) {
 	// Make a byte buffer with the data.
-	var err error
 	buffer := new(bytes.Buffer) // Buffer size = 0
 	buffer.Write(data)
 	// First: Read the prefix. For val this should be discarded.
 	var prefix uint8
-	err = binary.Read(buffer, binary.BigEndian, &prefix)
 	// Next, read how many values
 	var n uint8
-	err = binary.Read(buffer, binary.BigEndian, &n)
+	if err := binaryRead(buffer, &prefix, &n); err != nil {
+		return nil, err
+	}
 	res := make([]Value, 0)
 	for i := 0; i < int(n); i += 1 {
 		var v Value
 		var vtype uint8
-		err = binary.Read(buffer, binary.BigEndian, &vtype)
+		if err := binaryRead(buffer, &vtype); err != nil {
+			return nil, err
+		}
+		v.Type = vtype
 		if vtype == TYPE_INT64 {
 			// Just read the int64
-			err = binary.Read(buffer, binary.BigEndian, &v.I64)
+			if err := binaryRead(buffer, &v.I64); err != nil {
+				return nil, err
+			}
 		} else {
 			// Read the len
 			var l uint8
-			err = binary.Read(buffer, binary.BigEndian, &l)
+			if err := binaryRead(buffer, &l); err != nil {
+				return nil, err
+			}
 			var data []byte = make([]byte, l)
-			buffer.Read(data)
+			if err := binaryRead(buffer, data); err != nil {
+				return nil, err
+			}
 			v.Str = data
 		}
 		res = append(res, v)
 	}
-	if err != nil {
-		panic(err)
-	}
-
-	return res
+	return res, nil
 }
 
 func makeValuesWithIndex(tdef *TableDef, indexPos int, rec *Record) []Value {
@@ -234,17 +262,20 @@ func makeValuesWithIndex(tdef *TableDef, indexPos int, rec *Record) []Value {
 
 // SELECT * FROM People WHERE name == 'Adam' and age == 30
 // Always get from primary key: index[0] , prefix[0]
-func dbGet(db *DB, tdef *TableDef, rec *Record) bool {
+func dbGet(db *DB, tdef *TableDef, rec *Record) (bool, error) {
 	// Start a transaction
 	tx := KVTX{}
-	tx.kv.Begin(&tx)
+	if err := db.kv.Begin(&tx); err != nil {
+		return false, err
+	}
+	defer db.kv.Abort(&tx)
 
 	// Step 1: reorder columns
 	// rec{Cols[name, date, age], Val: ['Adam', nil, 30]}
 	// -> rec{Cols[name, age, date], Val: ['Adam', 30, nil]}
 	checkRecordRes := checkRecord(tdef, rec)
 	if !checkRecordRes {
-		return false
+		return false, nil
 	}
 
 	// Get record value
@@ -254,33 +285,42 @@ func dbGet(db *DB, tdef *TableDef, rec *Record) bool {
 	key := encodeKey(tdef.Prefix[0], recordVals)
 
 	// Step 3: query from kv store with transaction
-	val, found := tx.Get(key)
-	if !found {
-		return false
+	val, err := tx.Get(key)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
 	}
 
 	// Step 4: decode into record
-	vals := decodeVals(val)
+	vals, err := decodeVals(val)
+	if err != nil {
+		return false, err
+	}
 	for i := len(tdef.Indexes[0]); i < len(tdef.Cols); i++ {
 		rec.Vals[i] = vals[i-len(tdef.Indexes[0])]
 	}
 
 	// Res: rec{Cols[name, age, date], Val: ["Adam", 30, 20250101]}
-	return true
+	return true, nil
 }
 
 // INSERT INTO People (name, age, date) ('bob', 31, 20252111)
-func dbInsert(db *DB, tdef *TableDef, rec *Record) bool {
+func dbInsert(db *DB, tdef *TableDef, rec *Record) (bool, error) {
 	// Start a transaction
 	tx := KVTX{}
-	tx.kv.Begin(&tx)
+	if err := db.kv.Begin(&tx); err != nil {
+		return false, err
+	}
+	defer db.kv.Abort(&tx)
 
 	// Step 1: reorder columns
 	// rec{Cols[name, date, age], Val: ['Adam', nil, 30]}
 	// -> rec{Cols[name, age, date], Val: ['Adam', 30, nil]}
 	checkRecordRes := checkRecord(tdef, rec)
 	if !checkRecordRes {
-		return false
+		return false, nil
 	}
 
 	// Get record value
@@ -303,23 +343,30 @@ func dbInsert(db *DB, tdef *TableDef, rec *Record) bool {
 		Updated: false,
 	}
 
-	tx.Update(&req)
-
-	return true
+	if err := tx.Update(&req); err != nil {
+		return false, err
+	}
+	if err := dbCommit(db, &tx); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 // DELETE FROM People WHERE name = "xyz" and age = 18
-func dbDelete(db *DB, tdef *TableDef, rec *Record) bool {
+func dbDelete(db *DB, tdef *TableDef, rec *Record) (bool, error) {
 	// Start a transaction
 	tx := KVTX{}
-	tx.kv.Begin(&tx)
+	if err := db.kv.Begin(&tx); err != nil {
+		return false, err
+	}
+	defer db.kv.Abort(&tx)
 
 	// Step 1: reorder columns
 	// rec{Cols[name, date, age], Val: ['Adam', nil, 30]}
 	// -> rec{Cols[name, age, date], Val: ['Adam', 30, nil]}
 	checkRecordRes := checkRecord(tdef, rec)
 	if !checkRecordRes {
-		return false
+		return false, nil
 	}
 
 	// Get record value
@@ -333,20 +380,29 @@ func dbDelete(db *DB, tdef *TableDef, rec *Record) bool {
 	}
 
 	// Step 3: Delete using KV store
-	return tx.Update(&req)
+	if err := tx.Update(&req); err != nil {
+		return false, err
+	}
+	if err := dbCommit(db, &tx); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
-func dbUpdate(db *DB, tdef *TableDef, rec *Record) bool {
+func dbUpdate(db *DB, tdef *TableDef, rec *Record) (bool, error) {
 	// Start a transaction
 	tx := KVTX{}
-	tx.kv.Begin(&tx)
+	if err := db.kv.Begin(&tx); err != nil {
+		return false, err
+	}
+	defer db.kv.Abort(&tx)
 
 	// Step 1: reorder columns
 	// rec{Cols[name, date, age], Val: ['Adam', nil, 30]}
 	// -> rec{Cols[name, age, date], Val: ['Adam', 30, nil]}
 	checkRecordRes := checkRecord(tdef, rec)
 	if !checkRecordRes {
-		return false
+		return false, nil
 	}
 
 	// Get record value
@@ -358,10 +414,25 @@ func dbUpdate(db *DB, tdef *TableDef, rec *Record) bool {
 	val := encodeKey(tdef.Prefix[0], rec.Vals[len(tdef.Indexes[0]):])
 
 	req := UpdateReq{Key: key, Val: val, Mode: 3} // Mode update
-	tx.Update(&req)
+	if err := tx.Update(&req); err != nil {
+		return false, err
+	}
 	// Step 4: maintain index with update request to maintain secondary indexes
-	handleUpdateRequest(db, &tx, tdef, &req)
-	return req.Updated
+	if err := handleUpdateRequest(db, &tx, tdef, &req); err != nil {
+		return false, err
+	}
+	if err := dbCommit(db, &tx); err != nil {
+		return false, err
+	}
+	return req.Updated, nil
+}
+
+// Commit tx and write it to disk, for the next transactions to see it
+func dbCommit(db *DB, tx *KVTX) error {
+	if !db.kv.Commit(tx) {
+		return ErrConflict
+	}
+	return db.kv.CommitToDisk()
 }
 
 // Convert from record to a table definition structure
@@ -376,43 +447,44 @@ func encodeTableDef(TableDef) []uint8 {
 	return res
 }
 
-func getTableDef(db *DB, table string) *TableDef {
+// Return nil if there is no such table.
+func getTableDef(db *DB, table string) (*TableDef, error) {
 	// rec:{Cols = ["name"], Vals = ["People"]}
 	rec := (&Record{}).AddStr("name", []byte(table))
-	found := dbGet(db, TDEF_TABLE, rec)
-	if !found {
-		return nil
+	found, err := dbGet(db, TDEF_TABLE, rec)
+	if !found || err != nil {
+		return nil, err
 	}
 	res := decodeTableDef(rec)
-	return &res
+	return &res, nil
 }
 
 // ========================== DB Wrapper functions ==============
 
 // rec = {['name', 'age'], ['Adam', 30] }
 // => SELCT * FROM ... WHERE name = 'Adam' and age = 30
-func (db *DB) Get(table string, rec *Record) bool {
+func (db *DB) Get(table string, rec *Record) (bool, error) {
 	// Step 1: Check and get table definition from table name
-	tdef := getTableDef(db, table)
+	tdef, err := getTableDef(db, table)
 	if tdef == nil {
-		return false
+		return false, err
 	}
 
 	// Step 2: Get using table definition
 	return dbGet(db, tdef, rec)
 }
 
-func (db *DB) Insert(table string, rec Record) bool {
+func (db *DB) Insert(table string, rec Record) (bool, error) {
 	// Step 1: Check and get table definition from table name
-	tdef := getTableDef(db, table)
+	tdef, err := getTableDef(db, table)
 	if tdef == nil {
-		return false
+		return false, err
 	}
 
 	// Step 2: Get to see if there's data
-	found := db.Get(table, &rec)
-	if found {
-		return false // Cannot insert if same primary key
+	found, err := db.Get(table, &rec)
+	if found || err != nil {
+		return false, err // Cannot insert if same primary key
 	}
 
 	// Step 3: Insert using table definition
@@ -420,26 +492,26 @@ func (db *DB) Insert(table string, rec Record) bool {
 }
 
 // =================== TODO: Implement this =================
-func (db *DB) Update(table string, rec Record) bool {
-	return true
+func (db *DB) Update(table string, rec Record) (bool, error) {
+	return true, nil
 }
 
 // =================== TODO: Implement this =================
-func (db *DB) Upsert(table string, rec Record) bool {
-	return true
+func (db *DB) Upsert(table string, rec Record) (bool, error) {
+	return true, nil
 }
 
-func (db *DB) Delete(table string, rec Record) bool {
+func (db *DB) Delete(table string, rec Record) (bool, error) {
 	// Step 1: Check and get table definition from table name
-	tdef := getTableDef(db, table)
+	tdef, err := getTableDef(db, table)
 	if tdef == nil {
-		return false
+		return false, err
 	}
 
 	// Step 2: Get to see if there's data
-	found := db.Get(table, &rec)
-	if !found {
-		return false // Cannot insert if same primary key
+	found, err := db.Get(table, &rec)
+	if !found || err != nil {
+		return false, err // Cannot insert if same primary key
 	}
 
 	// Step 3: Delete using table definition
@@ -484,51 +556,52 @@ type UpdateReq struct {
 	Updated bool // added a new key or an old key was changed
 }
 
-// Handing update request for other indexes.
-func handleUpdateRequest(db *DB, tx *KVTX, tdef *TableDef, req *UpdateReq) {
-	oldVals := decodeVals(req.Old)
-	newVals := decodeVals(req.Val)
-	needChangeIdx := 0
-	var needChangePrefix uint8 = 0
-	for i := len(tdef.Indexes[0]); i < len(tdef.Cols); i++ {
-		col := tdef.Cols[i]
-		if compareRecord(oldVals, newVals) != 0 {
-			// Check if this belong to any index
-			for idx, idxCols := range tdef.Indexes[1:] {
-				for _, idxCol := range idxCols {
-					if idxCol == col {
-						needChangeIdx = idx
-						needChangePrefix = tdef.Prefix[idx]
-					}
-				}
-			}
-		}
+// Handing update request for other indexes: move the entry of each
+// secondary index whose columns changed, req has been applied by tx.Update.
+func handleUpdateRequest(db *DB, tx *KVTX, tdef *TableDef, req *UpdateReq) error {
+	if !req.Updated || len(tdef.Indexes) == 1 {
+		return nil
 	}
-	oldRecord := Record{}
-	newRecord := Record{}
-	// Get record value
-	oldRecordVals := make([]Value, 0)
-	newRecordVals := make([]Value, 0)
-	for i := 0; i < len(tdef.Indexes[needChangeIdx]); i++ {
-		for j := 0; j < len(oldRecord.Cols); j++ {
-			if tdef.Indexes[needChangeIdx][i] == oldRecord.Cols[j] {
-				oldRecordVals = append(oldRecordVals, oldRecord.Vals[j])
-				newRecordVals = append(newRecordVals, newRecord.Vals[j])
+	pkeyVals, err := decodeVals(req.Key)
+	if err != nil {
+		return err
+	}
+	newVals, err := decodeVals(req.Val)
+	if err != nil {
+		return err
+	}
+	newRecord := Record{Cols: tdef.Cols, Vals: append(slices.Clone(pkeyVals), newVals...)}
+	oldRecord := Record{Cols: tdef.Cols}
+	if !req.Added {
+		oldVals, err := decodeVals(req.Old)
+		if err != nil {
+			return err
+		}
+		oldRecord.Vals = append(slices.Clone(pkeyVals), oldVals...)
+	}
+	for idx := 1; idx < len(tdef.Indexes); idx++ {
+		newKey := encodeKey(tdef.Prefix[idx], makeValuesWithIndex(tdef, idx, &newRecord))
+		if !req.Added {
+			oldKey := encodeKey(tdef.Prefix[idx], makeValuesWithIndex(tdef, idx, &oldRecord))
+			if bytes.Equal(oldKey, newKey) {
+				continue
+			}
+			if err := tx.Update(&UpdateReq{
+				Key:  oldKey,
+				Mode: 2,
+			}); err != nil {
+				return err
 			}
 		}
+		if err := tx.Update(&UpdateReq{
+			Key:  newKey,
+			Val:  req.Key,
+			Mode: 1,
+		}); err != nil {
+			return err
+		}
 	}
-	oldKey := encodeKey(uint8(needChangePrefix), oldRecordVals)
-	newKey := encodeKey(uint8(needChangePrefix), newRecordVals)
-	tx.Update(&UpdateReq{
-		Key:  oldKey,
-		Mode: 2,
-	})
-	tx.Update(&UpdateReq{
-		Key:  newKey,
-		Val:  req.Key,
-		Mode: 1,
-	})
-	req.Updated = true
+	return nil
 }
 
 // ========================== Scanner ==============================
@@ -548,9 +621,26 @@ type Scanner struct {
 	// internal
 	db     *DB
 	tdef   *TableDef
-	index  int    // which index?
-	iter   *BIter // the underlying B-tree iterator
-	keyEnd []byte // the encoded Key2
+	index  int      // which index?
+	meta   MetaPage // the snapshot iter reads
+	iter   *BIter   // the underlying B-tree iterator
+	keyEnd []byte   // the encoded Key2
+}
+
+// Start sc at Key1 on its index of tdef, in the snapshot of tx. tx must not
+// end before sc is closed.
+func dbScan(db *DB, tx *KVTX, tdef *TableDef, sc *Scanner) error {
+	sc.db = db
+	sc.tdef = tdef
+	sc.meta, _ = tx.GetMeta()
+	sc.keyEnd = nil
+	keyStart := encodeKey(tdef.Prefix[sc.index], makeValuesWithIndex(tdef, sc.index, &sc.Key1))
+	iter, err := db.kv.tree.SeekGE(sc.meta, keyStart)
+	if err != nil {
+		return err
+	}
+	sc.iter = iter
+	return nil
 }
 
 // within the range or not?
@@ -567,15 +657,12 @@ func (sc *Scanner) Valid() bool {
 		}
 		sc.keyEnd = encodeKey(sc.tdef.Prefix[sc.index], recordVals)
 	}
-	pkeyKV := sc.iter.Deref()
-	indexKeys := pkeyKV.key
-	for i := range len(indexKeys) {
-		if indexKeys[i] > sc.keyEnd[i] {
-			// Out of range
-			return false
-		}
+	if !sc.iter.Valid() {
+		// Past the last key of the tree
+		return false
 	}
-	return true
+	// Out of range, the key is never in overflow pages
+	return compareKey(sc.iter.current().key, sc.keyEnd) <= 0
 }
 
 // move the underlying B-tree iterator
@@ -585,20 +672,37 @@ func (sc *Scanner) Next() {
 }
 
 // fetch the current row
-func (sc *Scanner) Deref(rec *Record) {
-	pkeyKV := sc.iter.Deref()
-	pkeyData := pkeyKV.val
-	pkeyVal, _ := sc.db.kv.Get(pkeyData[:])
+func (sc *Scanner) Deref(rec *Record) error {
+	kv, err := sc.iter.Deref()
+	if err != nil {
+		return err
+	}
+	// The primary index holds the row, a secondary index the primary key
+	pkeyData, pkeyVal := kv.key, kv.val
+	if sc.index != 0 {
+		pkeyData = kv.val
+		if pkeyVal, err = sc.db.kv.Get(sc.meta, pkeyData); err != nil {
+			return err
+		}
+	}
 
 	// Decode primary keys to columns.
-	pkeyVals := decodeVals(pkeyData[:])
-	recordVals := decodeVals(pkeyVal)
-	for i := 0; i < len(sc.tdef.Indexes[0]); i++ {
-		rec.Vals[i] = pkeyVals[i]
+	pkeyVals, err := decodeVals(pkeyData[:])
+	if err != nil {
+		return err
 	}
-	for i := len(sc.tdef.Indexes[0]); i < len(sc.tdef.Cols); i++ {
-		rec.Vals[i] = recordVals[i-len(sc.tdef.Indexes[0])]
+	recordVals, err := decodeVals(pkeyVal)
+	if err != nil {
+		return err
 	}
+	rec.Cols = sc.tdef.Cols
+	rec.Vals = append(pkeyVals, recordVals...)
+	return nil
+}
+
+// Unpin the pages of the underlying B-tree iterator
+func (sc *Scanner) Close() {
+	sc.iter.Close()
 }
 
 // ============================= Transaction ======================
@@ -621,7 +725,9 @@ type KVTX struct {
 
 	// Concurrency control
 	snapshot MetaPage
-	pending  *MetaPage // Can be null
+	pending  MetaPage // The snapshot with the updates of the transaction
+	epoch    uint64   // Pages of the snapshot are pinned until the end
+	done     bool
 
 	// Current read and written rows
 	reads  []StoreKey
@@ -629,15 +735,34 @@ type KVTX struct {
 }
 
 // begin a transaction: Store snapshot
-func (kv *KV) Begin(tx *KVTX) {
+func (kv *KV) Begin(tx *KVTX) error {
 	tx.kv = kv
 	// TODO: Generate a new version, maybe the current timestamp
 	tx.version = 100
-	tx.snapshot = tx.kv.LoadMetaPage()
+	// Pin first: a commit between loading the snapshot and pinning it could
+	// free its pages
+	tx.epoch = kv.tree.Pin()
+	snapshot, err := tx.kv.LoadMetaPage()
+	if err != nil {
+		tx.end()
+		return err
+	}
+	tx.snapshot = snapshot
+	tx.pending = snapshot
+	return nil
+}
+
+// Unpin the snapshot, once for each transaction
+func (tx *KVTX) end() {
+	if !tx.done {
+		tx.done = true
+		tx.kv.tree.Unpin(tx.epoch)
+	}
 }
 
 // end a transaction: commit updates; rollback on error
 func (kv *KV) Commit(tx *KVTX) bool {
+	defer tx.end()
 	mt, _ := tx.GetMeta()
 	if detectConflicts(kv, tx) {
 		return false
@@ -654,48 +779,57 @@ func (kv *KV) Commit(tx *KVTX) bool {
 // end a transaction: rollback
 // Remove all pending operations
 func (kv *KV) Abort(tx *KVTX) {
+	tx.end()
 }
 
 // point query. combines captured updates with the snapshot
 // true: Get return the snapshot
 // false: Get return a pending
 func (tx *KVTX) GetMeta() (MetaPage, bool) {
-	if tx.pending != nil {
-		val := *tx.pending
-		return val, false
-	} else {
-		return tx.snapshot, true
-	}
+	return tx.pending, tx.pending == tx.snapshot
 }
 
-func (tx *KVTX) Get(key []byte) ([]byte, bool) {
+// Return the value of key, an error wrapping ErrNotFound if there is none.
+func (tx *KVTX) Get(key []byte) ([]byte, error) {
 	mt, _ := tx.GetMeta()
-	val, exist := tx.kv.Get(mt, key)
-	if exist {
+	val, err := tx.kv.Get(mt, key)
+	if err == nil {
 		tx.reads = append(tx.reads, StoreKey{
 			key: key,
 		})
 	}
-	return val, exist
+	return val, err
 }
 
-func (tx *KVTX) Update(req *UpdateReq) bool {
+func (tx *KVTX) Update(req *UpdateReq) error {
 	mt, _ := tx.GetMeta()
-	if req.Mode == 1 { // Insert
-		*tx.pending = tx.kv.Set(mt, req.Key, req.Val)
+	if req.Mode == 1 || req.Mode == 3 { // Insert, Update
+		old, err := tx.kv.Get(mt, req.Key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		req.Old = old
+		req.Added = err != nil
+		req.Updated = req.Added || !bytes.Equal(old, req.Val)
+		newMetaPage, err := tx.kv.Set(mt, req.Key, req.Val)
+		if err != nil {
+			return err
+		}
+		tx.pending = newMetaPage
 	} else if req.Mode == 2 { // Del
-		ok, newMetaPage := tx.kv.Del(mt, req.Key)
-		if ok {
-			*tx.pending = newMetaPage
+		newMetaPage, err := tx.kv.Del(mt, req.Key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if err == nil {
+			tx.pending = newMetaPage
 		}
-	} else { // Update
-		*tx.pending = tx.kv.Set(mt, req.Key, req.Val)
 	}
 	// After update, put a history write.
 	tx.writes = append(tx.writes, StoreKey{
 		req.Key,
 	})
-	return true
+	return nil
 }
 
 // TODO: Scanner in transaction
@@ -1,9 +1,11 @@
 package main
 
 import (
-	// "bytes"
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
 	// "encoding/binary"
-	// "fmt"
 	// "math/rand"
 	"testing"
 	// "time"
@@ -69,7 +71,7 @@ func TestSchema_Record(t *testing.T) {
 	}
 	// Encode / decode test
 	encoded := encodeKey(11, original)
-	decoded := decodeVals(encoded)
+	decoded := must(decodeVals(encoded))(t)
 	if len(original) != len(decoded) {
 		t.Fatalf("Encode / Decode length is different, expected = %v, actual = %v", len(original), len(decoded))
 	}
@@ -124,10 +126,144 @@ func createRecordFromMap(mp map[string]any) Record {
 
 // Testing all functions related to TableDef
 func TestSchema_TableDef(t *testing.T) {
+	dbPath := testDBPath(t)
 	// Init the Database
 	db := DB{
-		Path: "test_db.db",
+		Path: dbPath,
 	}
-	db.Open()
+	mustOK(t, db.Open(nil))
 
 }
+
+// Get, Insert, Update and Delete rows, each in a transaction
+func TestSchema_DBTransactions(t *testing.T) {
+	db := DB{
+		Path: testDBPath(t),
+	}
+	mustOK(t, db.Open(nil))
+	defer db.Close()
+	// No table is defined yet
+	if found, err := db.Get("People", (&Record{}).AddStr("name", []byte("adam"))); found || err != nil {
+		t.Fatalf("Get from an unknown table: expected not found, got %v, %v", found, err)
+	}
+
+	people := &TableDef{
+		name:    "People",
+		Types:   []uint8{TYPE_BYTES, TYPE_INT64, TYPE_BYTES},
+		Cols:    []string{"name", "age", "city"},
+		Indexes: [][]string{{"name"}, {"city"}},
+		Prefix:  []uint8{11, 12},
+	}
+	row := func(name string, age int64, city string) *Record {
+		return (&Record{}).AddStr("name", []byte(name)).AddInt64("age", age).AddStr("city", []byte(city))
+	}
+	checkRow := func(name string, age int64, city string) {
+		t.Helper()
+		rec := row(name, 0, "")
+		if found := must(dbGet(&db, people, rec))(t); !found {
+			t.Fatalf("Get %s: not found", name)
+		}
+		if rec.Vals[1].I64 != age || !bytes.Equal(rec.Vals[2].Str, []byte(city)) {
+			t.Errorf("Get %s: expected %d, %s, got %d, %s", name, age, city, rec.Vals[1].I64, rec.Vals[2].Str)
+		}
+	}
+	cityKey := func(city string) []byte {
+		return encodeKey(12, []Value{{Type: TYPE_BYTES, Str: []byte(city)}})
+	}
+
+	// Each write is committed, the next transaction sees it
+	if ok := must(dbInsert(&db, people, row("adam", 30, "hanoi")))(t); !ok {
+		t.Fatalf("Insert: expected ok")
+	}
+	checkRow("adam", 30, "hanoi")
+
+	if updated := must(dbUpdate(&db, people, row("adam", 31, "hue")))(t); !updated {
+		t.Fatalf("Update: expected updated")
+	}
+	checkRow("adam", 31, "hue")
+	// The city index points to the row from its new city
+	meta := must(db.kv.LoadMetaPage())(t)
+	pkey := encodeKey(11, []Value{{Type: TYPE_BYTES, Str: []byte("adam")}})
+	if val, err := db.kv.Get(meta, cityKey("hue")); err != nil || !bytes.Equal(val, pkey) {
+		t.Errorf("City index after Update: expected %v, got %v, %v", pkey, val, err)
+	}
+	if _, err := db.kv.Get(meta, cityKey("hanoi")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("City index after Update: expected the old city removed, got %v", err)
+	}
+	// Nothing changes, the same values again
+	if updated := must(dbUpdate(&db, people, row("adam", 31, "hue")))(t); updated {
+		t.Errorf("Update with the same values: expected not updated")
+	}
+
+	if ok := must(dbDelete(&db, people, row("adam", 0, "")))(t); !ok {
+		t.Fatalf("Delete: expected ok")
+	}
+	if found := must(dbGet(&db, people, row("adam", 0, "")))(t); found {
+		t.Errorf("Get after Delete: expected not found")
+	}
+	meta = must(db.kv.LoadMetaPage())(t)
+	if _, err := db.kv.Get(meta, pkey); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after Delete: expected ErrNotFound, got %v", err)
+	}
+}
+
+// Scan a secondary index in the snapshot of a transaction
+func TestSchema_Scan(t *testing.T) {
+	db := DB{
+		Path: testDBPath(t),
+	}
+	mustOK(t, db.Open(nil))
+	defer db.Close()
+	people := &TableDef{
+		name:    "People",
+		Types:   []uint8{TYPE_BYTES, TYPE_INT64, TYPE_BYTES},
+		Cols:    []string{"name", "age", "city"},
+		Indexes: [][]string{{"name"}, {"city"}},
+		Prefix:  []uint8{11, 12},
+	}
+	for i, name := range []string{"adam", "bob", "carl"} {
+		rec := (&Record{}).AddStr("name", []byte(name)).AddInt64("age", int64(30+i)).AddStr("city", []byte{'a' + byte(i)})
+		must(dbUpdate(&db, people, rec))(t)
+	}
+
+	tx := KVTX{}
+	mustOK(t, db.kv.Begin(&tx))
+	defer db.kv.Abort(&tx)
+	// A later write does not change the snapshot of tx
+	rec := (&Record{}).AddStr("name", []byte("bob")).AddInt64("age", 99).AddStr("city", []byte("b"))
+	must(dbUpdate(&db, people, rec))(t)
+
+	sc := Scanner{
+		Key1:  *(&Record{}).AddStr("city", []byte("b")),
+		Key2:  *(&Record{}).AddStr("city", []byte("c")),
+		index: 1,
+	}
+	mustOK(t, dbScan(&db, &tx, people, &sc))
+	defer sc.Close()
+	got := []string{}
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		mustOK(t, sc.Deref(&rec))
+		got = append(got, fmt.Sprintf("%s %d", rec.Get("name").Str, rec.Get("age").I64))
+	}
+	if !slices.Equal(got, []string{"bob 31", "carl 32"}) {
+		t.Errorf("Scan: expected [bob 31 carl 32], got %v", got)
+	}
+
+	// The primary index holds the rows themselves
+	pk := Scanner{
+		Key1:  *(&Record{}).AddStr("name", []byte("bob")),
+		Key2:  *(&Record{}).AddStr("name", []byte("bob")),
+		index: 0,
+	}
+	mustOK(t, dbScan(&db, &tx, people, &pk))
+	defer pk.Close()
+	if !pk.Valid() {
+		t.Fatalf("Scan of the primary index: expected bob")
+	}
+	rec = &Record{}
+	mustOK(t, pk.Deref(rec))
+	if got := fmt.Sprintf("%s %d %s", rec.Get("name").Str, rec.Get("age").I64, rec.Get("city").Str); got != "bob 31 b" {
+		t.Errorf("Scan of the primary index: expected bob 31 b, got %s", got)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+)
+
+// ========================== Statistics ==========================
+// Stats walks the tree of a meta page level by level, as Dump does, and the
+// free list it points to, and adds up what the pages hold. Fragmentation says
+// how much the file would shrink with Compact.
+
+type LevelStats struct {
+	Pages   int     `json:"pages"`
+	Keys    int     `json:"keys"`
+	AvgFill float64 `json:"avg_fill"` // Mean of size / PAGE_SIZE over the pages
+}
+
+type TreeStats struct {
+	Generation    uint64       `json:"generation"`
+	Height        int          `json:"height"` // Levels of internal pages, plus the leaves
+	InternalPages int          `json:"internal_pages"`
+	LeafPages     int          `json:"leaf_pages"`
+	OverflowPages int          `json:"overflow_pages"`
+	Levels        []LevelStats `json:"levels"` // From the first internal page down to the leaves
+	Keys          int          `json:"keys"`
+	KeyBytes      uint64       `json:"key_bytes"`
+	ValueBytes    uint64       `json:"value_bytes"` // Inline and in overflow pages
+	FreeListPages int          `json:"free_list_pages"`
+	FreePages     int          `json:"free_pages"` // Blocks on the free list
+	FileSize      uint64       `json:"file_size"`
+	// Share of the blocks after the meta slots that are not pages of the
+	// tree: free, free list, or retired and not free yet. 0 once compacted.
+	Fragmentation float64 `json:"fragmentation"`
+}
+
+// Statistics of the tree of metaPage and of the database file.
+func (tree *BPTreeDisk) Stats(metaPage MetaPage) (TreeStats, error) {
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+	buffer := new(bytes.Buffer) // Buffer size = 0
+	pager, err := tree.getPager()
+	if err != nil {
+		return TreeStats{}, err
+	}
+	stats := TreeStats{Generation: metaPage.generation, Levels: []LevelStats{}}
+	// Step 1: Tree level by level from the first internal page
+	level := []uint64{}
+	if metaPage.header.next_page_pointer != 0 {
+		level = append(level, metaPage.header.next_page_pointer)
+	}
+	for len(level) > 0 {
+		next := []uint64{}
+		levelStats := LevelStats{Pages: len(level)}
+		for _, ptr := range level {
+			node, err := tree.readNode(ptr, buffer, pager)
+			if err != nil {
+				return stats, err
+			}
+			if convert, ok := node.(*BTreeInternalPage); ok {
+				stats.InternalPages += 1
+				levelStats.Keys += int(convert.nkey)
+				levelStats.AvgFill += float64(convert.size()) / PAGE_SIZE
+				next = append(next, convert.children...)
+				continue
+			}
+			convert := node.(*BTreeLeafPage)
+			stats.LeafPages += 1
+			levelStats.Keys += int(convert.nkv)
+			levelStats.AvgFill += float64(convert.size()) / PAGE_SIZE
+			for i := range convert.kv {
+				kv := &convert.kv[i]
+				stats.KeyBytes += uint64(len(kv.key))
+				if kv.overflow_ptr != 0 {
+					stats.ValueBytes += kv.overflow_len
+					stats.OverflowPages += int((kv.overflow_len + OVERFLOW_MAX_DATA - 1) / OVERFLOW_MAX_DATA)
+				} else {
+					stats.ValueBytes += uint64(len(kv.val))
+				}
+			}
+			stats.Keys += int(convert.nkv)
+		}
+		levelStats.AvgFill /= float64(levelStats.Pages)
+		stats.Levels = append(stats.Levels, levelStats)
+		stats.Height += 1
+		level = next
+	}
+	// Step 2: Free list
+	ptr := metaPage.free_list_pointer
+	for ptr != 0 {
+		if err := tree.readBlockAtPointer(ptr, buffer, pager); err != nil {
+			return stats, err
+		}
+		flPage := FreeListPage{}
+		if err := flPage.read_from_buffer(buffer, true); err != nil {
+			return stats, err
+		}
+		stats.FreeListPages += 1
+		stats.FreePages += int(flPage.nblock)
+		ptr = flPage.header.next_page_pointer
+	}
+	// Step 3: Blocks of the file the tree does not use
+	if stats.FileSize, err = pager.Size(); err != nil {
+		return stats, err
+	}
+	blocks := int(stats.FileSize/BLOCK_SIZE) - META_SLOTS
+	if used := stats.InternalPages + stats.LeafPages + stats.OverflowPages; blocks > 0 && used < blocks {
+		stats.Fragmentation = 1 - float64(used)/float64(blocks)
+	}
+	return stats, nil
+}
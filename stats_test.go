@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	test_db := newTestTree(t)
+	defer test_db.Close()
+	stats := must(test_db.Stats(must(test_db.LoadMetaPage())(t)))(t)
+	if stats.Height != 0 || stats.Keys != 0 || len(stats.Levels) != 0 {
+		t.Errorf("Expected an empty tree, got %+v", stats)
+	}
+
+	// 100 keys of 8 bytes with values of 160 bytes are left, one is big
+	test_db, meta := fragmentedTestTree(t, 1000)
+	defer test_db.Close()
+	meta = must(test_db.Set(meta, intToSlice(10), bytes.Repeat([]byte{1}, 3*BLOCK_SIZE)))(t)
+	mustOK(t, test_db.WriteMetaPage(meta))
+	meta = must(test_db.LoadMetaPage())(t)
+	stats = must(test_db.Stats(meta))(t)
+	report := must(test_db.Check())(t)
+	if stats.Height != report.Height || stats.InternalPages != report.InternalPages ||
+		stats.LeafPages != report.LeafPages || stats.OverflowPages != report.OverflowPages ||
+		stats.FreeListPages != report.FreeListPages || stats.FreePages != report.FreePages || stats.Keys != report.Keys {
+		t.Errorf("Stats do not match Check:\n%+v\n%+v", stats, report)
+	}
+	if stats.Keys != 100 || stats.KeyBytes != 100*8 || stats.ValueBytes != 99*160+3*BLOCK_SIZE {
+		t.Errorf("Expected 100 keys, got %d keys, %d key bytes, %d value bytes", stats.Keys, stats.KeyBytes, stats.ValueBytes)
+	}
+	if len(stats.Levels) != stats.Height || stats.Levels[stats.Height-1].Pages != stats.LeafPages {
+		t.Errorf("Levels not expected: %+v", stats.Levels)
+	}
+	if stats.Fragmentation < 0.5 {
+		t.Errorf("Expected a fragmented file after deletes, got %.2f", stats.Fragmentation)
+	}
+
+	// Compacted: no free block, full leaves
+	compactPath := filepath.Join(t.TempDir(), "test_compact.db")
+	mustOK(t, test_db.Compact(compactPath))
+	compacted := must(OpenBPTreeDisk(compactPath))(t)
+	defer compacted.Close()
+	compactStats := must(compacted.Stats(must(compacted.LoadMetaPage())(t)))(t)
+	if compactStats.Fragmentation != 0 || compactStats.FreePages != 0 || compactStats.FileSize >= stats.FileSize {
+		t.Errorf("Expected a dense file, got %.2f fragmented, %d bytes", compactStats.Fragmentation, compactStats.FileSize)
+	}
+	leaves := compactStats.Levels[compactStats.Height-1]
+	if leaves.Keys != 100 || leaves.AvgFill < 0.7 || leaves.AvgFill > 1 {
+		t.Errorf("Expected full leaves, got %+v", leaves)
+	}
+	if compactStats.KeyBytes != stats.KeyBytes || compactStats.ValueBytes != stats.ValueBytes {
+		t.Errorf("Compact changed the data: %+v", compactStats)
+	}
+}
+
+func TestCLI_Stats(t *testing.T) {
+	test_db, _ := fragmentedTestTree(t, 1000)
+	test_db.Close()
+	out := new(bytes.Buffer)
+	if code := runCommand([]string{"stats", "-json", test_db.fileName}, out, out); code != 0 {
+		t.Errorf("stats -json: exit code %d", code)
+	}
+	stats := TreeStats{}
+	mustOK(t, json.Unmarshal(out.Bytes(), &stats))
+	if stats.Keys != 100 || stats.Height == 0 {
+		t.Errorf("stats -json: %s", out)
+	}
+	if code := runCommand([]string{"stats", test_db.fileName}, io.Discard, io.Discard); code != 0 {
+		t.Errorf("stats: exit code %d", code)
+	}
+	if code := runCommand([]string{"stats"}, io.Discard, io.Discard); code == 0 {
+		t.Errorf("stats without <db> should fail")
+	}
+}
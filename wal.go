@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"maps"
+	"os"
+	"slices"
+)
+
+// ========================== Write-ahead log ==========================
+// In WAL mode a commit appends the writes made since the last commit to a log
+// file next to the database file, and syncs only the log. The tree itself is
+// written at checkpoints, with the usual meta page commit, after which the log
+// starts again empty: until then the pages written are kept in memory, see
+// walPager. On open, the log is replayed on top of the meta page of the last
+// checkpoint.
+
+// Log file of the database file fileName
+const WAL_SUFFIX = ".wal"
+
+// The log is checkpointed once it has this many bytes, by default
+const DEFAULT_CHECKPOINT_SIZE = 4 << 20
+
+// Or once the pages kept in memory since the last checkpoint take this many
+// bytes: a small record can write a whole path of pages
+const DEFAULT_DIRTY_LIMIT = 16 << 20
+
+// Written at the start of the log, with the generation of the checkpoint the
+// records apply to. A log of another generation is already in the tree.
+const WAL_SIGNATURE = "MINIWAL1"
+const WAL_HEADER_SIZE = 8 + 8
+
+// Operations of the log
+const (
+	WAL_SET = 1
+	WAL_DEL = 2
+)
+
+// Each record is a commit:
+// - len (4) + crc (4): CRC32C of the payload
+// - payload: generation (8) + version (8) + nwrite (4) + list of writes
+// Each write: op (1) + key len (2) + key + val len (4) + val
+// generation is the one of the checkpoint, as in the header. version counts
+// the commits since the checkpoint from 1. A record with another generation
+// or version is the garbage of a torn append, or of an older log the header
+// was written over.
+type walWrite struct {
+	op  uint8
+	key []byte
+	val []byte
+}
+
+type WAL struct {
+	file            *os.File
+	size            int64  // Bytes of the header and valid records
+	generation      uint64 // Of the checkpoint the records apply to
+	checkpoint_size int64
+	dirty_limit     int      // Bytes of pages kept in memory before a checkpoint
+	version         uint64   // Of the last record
+	meta            MetaPage // Committed by the last record, if version > 0
+}
+
+// Pager of a tree in WAL mode: pages written since the last checkpoint stay in
+// memory on top of the pager of the tree, the database file only changes at
+// checkpoints. Sync, which only a checkpoint calls, writes them to the file.
+// The meta slots are written through.
+type walPager struct {
+	Pager
+	dirty map[uint64][]byte // Blocks written since the last Sync
+}
+
+func newWALPager(pager Pager) *walPager {
+	return &walPager{
+		Pager: pager,
+		dirty: make(map[uint64][]byte),
+	}
+}
+
+func (p *walPager) ReadPage(ptr uint64, buffer *bytes.Buffer) error {
+	if block, ok := p.dirty[ptr]; ok {
+		buffer.Write(block)
+		return nil
+	}
+	return p.Pager.ReadPage(ptr, buffer)
+}
+
+func (p *walPager) WritePage(ptr uint64, block []byte) error {
+	if isMetaSlot(ptr) {
+		return p.Pager.WritePage(ptr, block)
+	}
+	p.dirty[ptr] = bytes.Clone(block)
+	return nil
+}
+
+// Whether the block at ptr was written since the last checkpoint: no meta
+// page on disk can reach it.
+func (p *walPager) written(ptr uint64) bool {
+	_, ok := p.dirty[ptr]
+	return ok
+}
+
+// A block written since the last checkpoint can be reused right away, others
+// once the next checkpoint no longer uses them. It stays in memory until it
+// is written again: a failed checkpoint puts it back in use.
+func (p *walPager) Free(ptr uint64) {
+	if !p.written(ptr) {
+		p.Pager.Free(ptr)
+		return
+	}
+	if isDebugMode {
+		fmt.Println("freeing written block ", ptr/BLOCK_SIZE)
+	}
+	allocator := p.allocator()
+	allocator.free_block = append(allocator.free_block, ptr/BLOCK_SIZE)
+}
+
+// Write the blocks kept in memory to the pager, in order, then sync it.
+// They are kept if it fails.
+func (p *walPager) Sync() error {
+	for _, ptr := range slices.Sorted(maps.Keys(p.dirty)) {
+		if err := p.Pager.WritePage(ptr, p.dirty[ptr]); err != nil {
+			return err
+		}
+	}
+	if err := p.Pager.Sync(); err != nil {
+		return err
+	}
+	clear(p.dirty)
+	return nil
+}
+
+// Bytes of the blocks kept in memory.
+func (p *walPager) dirtySize() int {
+	return len(p.dirty) * BLOCK_SIZE
+}
+
+func (p *walPager) Size() (uint64, error) {
+	size, err := p.Pager.Size()
+	if err != nil {
+		return 0, err
+	}
+	for ptr := range p.dirty {
+		size = max(size, ptr+BLOCK_SIZE)
+	}
+	return size, nil
+}
+
+// What to log for a write to the tree, nil if not in WAL mode.
+func (tree *BPTreeDisk) logWrite(op uint8, key []byte, val []byte) *walWrite {
+	if tree.wal == nil {
+		return nil
+	}
+	return &walWrite{op: op, key: bytes.Clone(key), val: bytes.Clone(val)}
+}
+
+func (w *walWrite) write_to_buffer(buffer *bytes.Buffer) error {
+	return binaryWrite(buffer, w.op, uint16(len(w.key)), w.key, uint32(len(w.val)), w.val)
+}
+
+func (w *walWrite) read_from_buffer(buffer *bytes.Buffer) error {
+	var keyLen uint16
+	var valLen uint32
+	if err := binaryRead(buffer, &w.op, &keyLen); err != nil {
+		return err
+	}
+	w.key = make([]byte, keyLen)
+	if err := binaryRead(buffer, w.key, &valLen); err != nil {
+		return err
+	}
+	if int(valLen) > buffer.Len() {
+		return fmt.Errorf("%w: value of %d bytes in a log record", ErrCorrupt, valLen)
+	}
+	w.val = make([]byte, valLen)
+	return binaryRead(buffer, w.val)
+}
+
+// Commit through the log from now on, and replay the log if there is one.
+// The tree is checkpointed once the log has more than checkpointSize bytes,
+// 0 for DEFAULT_CHECKPOINT_SIZE, or the pages written since the last
+// checkpoint more than DEFAULT_DIRTY_LIMIT. Needs a database file.
+func (tree *BPTreeDisk) EnableWAL(checkpointSize int64) error {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+	return tree.enableWAL(checkpointSize)
+}
+
+func (tree *BPTreeDisk) enableWAL(checkpointSize int64) error {
+	if tree.fileName == "" {
+		return errors.New("WAL: the tree is not in a database file")
+	}
+	if tree.wal != nil {
+		return nil
+	}
+	if checkpointSize <= 0 {
+		checkpointSize = DEFAULT_CHECKPOINT_SIZE
+	}
+	file, err := os.OpenFile(tree.fileName+WAL_SUFFIX, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	tree.wal = &WAL{
+		file:            file,
+		generation:      tree.generation,
+		checkpoint_size: checkpointSize,
+		dirty_limit:     DEFAULT_DIRTY_LIMIT,
+	}
+	tree.pager = newWALPager(tree.pager)
+	if err := tree.replayWAL(); err != nil {
+		file.Close()
+		tree.wal = nil
+		tree.pager = tree.pager.(*walPager).Pager
+		return err
+	}
+	return nil
+}
+
+// Checkpoint, then commit to the tree directly and remove the log.
+func (tree *BPTreeDisk) DisableWAL() error {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+	return tree.disableWAL()
+}
+
+func (tree *BPTreeDisk) disableWAL() error {
+	if tree.wal == nil {
+		return nil
+	}
+	if err := tree.checkpointLast(); err != nil {
+		return err
+	}
+	tree.wal.file.Close()
+	tree.wal = nil
+	tree.pager = tree.pager.(*walPager).Pager
+	return os.Remove(tree.fileName + WAL_SUFFIX)
+}
+
+// Step 1: Check the header, a log of another checkpoint is started again
+// Step 2: Apply the records in order, until the end or a torn record
+// Step 3: Cut the log after the last record applied
+func (tree *BPTreeDisk) replayWAL() error {
+	wal := tree.wal
+	data, err := io.ReadAll(wal.file)
+	if err != nil {
+		return err
+	}
+	if len(data) < WAL_HEADER_SIZE || string(data[:8]) != WAL_SIGNATURE ||
+		binary.BigEndian.Uint64(data[8:WAL_HEADER_SIZE]) != tree.generation {
+		return wal.reset(tree.generation)
+	}
+	wal.size = WAL_HEADER_SIZE
+	meta, err := tree.loadMetaPage()
+	if err != nil {
+		return err
+	}
+	for {
+		generation, version, writes, n := parseRecord(data[wal.size:])
+		if n == 0 || generation != wal.generation || version != wal.version+1 {
+			break
+		}
+		for _, write := range writes {
+			if write.op == WAL_DEL {
+				meta, err = tree.del(meta, write.key)
+				if errors.Is(err, ErrNotFound) {
+					err = nil
+				}
+			} else {
+				meta, err = tree.set(meta, write.key, write.val)
+			}
+			if err != nil {
+				return fmt.Errorf("replay log record %d: %w", version, err)
+			}
+		}
+		tree.freePages(tree.reclaim.commitLogged(meta.version, tree.checkpointed))
+		wal.version = version
+		wal.meta = meta
+		wal.size += int64(n)
+	}
+	if isDebugMode {
+		fmt.Printf("replayed %d log records\n", wal.version)
+	}
+	if err := wal.file.Truncate(wal.size); err != nil {
+		return err
+	}
+	return wal.file.Sync()
+}
+
+// Generation, version and writes of the record at the start of data, and its
+// size. Size 0 if there is no complete record.
+func parseRecord(data []byte) (uint64, uint64, []walWrite, int) {
+	if len(data) < 8 {
+		return 0, 0, nil, 0
+	}
+	size := int(binary.BigEndian.Uint32(data))
+	if size > len(data)-8 || crc32.Checksum(data[8:8+size], crc32cTable) != binary.BigEndian.Uint32(data[4:]) {
+		return 0, 0, nil, 0
+	}
+	payload := bytes.NewBuffer(data[8 : 8+size])
+	var generation, version uint64
+	var nwrite uint32
+	if err := binaryRead(payload, &generation, &version, &nwrite); err != nil {
+		return 0, 0, nil, 0
+	}
+	writes := []walWrite{}
+	for i := uint32(0); i < nwrite; i++ {
+		write := walWrite{}
+		if err := write.read_from_buffer(payload); err != nil {
+			return 0, 0, nil, 0
+		}
+		writes = append(writes, write)
+	}
+	return generation, version, writes, 8 + size
+}
+
+// Start an empty log for the checkpoint of generation.
+func (wal *WAL) reset(generation uint64) error {
+	header := binary.BigEndian.AppendUint64([]byte(WAL_SIGNATURE), generation)
+	if err := wal.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := wal.file.WriteAt(header, 0); err != nil {
+		return err
+	}
+	if err := wal.file.Sync(); err != nil {
+		return err
+	}
+	wal.size = WAL_HEADER_SIZE
+	wal.generation = generation
+	wal.version = 0
+	wal.meta = MetaPage{}
+	return nil
+}
+
+// Append a record and sync it. A failed append is cut off, so the next one
+// goes after the last good record.
+func (wal *WAL) append(writes []walWrite) error {
+	payload := new(bytes.Buffer)
+	if err := binaryWrite(payload, wal.generation, wal.version+1, uint32(len(writes))); err != nil {
+		return err
+	}
+	for i := range writes {
+		if err := writes[i].write_to_buffer(payload); err != nil {
+			return err
+		}
+	}
+	record := binary.BigEndian.AppendUint32(nil, uint32(payload.Len()))
+	record = binary.BigEndian.AppendUint32(record, crc32.Checksum(payload.Bytes(), crc32cTable))
+	record = append(record, payload.Bytes()...)
+	_, err := wal.file.WriteAt(record, wal.size)
+	if err == nil {
+		err = wal.file.Sync()
+	}
+	if err != nil {
+		wal.file.Truncate(wal.size)
+		return err
+	}
+	wal.size += int64(len(record))
+	wal.version += 1
+	return nil
+}
+
+// Commit in WAL mode: the writes since the last commit go to the log. A
+// version that cannot be logged (BulkLoad, made from an older meta page) is
+// committed with a checkpoint instead.
+func (tree *BPTreeDisk) commitWAL(metaPage MetaPage) error {
+	writes, ok := tree.reclaim.writesSince(metaPage.version)
+	if !ok || tree.wal.generation != tree.generation {
+		// Or the log was not started again after the last checkpoint
+		return tree.checkpoint(metaPage)
+	}
+	if len(writes) == 0 {
+		return nil
+	}
+	if err := tree.wal.append(writes); err != nil {
+		return err
+	}
+	tree.freePages(tree.reclaim.commitLogged(metaPage.version, tree.checkpointed))
+	tree.wal.meta = metaPage
+	if tree.wal.size >= tree.wal.checkpoint_size || tree.pager.(*walPager).dirtySize() >= tree.wal.dirty_limit {
+		return tree.checkpointLast()
+	}
+	return nil
+}
+
+// Whether the page at ptr is one of the tree of the last checkpoint, rather
+// than written since in memory.
+func (tree *BPTreeDisk) checkpointed(ptr uint64) bool {
+	return !tree.pager.(*walPager).written(ptr)
+}
+
+func (tree *BPTreeDisk) freePages(ptrs []uint64) {
+	for _, ptr := range ptrs {
+		tree.pager.Free(ptr)
+	}
+}
+
+// Write the tree of the last commit to the database file and empty the log.
+// Nothing to do if not in WAL mode.
+func (tree *BPTreeDisk) Checkpoint() error {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+	return tree.checkpointLast()
+}
+
+func (tree *BPTreeDisk) checkpointLast() error {
+	if tree.wal == nil {
+		return nil
+	}
+	metaPage, err := tree.loadMetaPage()
+	if err != nil {
+		return err
+	}
+	return tree.checkpoint(metaPage)
+}
+
+// The meta page is durable before the log is emptied: a crash in between
+// leaves a log of the previous generation, which is not replayed.
+func (tree *BPTreeDisk) checkpoint(metaPage MetaPage) error {
+	if err := tree.writeMetaPage(metaPage); err != nil {
+		return err
+	}
+	return tree.wal.reset(tree.generation)
+}
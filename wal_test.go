@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"maps"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// Random Set / Del on tree with a commit after each, the same on model.
+func walWrites(tb testing.TB, tree *BPTreeDisk, r *rand.Rand, model map[string][]byte, n int) {
+	tb.Helper()
+	meta := must(tree.LoadMetaPage())(tb)
+	for range n {
+		key := intToSlice(int64(r.Intn(200)))
+		if _, ok := model[string(key)]; ok && r.Intn(4) == 0 {
+			meta = must(tree.Del(meta, key))(tb)
+			delete(model, string(key))
+		} else {
+			val := randomBytes(r, 0, 100)
+			if r.Intn(20) == 0 {
+				val = randomBytes(r, MAX_INLINE_VAL_SIZE, 2*BLOCK_SIZE)
+			}
+			meta = must(tree.Set(meta, key, val))(tb)
+			model[string(key)] = val
+		}
+		mustOK(tb, tree.WriteMetaPage(meta))
+	}
+}
+
+func checkContent(t *testing.T, tree *BPTreeDisk, model map[string][]byte) {
+	t.Helper()
+	content := must(treeContent(tree, must(tree.LoadMetaPage())(t)))(t)
+	if !maps.EqualFunc(content, model, bytes.Equal) {
+		t.Errorf("Expected %d keys, got %d, or values not expected", len(model), len(content))
+	}
+}
+
+func TestWAL(t *testing.T) {
+	dbPath := testDBPath(t)
+	r := rand.New(rand.NewSource(1))
+	model := map[string][]byte{}
+	test_db := must(NewBPTreeDisk(dbPath))(t)
+	mustOK(t, test_db.EnableWAL(0))
+	walWrites(t, &test_db, r, model, 300)
+	// Commits only went to the log
+	if test_db.generation != 0 || test_db.wal.version != 300 {
+		t.Errorf("Expected 300 commits in the log, generation 0, got %d, %d", test_db.wal.version, test_db.generation)
+	}
+	// Not committed: not in the log
+	meta := must(test_db.LoadMetaPage())(t)
+	must(test_db.Set(meta, []byte("lost"), []byte("lost")))(t)
+	mustOK(t, test_db.Close())
+
+	// Replayed on open, WAL mode is kept
+	test_db = must(OpenBPTreeDisk(dbPath))(t)
+	if test_db.wal == nil {
+		t.Fatalf("Expected WAL mode after reopen")
+	}
+	checkContent(t, &test_db, model)
+	walWrites(t, &test_db, r, model, 100)
+
+	// Checkpoint: the tree has it all, the log is empty
+	mustOK(t, test_db.Checkpoint())
+	if info := must(os.Stat(dbPath + WAL_SUFFIX))(t); info.Size() != WAL_HEADER_SIZE || test_db.generation != 1 {
+		t.Errorf("Expected an empty log and generation 1, got %d bytes, %d", info.Size(), test_db.generation)
+	}
+	if report := must(test_db.Check())(t); !report.OK() || report.Keys != len(model) {
+		t.Errorf("%d keys, errors:\n%s", report.Keys, checkErrors(report))
+	}
+	walWrites(t, &test_db, r, model, 50)
+	mustOK(t, test_db.Close())
+	test_db = must(OpenBPTreeDisk(dbPath))(t)
+	checkContent(t, &test_db, model)
+
+	// Back to commits to the tree
+	mustOK(t, test_db.DisableWAL())
+	if _, err := os.Stat(dbPath + WAL_SUFFIX); !os.IsNotExist(err) {
+		t.Errorf("Expected no log after DisableWAL, got %v", err)
+	}
+	walWrites(t, &test_db, r, model, 10)
+	mustOK(t, test_db.Close())
+	test_db = must(OpenBPTreeDisk(dbPath))(t)
+	defer test_db.Close()
+	if test_db.wal != nil {
+		t.Errorf("Expected no WAL mode")
+	}
+	checkContent(t, &test_db, model)
+}
+
+func TestWAL_PagesInMemory(t *testing.T) {
+	dbPath := testDBPath(t)
+	test_db := must(NewBPTreeDisk(dbPath))(t)
+	mustOK(t, test_db.EnableWAL(0))
+	before := must(os.Stat(dbPath))(t).Size()
+	model := map[string][]byte{}
+	meta := must(test_db.LoadMetaPage())(t)
+	for i := range 2000 {
+		key := intToSlice(int64(i % 50))
+		meta = must(test_db.Set(meta, key, textValue(i)))(t)
+		model[string(key)] = textValue(i)
+		mustOK(t, test_db.WriteMetaPage(meta))
+	}
+	// Only the log changed, pages of the commits in it are reused
+	if size := must(os.Stat(dbPath))(t).Size(); size != before {
+		t.Errorf("Expected a database file of %d bytes before the checkpoint, got %d", before, size)
+	}
+	if last_free := test_db.pager.allocator().last_free; last_free > 10 {
+		t.Errorf("Expected pages to be reused between checkpoints, last_free = %d", last_free)
+	}
+	// Replayed from the log on open
+	mustOK(t, test_db.Close())
+	test_db = must(OpenBPTreeDisk(dbPath))(t)
+	defer test_db.Close()
+	checkContent(t, &test_db, model)
+	mustOK(t, test_db.Checkpoint())
+	if size := must(os.Stat(dbPath))(t).Size(); size > 10*BLOCK_SIZE {
+		t.Errorf("Expected a small database file after the checkpoint, got %d bytes", size)
+	}
+	if report := must(test_db.Check())(t); !report.OK() || report.Keys != 50 {
+		t.Errorf("%d keys, errors:\n%s", report.Keys, checkErrors(report))
+	}
+}
+
+func TestWAL_Check(t *testing.T) {
+	dbPath := testDBPath(t)
+	r := rand.New(rand.NewSource(4))
+	model := map[string][]byte{}
+	test_db := must(NewBPTreeDisk(dbPath))(t)
+	walWrites(t, &test_db, r, model, 100)
+	mustOK(t, test_db.EnableWAL(0))
+	walWrites(t, &test_db, r, model, 200)
+
+	// Commits only in the log are checked against the allocator in memory
+	if report := must(test_db.Check())(t); !report.OK() || report.Keys != len(model) {
+		t.Errorf("%d keys, errors:\n%s", report.Keys, checkErrors(report))
+	}
+	epoch := test_db.Pin()
+	walWrites(t, &test_db, r, model, 50)
+	if report := must(test_db.Check())(t); !report.OK() || report.Keys != len(model) {
+		t.Errorf("With a pinned reader: %d keys, errors:\n%s", report.Keys, checkErrors(report))
+	}
+	test_db.Unpin(epoch)
+	mustOK(t, test_db.Close())
+
+	// Replayed on open, or not by fsck
+	test_db = must(OpenBPTreeDisk(dbPath))(t)
+	defer test_db.Close()
+	if report := must(test_db.Check())(t); !report.OK() || report.Keys != len(model) {
+		t.Errorf("After replay: %d keys, errors:\n%s", report.Keys, checkErrors(report))
+	}
+	out := new(bytes.Buffer)
+	if code := runCommand([]string{"fsck", dbPath}, out, out); code != 0 {
+		t.Errorf("fsck with a log: exit code %d, output:\n%s", code, out)
+	}
+}
+
+func TestWAL_TornRecord(t *testing.T) {
+	dbPath := testDBPath(t)
+	r := rand.New(rand.NewSource(2))
+	model := map[string][]byte{}
+	test_db := must(NewBPTreeDisk(dbPath))(t)
+	mustOK(t, test_db.EnableWAL(0))
+	walWrites(t, &test_db, r, model, 50)
+	before := test_db.wal.size
+	mustOK(t, test_db.Close())
+
+	// Half of a record after the last good one is cut off
+	log := must(os.ReadFile(dbPath + WAL_SUFFIX))(t)
+	torn := append(bytes.Clone(log), log[WAL_HEADER_SIZE:WAL_HEADER_SIZE+20]...)
+	mustOK(t, os.WriteFile(dbPath+WAL_SUFFIX, torn, 0644))
+	test_db = must(OpenBPTreeDisk(dbPath))(t)
+	checkContent(t, &test_db, model)
+	if test_db.wal.size != before {
+		t.Errorf("Expected the log cut at %d, got %d", before, test_db.wal.size)
+	}
+	mustOK(t, test_db.Close())
+
+	// A record that does not match its checksum ends the log
+	log[len(log)-1] ^= 0xFF
+	mustOK(t, os.WriteFile(dbPath+WAL_SUFFIX, log, 0644))
+	test_db = must(OpenBPTreeDisk(dbPath))(t)
+	defer test_db.Close()
+	if test_db.wal.version != 49 {
+		t.Errorf("Expected 49 records replayed, got %d", test_db.wal.version)
+	}
+}
+
+func TestWAL_Checkpoint(t *testing.T) {
+	dbPath := testDBPath(t)
+	r := rand.New(rand.NewSource(3))
+	model := map[string][]byte{}
+	test_db := must(NewBPTreeDisk(dbPath))(t)
+	mustOK(t, test_db.EnableWAL(16*1024))
+	walWrites(t, &test_db, r, model, 20)
+	oldLog := must(os.ReadFile(dbPath + WAL_SUFFIX))(t)
+	// Checkpoints on their own once the log is big, pages are reused
+	walWrites(t, &test_db, r, model, 1000)
+	if test_db.generation == 0 || test_db.wal.size > 16*1024 {
+		t.Errorf("Expected checkpoints, generation %d, log of %d bytes", test_db.generation, test_db.wal.size)
+	}
+	if last_free := test_db.pager.allocator().last_free; last_free > 300 {
+		t.Errorf("Expected pages to be reused after checkpoints, last_free = %d", last_free)
+	}
+	// BulkLoad cannot be logged, it is a checkpoint
+	generation := test_db.generation
+	mustOK(t, test_db.WriteMetaPage(must(test_db.BulkLoad(sortedTestPairs(100), 1))(t)))
+	if test_db.generation != generation+1 || test_db.wal.version != 0 {
+		t.Errorf("Expected a checkpoint for BulkLoad")
+	}
+	model = map[string][]byte{}
+	for key, val := range sortedTestPairs(100) {
+		model[string(key)] = val
+	}
+	walWrites(t, &test_db, r, model, 20)
+	mustOK(t, test_db.Checkpoint())
+	if report := must(test_db.Check())(t); !report.OK() {
+		t.Errorf("Errors after checkpoints:\n%s", checkErrors(report))
+	}
+	mustOK(t, test_db.Close())
+
+	// Log of an older checkpoint, as after a crash just before it was emptied
+	mustOK(t, os.WriteFile(dbPath+WAL_SUFFIX, oldLog, 0644))
+	test_db = must(OpenBPTreeDisk(dbPath))(t)
+	defer test_db.Close()
+	if test_db.wal.version != 0 {
+		t.Errorf("Expected the old log not to be replayed, got %d records", test_db.wal.version)
+	}
+	checkContent(t, &test_db, model)
+
+	// Compaction replaces the file, the log goes on with the new one
+	c := must(test_db.StartCompaction())(t)
+	walWrites(t, &test_db, r, model, 20)
+	mustOK(t, c.CatchUp())
+	checkContent(t, &c.dst, model)
+	mustOK(t, c.Finish())
+	if test_db.wal == nil {
+		t.Fatalf("Expected WAL mode after CompactOnline")
+	}
+	walWrites(t, &test_db, r, model, 20)
+	checkContent(t, &test_db, model)
+}
+
+func TestWAL_DirtyLimit(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	model := map[string][]byte{}
+	test_db := must(NewBPTreeDisk(testDBPath(t)))(t)
+	defer test_db.Close()
+	mustOK(t, test_db.EnableWAL(1<<30))
+	test_db.wal.dirty_limit = 8 * BLOCK_SIZE
+	// The log stays small, the pages kept in memory do not
+	walWrites(t, &test_db, r, model, 200)
+	if test_db.generation == 0 {
+		t.Errorf("Expected checkpoints once %d bytes of pages are in memory", test_db.wal.dirty_limit)
+	}
+	if size := test_db.pager.(*walPager).dirtySize(); size >= test_db.wal.dirty_limit {
+		t.Errorf("Expected less than %d bytes of pages in memory, got %d", test_db.wal.dirty_limit, size)
+	}
+	checkContent(t, &test_db, model)
+}
+
+func TestWAL_StaleRecords(t *testing.T) {
+	dbPath := testDBPath(t)
+	r := rand.New(rand.NewSource(5))
+	model := map[string][]byte{}
+	test_db := must(NewBPTreeDisk(dbPath))(t)
+	mustOK(t, test_db.EnableWAL(0))
+	walWrites(t, &test_db, r, model, 20)
+	oldLog := must(os.ReadFile(dbPath + WAL_SUFFIX))(t)
+	mustOK(t, test_db.Checkpoint())
+	newLog := must(os.ReadFile(dbPath + WAL_SUFFIX))(t)
+	mustOK(t, test_db.Close())
+
+	// The header of the new checkpoint over the records of the old one, as
+	// after a crash that kept the header but not the truncation
+	stale := append(bytes.Clone(newLog), oldLog[WAL_HEADER_SIZE:]...)
+	mustOK(t, os.WriteFile(dbPath+WAL_SUFFIX, stale, 0644))
+	test_db = must(OpenBPTreeDisk(dbPath))(t)
+	defer test_db.Close()
+	if test_db.wal.version != 0 {
+		t.Errorf("Expected the old records not to be replayed, got %d records", test_db.wal.version)
+	}
+	checkContent(t, &test_db, model)
+}
+
+// Insert of a key that exists fails, so replay builds the tree committed.
+func TestWAL_InsertExisting(t *testing.T) {
+	dbPath := testDBPath(t)
+	test_db := must(NewBPTreeDisk(dbPath))(t)
+	mustOK(t, test_db.EnableWAL(0))
+	meta := must(test_db.LoadMetaPage())(t)
+	meta = must(test_db.Insert(meta, []byte("a"), []byte("1")))(t)
+	if _, err := test_db.Insert(meta, []byte("a"), []byte("2")); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("Insert of an existing key: expected ErrKeyExists, got %v", err)
+	}
+	mustOK(t, test_db.WriteMetaPage(meta))
+	model := map[string][]byte{"a": []byte("1")}
+	checkContent(t, &test_db, model)
+
+	// Crash before a checkpoint: the tree is replayed from the log
+	mustOK(t, test_db.Close())
+	test_db = must(OpenBPTreeDisk(dbPath))(t)
+	defer test_db.Close()
+	if test_db.generation != 0 {
+		t.Fatalf("Expected the commit in the log, generation 0, got %d", test_db.generation)
+	}
+	checkContent(t, &test_db, model)
+	if report := must(test_db.Check())(t); !report.OK() || report.Keys != 1 {
+		t.Errorf("%d keys, errors:\n%s", report.Keys, checkErrors(report))
+	}
+}